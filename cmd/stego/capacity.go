@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+
+	"dennis-tra/image-stego/pkg/stego"
+)
+
+func capacity(filepath string, opts stego.EncodeOptions) []*record {
+	pages, _, failed := openPages(filepath)
+	if failed != nil {
+		return []*record{failed}
+	}
+
+	for _, p := range pages {
+		logPage(p, len(pages))
+		capacityPage(p, opts)
+	}
+
+	return records(pages)
+}
+
+func capacityPage(p *page, opts stego.EncodeOptions) *record {
+	rec := p.rec
+
+	log.Println("Calculating the chunk grid of the image...")
+	report, err := stego.Inspect(p.img, opts)
+	if err != nil {
+		return rec.fail(encodeExitCode(err), err)
+	}
+	rec.Grid = &grid{Cols: report.Cols, Rows: report.Rows}
+	rec.Capacity = newCapacityInfo(report)
+
+	log.Printf("Image of %dx%d pixels is divided into %dx%d chunks\n", report.Width, report.Height, report.Cols, report.Rows)
+	log.Printf("Chunk size: %dx%d to %dx%d pixels\n", report.MinChunkSize.X, report.MinChunkSize.Y, report.MaxChunkSize.X, report.MaxChunkSize.Y)
+	log.Printf("Smallest detectable region: %dx%d pixels\n", report.MinRegionSize.X, report.MinRegionSize.Y)
+	c := rec.Capacity
+	log.Printf("Required bits per chunk: %d to %d\n", c.MinRequiredBits, c.MaxRequiredBits)
+	log.Printf("Available bits per chunk: %d to %d\n", c.MinAvailableBits, c.MaxAvailableBits)
+	log.Printf("Spare bytes per chunk: %d to %d\n", c.MinSpareBytes, c.MaxSpareBytes)
+	log.Printf("Total free payload: %d bytes, of which %d bytes can hold a message\n", report.FreeBytes, report.MessageCapacity)
+
+	return rec
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"path"
+
+	"dennis-tra/image-stego/internal/chunk"
+	"dennis-tra/image-stego/pkg/stego"
+)
+
+func decode(filepath string, opts stego.DecodeOptions) []*record {
+	pages, format, failed := openPages(filepath)
+	if failed != nil {
+		return []*record{failed}
+	}
+
+	if opts.Proof == nil && format == chunk.FormatPNG.String() {
+		data, err := chunk.OpenPNGChunk(filepath, stego.PNGChunkType, stego.MaxPNGProofLength)
+		if err == nil {
+			log.Println("Found proof embedded in PNG chunk", stego.PNGChunkType)
+			opts.Proof = &stego.Proof{}
+			if err = opts.Proof.UnmarshalBinary(data); err != nil {
+				return []*record{pages[0].rec.fail(exitUnverifiable, err)}
+			}
+		} else if err != chunk.ErrPNGChunkNotFound {
+			return []*record{pages[0].rec.fail(exitIOError, err)}
+		}
+	}
+
+	for _, p := range pages {
+		logPage(p, len(pages))
+		decodePage(p, filepath, opts)
+	}
+
+	return records(pages)
+}
+
+func decodePage(p *page, filepath string, opts stego.DecodeOptions) *record {
+	rec := p.rec
+
+	log.Println("Calculating Merkle tree roots for every chunk...")
+	report, err := stego.Decode(p.img, opts)
+	if err != nil {
+		return rec.fail(exitUnverifiable, err)
+	}
+
+	cols, rows := report.Grid()
+	rec.Verdict = report.Verdict.String()
+	rec.MerkleRoot = hex.EncodeToString(report.MerkleRoot)
+	rec.ExpectedRoot = report.Expected
+	rec.RecoveredRoot = report.Recovered
+	rec.Grid = &grid{Cols: cols, Rows: rows}
+
+	if report.Cropped() {
+		rec.Crop = &crop{
+			OriginalWidth:  report.Original.Dx(),
+			OriginalHeight: report.Original.Dy(),
+			X:              report.Region.Min.X,
+			Y:              report.Region.Min.Y,
+			Width:          report.Region.Dx(),
+			Height:         report.Region.Dy(),
+		}
+		log.Printf("This image was cropped. It covers the region %v of the original %dx%d image. Only the %d chunks that lie completely within this region are verified.\n",
+			report.Region, report.Original.Dx(), report.Original.Dy(), len(report.Chunks))
+	}
+
+	if report.Signature != nil {
+		rec.Signature = &signature{
+			Algorithm: report.Signature.Algorithm,
+			KeyID:     report.Signature.KeyID,
+			Signer:    report.Signature.Signer,
+			Verified:  report.Signature.Verified,
+		}
+
+		if report.Signature.Verified {
+			log.Printf("The Merkle Root was signed by %s (%s key id %x)\n", report.Signature.Signer, report.Signature.Algorithm, report.Signature.KeyID)
+		} else if len(opts.TrustedKeys) == 0 {
+			log.Printf("The Merkle Root was signed (%s key id %x). Pass -verify-key to verify the signature.\n", report.Signature.Algorithm, report.Signature.KeyID)
+		} else {
+			log.Printf("The signature of the Merkle Root (%s key id %x) could not be verified with any trusted key!\n", report.Signature.Algorithm, report.Signature.KeyID)
+		}
+	} else if len(opts.TrustedKeys) > 0 {
+		log.Println("This image was not signed!")
+	}
+
+	switch report.Verdict {
+	case stego.Intact:
+		// An intact image is only authentic if a trusted key vouches for it
+		if len(opts.TrustedKeys) > 0 && (report.Signature == nil || !report.Signature.Verified) {
+			rec.exitCode = exitUnverifiable
+		}
+
+		if report.Expected {
+			log.Println("This image has not been tampered with. All chunks lead to the expected Merkle Root:", rec.MerkleRoot)
+		} else if opts.Proof != nil {
+			log.Println("This image has not been tampered with. All chunks lead to the Merkle Root of the proof:", rec.MerkleRoot)
+		} else {
+			log.Println("This image has not been tampered with. All chunks have the same Merkle Root:", rec.MerkleRoot)
+		}
+		return rec
+	case stego.Unverifiable:
+		log.Println("This image could not be verified. No two chunks lead to the same Merkle Root. Was it encoded?")
+		if !report.Expected {
+			rec.MerkleRoot = ""
+		}
+		rec.exitCode = exitUnverifiable
+		return rec
+	}
+
+	rec.exitCode = exitTampered
+	for _, c := range report.TamperedChunks() {
+		rec.TamperedChunks = append(rec.TamperedChunks, c.Index)
+	}
+
+	if len(report.MerkleRoot) == 0 {
+		log.Println("No two chunks lead to the same Merkle Root with the given key. This image was encoded without the key or has been tampered with!")
+	} else {
+		if report.Expected {
+			log.Println("Found chunks that don't lead to the expected Merkle Root. This image has been tampered with! RootHashes:")
+		} else if opts.Proof != nil {
+			log.Println("Found chunks that don't lead to the Merkle Root of the proof. This image has been tampered with! RootHashes:")
+		} else if report.Recovered {
+			log.Println("Found chunks that don't lead to the Merkle Root recovered from the image metadata. This image has been tampered with! RootHashes:")
+		} else {
+			log.Println("Found multiple Merkle Roots. This image has been tampered with! RootHashes:")
+		}
+
+		log.Println("Count\tRoot")
+		for root, count := range report.RootCounts() {
+			log.Printf("%5d\t%s\n", count, root)
+		}
+	}
+
+	log.Println("Drawing overlay image of altered regions...")
+	overlayImg := stego.OverlayImage(p.img, report)
+
+	overlayFilepath := path.Join(path.Dir(filepath), chunk.SetExtension(p.filename, ".overlay.png"))
+	log.Println("Saving overlay image:", overlayFilepath)
+	err = chunk.SaveImageFile(overlayFilepath, overlayImg)
+	if err != nil {
+		return rec.fail(exitIOError, err)
+	}
+	rec.Outputs = append(rec.Outputs, overlayFilepath)
+
+	return rec
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"path"
+
+	"dennis-tra/image-stego/internal/chunk"
+	"dennis-tra/image-stego/pkg/stego"
+)
+
+func encode(filepath string, outdir string, format chunk.Format, check bool, opts stego.EncodeOptions) []*record {
+	filename := path.Base(filepath)
+
+	pages, inputFormat, failed := openPages(filepath)
+	if failed != nil {
+		return []*record{failed}
+	}
+
+	// Without an explicit format the encoded image keeps the format of the image file if it can be written
+	if format == 0 {
+		var err error
+		if format, err = chunk.ParseFormat(inputFormat); err != nil || opts.Mode == stego.ModePNGChunk {
+			format = chunk.FormatPNG
+		}
+
+		if errors.Is(err, chunk.ErrLossyFormat) && opts.Mode != stego.ModeSidecar {
+			log.Printf("The image file is a lossy %s file. The encoded image is saved as %s instead, as lossy compression would destroy the Merkle tree information\n", inputFormat, format)
+		}
+	}
+
+	if len(pages) > 1 && opts.Mode != stego.ModeSidecar && format != chunk.FormatTIFF {
+		err := fmt.Errorf("the %d pages of the image can only be saved in a tiff file", len(pages))
+		return []*record{pages[0].rec.fail(exitUsage, err)}
+	}
+
+	var encodedImgs []image.Image
+	var encodeds []*stego.Encoded
+	for _, p := range pages {
+		logPage(p, len(pages))
+
+		encoded := encodePage(p, outdir, format, opts)
+		if encoded == nil {
+			return records(pages)
+		}
+		encodedImgs = append(encodedImgs, encoded.Image)
+		encodeds = append(encodeds, encoded)
+	}
+
+	if opts.Mode == stego.ModeSidecar {
+		if check {
+			selfCheck(filepath, outdir, pages, encodeds, opts)
+		}
+		return records(pages)
+	}
+
+	var pngChunks []chunk.PNGChunk
+	if opts.Mode == stego.ModePNGChunk {
+		data, err := encodeds[0].Proof.MarshalBinary()
+		if err != nil {
+			return []*record{pages[0].rec.fail(exitIOError, err)}
+		}
+		pngChunks = append(pngChunks, chunk.PNGChunk{Type: stego.PNGChunkType, Data: data})
+	}
+
+	// The extension of the image file is kept if it denotes the format already, e.g. .tif
+	ext := format.Extension()
+	if f, ok := chunk.FormatOf(filename); ok && f == format {
+		ext = path.Ext(filename)
+	}
+
+	encodedFilepath := path.Join(outdir, chunk.SetExtension(filename, ext))
+	log.Println("Saving encoded image:", encodedFilepath)
+	var err error
+	if len(encodedImgs) > 1 {
+		err = chunk.SaveImagePages(encodedFilepath, encodedImgs)
+	} else {
+		err = chunk.SaveImageFile(encodedFilepath, encodedImgs[0], pngChunks...)
+	}
+	if err != nil {
+		return []*record{pages[0].rec.fail(exitIOError, err)}
+	}
+
+	for _, p := range pages {
+		p.rec.Outputs = append(p.rec.Outputs, encodedFilepath)
+	}
+
+	if check {
+		selfCheck(encodedFilepath, outdir, pages, encodeds, opts)
+	}
+
+	return records(pages)
+}
+
+// encodePage encodes the given page and saves its checker pattern overlay image and, in ModeSidecar, its
+// proof file. It returns nil if the page could not be encoded.
+func encodePage(p *page, outdir string, format chunk.Format, opts stego.EncodeOptions) *stego.Encoded {
+	rec := p.rec
+
+	originalImg := p.img
+	if opts.Mode != stego.ModeSidecar {
+		if originalImg = format.Convert(p.img); originalImg != p.img {
+			log.Printf("Converting the image to a color model that %s files store losslessly\n", format)
+		}
+	}
+
+	if opts.Message != nil {
+		capacity, err := stego.Capacity(originalImg, opts)
+		if err != nil {
+			rec.fail(encodeExitCode(err), err)
+			return nil
+		}
+
+		log.Printf("Hiding a message of %d bytes in the image, which can hide up to %d bytes\n", len(opts.Message), capacity)
+		if len(opts.Message) > capacity {
+			rec.fail(exitUsage, stego.ErrMessageTooLarge)
+			return nil
+		}
+	}
+
+	if opts.Mode == stego.ModeLSB {
+		log.Println("Encoding Merkle Tree information into LSBs of the image")
+	} else {
+		log.Println("Calculating Merkle Tree information of the image")
+	}
+	encoded, err := stego.Encode(originalImg, opts)
+	if err != nil {
+		rec.fail(encodeExitCode(err), err)
+		return nil
+	}
+	rec.MerkleRoot = hex.EncodeToString(encoded.MerkleRoot)
+	rec.Grid = &grid{Cols: len(encoded.Bounds), Rows: len(encoded.Bounds[0])}
+	log.Println("Merkle Tree Root Hash:", rec.MerkleRoot)
+
+	log.Println("Drawing checker pattern overlay image...")
+	checkerImg := stego.CheckerImage(originalImg, encoded.Bounds)
+
+	checkerFilepath := path.Join(outdir, chunk.SetExtension(p.filename, ".checker.png"))
+	log.Println("Saving checker pattern overlay image:", checkerFilepath)
+	err = chunk.SaveImageFile(checkerFilepath, checkerImg)
+	if err != nil {
+		rec.fail(exitIOError, err)
+		return nil
+	}
+	rec.Outputs = append(rec.Outputs, checkerFilepath)
+
+	if opts.Mode == stego.ModeSidecar {
+		proofFilepath := path.Join(outdir, chunk.SetExtension(p.filename, ".proof.json"))
+		log.Println("Saving sidecar proof file:", proofFilepath)
+		err = saveProofFile(proofFilepath, encoded.Proof)
+		if err != nil {
+			rec.fail(exitIOError, err)
+			return nil
+		}
+		rec.Outputs = append(rec.Outputs, proofFilepath)
+	}
+
+	return encoded
+}
+
+// selfCheck reads the saved encoded image file, or the unaltered image file in ModeSidecar, along with the saved
+// proofs and verifies every page with stego.SelfCheck. Pages that don't verify are recorded as failed.
+func selfCheck(filepath string, outdir string, pages []*page, encodeds []*stego.Encoded, opts stego.EncodeOptions) {
+	log.Println("Verifying the saved image file:", filepath)
+	imgs, _, err := chunk.OpenImagePages(filepath)
+	if err == nil && len(imgs) != len(pages) {
+		err = fmt.Errorf("%w: the image file holds %d instead of %d pages", stego.ErrSelfCheckFailed, len(imgs), len(pages))
+	}
+	if err != nil {
+		for _, p := range pages {
+			p.rec.fail(exitIOError, err)
+		}
+		return
+	}
+
+	for i, p := range pages {
+		saved := *encodeds[i]
+		switch opts.Mode {
+		case stego.ModeSidecar:
+			saved.Proof, err = openProofFile(path.Join(outdir, chunk.SetExtension(p.filename, ".proof.json")))
+		case stego.ModePNGChunk:
+			var data []byte
+			if data, err = chunk.OpenPNGChunk(filepath, stego.PNGChunkType, stego.MaxPNGProofLength); err == nil {
+				saved.Proof = &stego.Proof{}
+				err = saved.Proof.UnmarshalBinary(data)
+			}
+		}
+		if err != nil {
+			p.rec.fail(exitIOError, err)
+			continue
+		}
+
+		if err = stego.SelfCheck(imgs[i], &saved, opts); err != nil {
+			p.rec.fail(exitUnverifiable, err)
+			continue
+		}
+		logPage(p, len(pages))
+		log.Println("The saved image passed the self-check")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"path"
+
+	"dennis-tra/image-stego/internal/chunk"
+	"dennis-tra/image-stego/pkg/stego"
+)
+
+func extract(filepath string, outdir string, opts stego.DecodeOptions) []*record {
+	pages, _, failed := openPages(filepath)
+	if failed != nil {
+		return []*record{failed}
+	}
+
+	for _, p := range pages {
+		logPage(p, len(pages))
+		extractPage(p, outdir, opts)
+	}
+
+	return records(pages)
+}
+
+func extractPage(p *page, outdir string, opts stego.DecodeOptions) *record {
+	rec := p.rec
+
+	log.Println("Extracting the hidden message from the LSBs of the image...")
+	report, err := stego.Decode(p.img, opts)
+	if err != nil {
+		return rec.fail(exitUnverifiable, err)
+	}
+	rec.Verdict = report.Verdict.String()
+	rec.MerkleRoot = hex.EncodeToString(report.MerkleRoot)
+
+	message, err := report.Message()
+	if errors.Is(err, stego.ErrMessageCorrupted) {
+		return rec.fail(exitTampered, err)
+	} else if err != nil {
+		return rec.fail(exitUnverifiable, err)
+	}
+
+	if report.Verdict != stego.Intact {
+		log.Printf("The message is intact, but the image is %s!\n", report.Verdict)
+	}
+
+	messageFilepath := path.Join(outdir, chunk.SetExtension(p.filename, ".message"))
+	log.Printf("Saving hidden message of %d bytes: %s\n", len(message), messageFilepath)
+	if err = ioutil.WriteFile(messageFilepath, message, 0o644); err != nil {
+		return rec.fail(exitIOError, err)
+	}
+	rec.Outputs = append(rec.Outputs, messageFilepath)
+
+	return rec
+}
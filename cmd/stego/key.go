@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"dennis-tra/image-stego/pkg/stego"
+)
+
+// keyEnv is the environment variable that holds the secret key if neither -key nor -key-file is given.
+const keyEnv = "STEGO_KEY"
+
+// errKeyConflict is returned if the secret key is given via -key and -key-file at the same time.
+var errKeyConflict = errors.New("the key can only be given via -key or -key-file")
+
+// errEncryptionKeyConflict is returned if the encryption key is given via -encryption-key and -encryption-key-file at the same time.
+var errEncryptionKeyConflict = errors.New("the encryption key can only be given via -encryption-key or -encryption-key-file")
+
+// loadKey returns the secret key from the given flag value, the given key file or the STEGO_KEY
+// environment variable in this order. Trailing line breaks of the key file are removed. It returns
+// nil if no key is given.
+func loadKey(key string, keyFile string) ([]byte, error) {
+	if key != "" && keyFile != "" {
+		return nil, errKeyConflict
+	}
+
+	if key != "" {
+		return []byte(key), nil
+	}
+
+	if keyFile != "" {
+		return readKeyFile(keyFile)
+	}
+
+	if env := os.Getenv(keyEnv); env != "" {
+		return []byte(env), nil
+	}
+
+	return nil, nil
+}
+
+// loadEncryptionKey returns the encryption key from the given flag value or the given key file.
+// Trailing line breaks of the key file are removed. It returns nil if no encryption key is given.
+func loadEncryptionKey(key string, keyFile string) ([]byte, error) {
+	if key != "" && keyFile != "" {
+		return nil, errEncryptionKeyConflict
+	}
+
+	if keyFile != "" {
+		return readKeyFile(keyFile)
+	}
+
+	if key != "" {
+		return []byte(key), nil
+	}
+
+	return nil, nil
+}
+
+// readKeyFile returns the content of the given key file without trailing line breaks.
+func readKeyFile(keyFile string) ([]byte, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimRight(data, "\r\n")
+	if len(data) == 0 {
+		return nil, errors.New("key file is empty")
+	}
+
+	return data, nil
+}
+
+// loadSigner reads a PEM encoded Ed25519 or ECDSA private key in PKCS #8 or SEC 1 form from the given file.
+func loadSigner(keyFile string) (crypto.Signer, error) {
+	block, err := readPEM(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", keyFile, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyFile, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", keyFile, key)
+	}
+
+	return signer, nil
+}
+
+// loadTrustedKeys reads the PEM encoded public key in PKIX form from the given file. If the given path is a
+// directory all *.pem files in it are read. Every key is named after its file name without the extension.
+func loadTrustedKeys(keyPath string) ([]stego.TrustedKey, error) {
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{keyPath}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(keyPath, "*.pem")); err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+	}
+
+	keys := []stego.TrustedKey{}
+	for _, file := range files {
+		block, err := readPEM(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("%s: unsupported PEM block %q", file, block.Type)
+		}
+
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		keys = append(keys, stego.TrustedKey{Name: name, PublicKey: pub})
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no *.pem files found", keyPath)
+	}
+
+	return keys, nil
+}
+
+// readPEM returns the first PEM block of the given file.
+func readPEM(file string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", file)
+	}
+
+	return block, nil
+}
@@ -1,20 +1,50 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
 
 	"dennis-tra/image-stego/internal/chunk"
+	"dennis-tra/image-stego/pkg/stego"
 )
 
 func main() {
 
 	decodePtr := flag.Bool("d", false, "Whether to decode the given image file(s)")
 	encodePtr := flag.Bool("e", false, "Whether to encode the given image file(s)")
-	outputPtr := flag.String("o", "", "Output directory of an encoded image")
+	capacityPtr := flag.Bool("capacity", false, "Whether to report the chunk grid and the spare capacity of the given image file(s) with the encoding flags without encoding them")
+	extractPtr := flag.Bool("x", false, "Whether to extract the hidden message of the given image file(s) (see -embed) into the output directory")
+	embedPtr := flag.String("embed", "", "File whose content is hidden in the LSBs of an encoded image that are left over by the Merkle tree information")
+	outputPtr := flag.String("o", "", "Output directory of an encoded image or an extracted message")
+	rootPtr := flag.String("root", "", "Hex encoded Merkle root to verify the given image file(s) against")
+	formatPtr := flag.String("format", "", "Image format of an encoded image: png, tiff, bmp or webp. Lossy formats like jpeg are refused. Defaults to the format of the given image file(s) if it can be written and png otherwise, e.g. for jpeg files")
+	selfCheckPtr := flag.Bool("self-check", true, "Whether to verify an encoded image by reading the saved image file again and decoding it before reporting success")
+	modePtr := flag.String("mode", "lsb", "Where to store the Merkle tree information of an encoded image: lsb (least significant bits), sidecar (separate proof file) or png (PNG ancillary chunk)")
+	channelsPtr := flag.String("channels", "rgb", "Color channels whose least significant bits carry the Merkle tree information of an encoded image (any subset of r, g, b and a). The header and locator at the beginning of every chunk are always stored in the r, g and b channels")
+	planesPtr := flag.Int("planes", 1, "Number of low bits per channel (1-4) that carry the Merkle tree information of an encoded image. More planes allow a finer tamper localisation at the cost of more visible noise")
+	rowHashBitsPtr := flag.Int("row-hash-bits", 0, "Number of bits (1-32) of an additional hash of every pixel row of a chunk to localise modifications within tampered chunks. 0 disables row hashes")
+	hashPtr := flag.String("hash", "sha256", "Hash algorithm of the chunk hashes and Merkle nodes of an encoded image: sha256, sha512/256, sha3-256, blake2b-256 or blake3")
+	hashBitsPtr := flag.Int("hash-bits", 256, "Number of bits (64-256, multiple of 8) the chunk hashes and Merkle nodes of an encoded image are truncated to. Shorter hashes allow a finer tamper localisation at the cost of a weaker collision resistance")
+	keyPtr := flag.String("key", "", "Secret key to encode or decode the given image file(s) with keyed hashes. Only key holders can produce a valid encoding. Defaults to the STEGO_KEY environment variable")
+	keyFilePtr := flag.String("key-file", "", "File holding the secret key to encode or decode the given image file(s) with keyed hashes (see -key)")
+	scatterPtr := flag.Bool("scatter", false, "Whether to spread the Merkle tree information of an encoded image pseudo-randomly across every chunk. Requires a secret key (see -key)")
+	skipTransparentPtr := flag.Bool("skip-transparent", false, "Whether to exclude fully transparent pixels from carrying the Merkle tree information of an encoded image, so that premultiplying alpha doesn't invalidate it. The alpha channel must not be selected (see -channels)")
+	signKeyPtr := flag.String("sign-key", "", "PEM encoded Ed25519 or ECDSA P-256 private key to sign the Merkle root of an encoded image with")
+	verifyKeyPtr := flag.String("verify-key", "", "PEM encoded public key or directory of *.pem public keys to verify the signature of the given image file(s) against")
+	encryptionKeyPtr := flag.String("encryption-key", "", "Passphrase (or raw 32 byte key with -kdf=none) to encrypt or decrypt the Merkle tree information of the given image file(s)")
+	encryptionKeyFilePtr := flag.String("encryption-key-file", "", "File holding the passphrase or key to encrypt or decrypt the Merkle tree information of the given image file(s) (see -encryption-key)")
+	cipherPtr := flag.String("cipher", "aes-256-gcm", "Authenticated cipher that encrypts the Merkle tree information of an encoded image: aes-256-gcm or chacha20-poly1305")
+	kdfPtr := flag.String("kdf", "argon2id", "Function that derives the key of the cipher from the encryption key of an encoded image: argon2id, scrypt or none")
+	proofPtr := flag.String("proof", "", "Sidecar proof file to verify the given image file(s) against")
+	jsonPtr := flag.Bool("json", false, "Whether to print one JSON record per image file (per page of multi-page files) to stdout instead of log output")
 
+	flag.Usage = usage
 	flag.Parse()
 
 	cwd, err := os.Getwd()
@@ -22,28 +52,218 @@ func main() {
 		log.Fatal(err)
 	}
 
-	if _, err := os.Stat(path.Join(cwd, *outputPtr)); *encodePtr && os.IsNotExist(err) {
+	if _, err := os.Stat(path.Join(cwd, *outputPtr)); (*encodePtr || *extractPtr) && os.IsNotExist(err) {
 		log.Println("Output directory does not exist")
-		flag.PrintDefaults()
-		os.Exit(1)
+		flag.Usage()
+		os.Exit(exitUsage)
 	}
 
-	if *decodePtr == *encodePtr {
-		log.Println("Incompatible combination of decode and encode flags")
-		log.Println("Please specify weather you want to encode -e or decode -d the image file(s)")
-		flag.PrintDefaults()
-		os.Exit(1)
+	if modes := countTrue(*decodePtr, *encodePtr, *extractPtr, *capacityPtr); modes != 1 {
+		log.Println("Incompatible combination of decode, encode, extract and capacity flags")
+		log.Println("Please specify weather you want to encode -e, decode -d, extract -x or report the capacity -capacity of the image file(s)")
+		flag.Usage()
+		os.Exit(exitUsage)
 	}
 
+	expectedRoot, err := hex.DecodeString(*rootPtr)
+	if err != nil {
+		log.Println("Invalid Merkle root:", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	key, err := loadKey(*keyPtr, *keyFilePtr)
+	if err == errKeyConflict {
+		log.Println("Invalid key:", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	} else if err != nil {
+		log.Println("Could not read key file:", err)
+		os.Exit(exitIOError)
+	}
+
+	encryptionKey, err := loadEncryptionKey(*encryptionKeyPtr, *encryptionKeyFilePtr)
+	if err == errEncryptionKeyConflict {
+		log.Println("Invalid encryption key:", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	} else if err != nil {
+		log.Println("Could not read encryption key file:", err)
+		os.Exit(exitIOError)
+	}
+
+	decodeOpts := stego.DecodeOptions{Key: key, EncryptionKey: encryptionKey}
+	if *decodePtr && *verifyKeyPtr != "" {
+		if decodeOpts.TrustedKeys, err = loadTrustedKeys(*verifyKeyPtr); err != nil {
+			log.Println("Could not read trusted keys:", err)
+			os.Exit(exitIOError)
+		}
+	}
+	if len(expectedRoot) > 0 {
+		decodeOpts.ExpectedRoot = expectedRoot
+	}
+
+	if *decodePtr && *proofPtr != "" {
+		decodeOpts.Proof, err = openProofFile(*proofPtr)
+		if err != nil {
+			log.Println("Could not open proof file:", err)
+			os.Exit(exitIOError)
+		}
+	}
+
+	if (*encodePtr || *capacityPtr) && *scatterPtr && len(key) == 0 {
+		log.Println("Invalid scatter:", stego.ErrScatterWithoutKey)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	encodeOpts := stego.EncodeOptions{Key: key, Scatter: *scatterPtr, SkipTransparent: *skipTransparentPtr, EncryptionKey: encryptionKey}
+	if (*encodePtr || *capacityPtr) && *signKeyPtr != "" {
+		if encodeOpts.Signer, err = loadSigner(*signKeyPtr); err != nil {
+			log.Println("Could not read signing key:", err)
+			os.Exit(exitIOError)
+		}
+	}
+	if *encodePtr && *embedPtr != "" {
+		if encodeOpts.Message, err = ioutil.ReadFile(*embedPtr); err != nil {
+			log.Println("Could not read file to embed:", err)
+			os.Exit(exitIOError)
+		}
+	}
+	if err = encodeOpts.Mode.UnmarshalText([]byte(*modePtr)); err != nil {
+		log.Println("Invalid mode:", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	var format chunk.Format
+	if *formatPtr != "" {
+		if format, err = chunk.ParseFormat(*formatPtr); err != nil {
+			log.Println("Invalid format:", err)
+			flag.Usage()
+			os.Exit(exitUsage)
+		}
+
+		if encodeOpts.Mode == stego.ModePNGChunk && format != chunk.FormatPNG {
+			log.Printf("Invalid format: the proof can only be embedded into png files with -mode=%s\n", stego.ModePNGChunk)
+			flag.Usage()
+			os.Exit(exitUsage)
+		}
+	}
+
+	if encodeOpts.Channels, err = stego.ParseChannels(*channelsPtr); err != nil {
+		log.Println("Invalid channels:", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if *planesPtr < 1 || *planesPtr > stego.MaxPlanes {
+		log.Printf("Invalid planes: must be between 1 and %d\n", stego.MaxPlanes)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	encodeOpts.Planes = *planesPtr
+
+	if *rowHashBitsPtr < 0 || *rowHashBitsPtr > stego.MaxRowHashBits {
+		log.Printf("Invalid row hash bits: must be between 0 and %d\n", stego.MaxRowHashBits)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	encodeOpts.RowHashBits = *rowHashBitsPtr
+
+	if encodeOpts.HashAlgorithm, err = stego.ParseHashAlgorithm(*hashPtr); err != nil {
+		log.Println("Invalid hash:", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if *hashBitsPtr < stego.MinHashBits || *hashBitsPtr > stego.MaxHashBits || *hashBitsPtr%8 != 0 {
+		log.Printf("Invalid hash bits: must be a multiple of 8 between %d and %d\n", stego.MinHashBits, stego.MaxHashBits)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	encodeOpts.HashBits = *hashBitsPtr
+
+	if encodeOpts.Cipher, err = stego.ParseCipher(*cipherPtr); err != nil {
+		log.Println("Invalid cipher:", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if encodeOpts.KDF, err = stego.ParseKDF(*kdfPtr); err != nil {
+		log.Println("Invalid kdf:", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if *encodePtr && encodeOpts.KDF == stego.KDFNone && len(encryptionKey) > 0 && len(encryptionKey) != stego.EncryptionKeyLength {
+		log.Printf("Invalid encryption key: must be %d bytes long with -kdf=none\n", stego.EncryptionKeyLength)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if *jsonPtr {
+		log.SetOutput(ioutil.Discard)
+	}
+	enc := json.NewEncoder(os.Stdout)
+
+	exitCode := exitIntact
 	for _, filename := range flag.Args() {
 
-		if *decodePtr{
-			err = chunk.Decode(filename)
+		var recs []*record
+		if *decodePtr {
+			recs = decode(filename, decodeOpts)
 		} else if *encodePtr {
-			err = chunk.Encode(filename, *outputPtr)
+			recs = encode(filename, *outputPtr, format, *selfCheckPtr, encodeOpts)
+		} else if *extractPtr {
+			recs = extract(filename, *outputPtr, decodeOpts)
+		} else if *capacityPtr {
+			recs = capacity(filename, encodeOpts)
 		}
-		if err != nil {
-			log.Println(err)
+
+		for _, rec := range recs {
+			if rec.Error != "" {
+				log.Println(rec.Error)
+			}
+
+			if *jsonPtr {
+				if err := enc.Encode(rec); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(exitIOError)
+				}
+			}
+
+			if rec.exitCode > exitCode {
+				exitCode = rec.exitCode
+			}
 		}
 	}
+
+	os.Exit(exitCode)
+}
+
+// countTrue returns the number of the given flags that are set.
+func countTrue(flags ...bool) int {
+	count := 0
+	for _, f := range flags {
+		if f {
+			count++
+		}
+	}
+	return count
+}
+
+// usage prints the flag defaults along with the documented exit codes.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(out, `
+Exit codes:
+  %d	All images were encoded successfully or have not been tampered with
+  %d	At least one image has been tampered with
+  %d	At least one image could not be verified (e.g. it was not encoded)
+  %d	At least one image file could not be read or written
+  %d	Invalid flags or flags that don't fit an image (e.g. it is too small or the message too large)
+`, exitIntact, exitTampered, exitUnverifiable, exitIOError, exitUsage)
 }
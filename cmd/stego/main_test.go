@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"dennis-tra/image-stego/internal/chunk"
+	"dennis-tra/image-stego/pkg/stego"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// noiseImage returns an opaque image of the given size with random pixel values.
+func noiseImage(w, h int) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(int64(w * h)))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		if (i+1)%4 == 0 {
+			img.Pix[i] = 255
+		} else {
+			img.Pix[i] = uint8(rnd.Intn(256))
+		}
+	}
+	return img
+}
+
+// tempImage saves a noise image of the given size as a PNG file in a new temporary directory and returns
+// the path of the file along with the directory, which the caller removes.
+func tempImage(t *testing.T, w, h int) (string, string) {
+	dir, err := ioutil.TempDir("", "stego")
+	require.NoError(t, err)
+
+	filepath := path.Join(dir, "image.png")
+	require.NoError(t, chunk.SaveImageFile(filepath, noiseImage(w, h)))
+	return filepath, dir
+}
+
+// encodeFile encodes the image file at the given path into a new out directory inside dir and returns
+// the path of the encoded image file.
+func encodeFile(t *testing.T, filepath string, dir string, opts stego.EncodeOptions) string {
+	outdir := path.Join(dir, "out")
+	require.NoError(t, os.MkdirAll(outdir, 0755))
+
+	recs := encode(filepath, outdir, 0, true, opts)
+	require.Len(t, recs, 1)
+	require.Equal(t, exitIntact, recs[0].exitCode, recs[0].Error)
+	return path.Join(outdir, path.Base(filepath))
+}
+
+func TestExitCode_Intact(t *testing.T) {
+	filepath, dir := tempImage(t, 200, 150)
+	defer os.RemoveAll(dir)
+
+	encodedFilepath := encodeFile(t, filepath, dir, stego.EncodeOptions{})
+
+	recs := decode(encodedFilepath, stego.DecodeOptions{})
+	require.Len(t, recs, 1)
+	assert.Equal(t, exitIntact, recs[0].exitCode)
+	assert.Equal(t, stego.Intact.String(), recs[0].Verdict)
+}
+
+func TestExitCode_Tampered(t *testing.T) {
+	filepath, dir := tempImage(t, 200, 150)
+	defer os.RemoveAll(dir)
+
+	encodedFilepath := encodeFile(t, filepath, dir, stego.EncodeOptions{})
+
+	img, err := chunk.OpenImageFile(encodedFilepath)
+	require.NoError(t, err)
+	tampered := image.NewNRGBA(img.Bounds())
+	draw.Draw(tampered, tampered.Bounds(), img, img.Bounds().Min, draw.Src)
+	draw.Draw(tampered, image.Rect(0, 0, 20, 20), image.Black, image.Point{}, draw.Src)
+	require.NoError(t, chunk.SaveImageFile(encodedFilepath, tampered))
+
+	recs := decode(encodedFilepath, stego.DecodeOptions{})
+	require.Len(t, recs, 1)
+	assert.Equal(t, exitTampered, recs[0].exitCode)
+	assert.NotEmpty(t, recs[0].TamperedChunks)
+}
+
+func TestExitCode_Unverifiable(t *testing.T) {
+	filepath, dir := tempImage(t, 200, 150)
+	defer os.RemoveAll(dir)
+
+	recs := decode(filepath, stego.DecodeOptions{})
+	require.Len(t, recs, 1)
+	assert.Equal(t, exitUnverifiable, recs[0].exitCode)
+	assert.Empty(t, recs[0].MerkleRoot)
+}
+
+func TestExitCode_IOError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stego")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filepath := path.Join(dir, "missing.png")
+	for _, recs := range [][]*record{
+		encode(filepath, dir, 0, false, stego.EncodeOptions{}),
+		decode(filepath, stego.DecodeOptions{}),
+		capacity(filepath, stego.EncodeOptions{}),
+	} {
+		require.Len(t, recs, 1)
+		assert.Equal(t, exitIOError, recs[0].exitCode)
+		assert.NotEmpty(t, recs[0].Error)
+	}
+
+	// The output directory doesn't exist
+	filepath, imgDir := tempImage(t, 200, 150)
+	defer os.RemoveAll(imgDir)
+
+	recs := encode(filepath, path.Join(dir, "missing"), 0, false, stego.EncodeOptions{})
+	require.Len(t, recs, 1)
+	assert.Equal(t, exitIOError, recs[0].exitCode)
+}
+
+func TestExitCode_Usage(t *testing.T) {
+	filepath, dir := tempImage(t, 200, 150)
+	defer os.RemoveAll(dir)
+
+	smallFilepath, smallDir := tempImage(t, 2, 2)
+	defer os.RemoveAll(smallDir)
+
+	tests := []struct {
+		name     string
+		filepath string
+		opts     stego.EncodeOptions
+		// inspect is true if the capacity of the image can't be inspected with the options either
+		inspect bool
+	}{
+		{name: "image too small", filepath: smallFilepath, inspect: true},
+		{name: "message too large", filepath: filepath, opts: stego.EncodeOptions{Message: make([]byte, 1<<20)}},
+		{name: "invalid planes", filepath: filepath, opts: stego.EncodeOptions{Planes: 9}, inspect: true},
+		{name: "row hashes outside lsb", filepath: filepath, opts: stego.EncodeOptions{Mode: stego.ModeSidecar, RowHashBits: 8}, inspect: true},
+		{name: "scatter without key", filepath: filepath, opts: stego.EncodeOptions{Scatter: true}, inspect: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recs := encode(tt.filepath, dir, 0, false, tt.opts)
+			require.Len(t, recs, 1)
+			assert.Equal(t, exitUsage, recs[0].exitCode, recs[0].Error)
+			assert.NotEmpty(t, recs[0].Error)
+
+			if tt.inspect {
+				recs = capacity(tt.filepath, tt.opts)
+				require.Len(t, recs, 1)
+				assert.Equal(t, exitUsage, recs[0].exitCode, recs[0].Error)
+			}
+		})
+	}
+}
+
+func TestEncodeExitCode(t *testing.T) {
+	assert.Equal(t, exitUsage, encodeExitCode(stego.ErrImageTooSmall))
+	assert.Equal(t, exitUsage, encodeExitCode(stego.ErrMessageTooLarge))
+	assert.Equal(t, exitUsage, encodeExitCode(stego.ErrScatterWithoutKey))
+	assert.Equal(t, exitUnverifiable, encodeExitCode(chunk.ErrPNGChunkNotFound))
+}
+
+func TestRecord_JSON(t *testing.T) {
+	filepath, dir := tempImage(t, 200, 150)
+	defer os.RemoveAll(dir)
+
+	encodedFilepath := encodeFile(t, filepath, dir, stego.EncodeOptions{})
+	recs := decode(encodedFilepath, stego.DecodeOptions{})
+	require.Len(t, recs, 1)
+
+	data, err := json.Marshal(recs[0])
+	require.NoError(t, err)
+
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &fields))
+
+	assert.Equal(t, encodedFilepath, fields["file"])
+	assert.Equal(t, stego.Intact.String(), fields["verdict"])
+	assert.Equal(t, recs[0].MerkleRoot, fields["merkle_root"])
+	assert.Equal(t, map[string]interface{}{"cols": float64(recs[0].Grid.Cols), "rows": float64(recs[0].Grid.Rows)}, fields["grid"])
+
+	// Empty fields and the exit code are left out
+	for _, key := range []string{"page", "expected_root", "crop", "signature", "tampered_chunks", "error", "exitCode", "exit_code"} {
+		assert.NotContains(t, fields, key)
+	}
+
+	failed := (&record{File: "image.png"}).fail(exitIOError, os.ErrNotExist)
+	data, err = json.Marshal(failed)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"file":"image.png","error":"file does not exist"}`, string(data))
+}
+
+func TestUsage_ExitCodes(t *testing.T) {
+	var buf bytes.Buffer
+	flag.CommandLine.SetOutput(&buf)
+	defer flag.CommandLine.SetOutput(nil)
+
+	usage()
+
+	for _, line := range []string{
+		"0\tAll images were encoded successfully",
+		"1\tAt least one image has been tampered with",
+		"2\tAt least one image could not be verified",
+		"3\tAt least one image file could not be read or written",
+		"4\tInvalid flags",
+	} {
+		assert.Contains(t, buf.String(), line)
+	}
+}
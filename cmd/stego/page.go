@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"path"
+
+	"dennis-tra/image-stego/internal/chunk"
+)
+
+// page is a single image of an image file along with the record of its processing.
+type page struct {
+	// img is the decoded image of the page.
+	img image.Image
+
+	// rec is the record of the page. It carries the page number for multi-page files.
+	rec *record
+
+	// filename is the base name of the image file, which the names of the output files of the page
+	// derive from. It is extended by the page number for multi-page files, e.g. scan.page-2.tiff.
+	filename string
+}
+
+// openPages opens the image file at the given path and returns all its pages along with the name of its
+// format, e.g. "png" or "tiff". Only TIFF files can hold multiple pages. If the file can't be opened
+// the returned record holds the error.
+func openPages(filepath string) ([]*page, string, *record) {
+	log.Println("Opening image:", filepath)
+	imgs, format, err := chunk.OpenImagePages(filepath)
+	if err != nil {
+		return nil, "", (&record{File: filepath}).fail(exitIOError, err)
+	}
+
+	filename := path.Base(filepath)
+	pages := make([]*page, len(imgs))
+	for i, img := range imgs {
+		pages[i] = &page{img: img, rec: &record{File: filepath}, filename: filename}
+		if len(imgs) > 1 {
+			pages[i].rec.Page = i + 1
+			pages[i].filename = chunk.SetExtension(filename, fmt.Sprintf(".page-%d%s", i+1, path.Ext(filename)))
+		}
+	}
+
+	if len(pages) > 1 {
+		log.Printf("Image file holds %d pages\n", len(pages))
+	}
+
+	return pages, format, nil
+}
+
+// logPage logs the page number of the given page of a multi-page file.
+func logPage(p *page, count int) {
+	if count > 1 {
+		log.Printf("Page %d of %d\n", p.rec.Page, count)
+	}
+}
+
+// records returns the records of the given pages.
+func records(pages []*page) []*record {
+	recs := make([]*record, len(pages))
+	for i, p := range pages {
+		recs[i] = p.rec
+	}
+	return recs
+}
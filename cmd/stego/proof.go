@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"dennis-tra/image-stego/pkg/stego"
+)
+
+// openProofFile opens the sidecar file at the given path and returns the decoded proof.
+func openProofFile(filepath string) (*stego.Proof, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	proof := &stego.Proof{}
+	if err = json.NewDecoder(file).Decode(proof); err != nil {
+		return nil, err
+	}
+
+	return proof, nil
+}
+
+// saveProofFile saves the given proof to the given filepath as a JSON sidecar file.
+func saveProofFile(filepath string, proof *stego.Proof) error {
+	file, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(proof)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+
+	"dennis-tra/image-stego/pkg/stego"
+)
+
+// Exit codes of the stego command. If multiple image files are given
+// the highest exit code of all files is returned.
+const (
+	// exitIntact means all images were encoded successfully or have not been tampered with.
+	exitIntact = 0
+
+	// exitTampered means at least one image has been tampered with.
+	exitTampered = 1
+
+	// exitUnverifiable means at least one image could not be verified, e.g. because it wasn't encoded.
+	exitUnverifiable = 2
+
+	// exitIOError means at least one image file could not be read or written.
+	exitIOError = 3
+
+	// exitUsage means the command was invoked with invalid flags or with flags that don't fit an image,
+	// e.g. because it is too small to be encoded or the message to hide is too large.
+	exitUsage = 4
+)
+
+// encodeExitCode returns the exit code of an error of stego.Encode or stego.Inspect. Invalid options and
+// options that don't fit the image are usage errors, everything else means the image couldn't be encoded.
+func encodeExitCode(err error) int {
+	for _, usageErr := range []error{stego.ErrInvalidOptions, stego.ErrScatterWithoutKey, stego.ErrUnsupportedSigner,
+		stego.ErrImageTooSmall, stego.ErrMessageTooLarge} {
+		if errors.Is(err, usageErr) {
+			return exitUsage
+		}
+	}
+	return exitUnverifiable
+}
+
+// record is the machine-readable result of processing a single image file or a single page of a
+// multi-page image file.
+type record struct {
+	File           string             `json:"file"`
+	Page           int                `json:"page,omitempty"`
+	Verdict        string             `json:"verdict,omitempty"`
+	MerkleRoot     string             `json:"merkle_root,omitempty"`
+	ExpectedRoot   bool               `json:"expected_root,omitempty"`
+	RecoveredRoot  bool               `json:"recovered_root,omitempty"`
+	Grid           *grid              `json:"grid,omitempty"`
+	Capacity       *capacityInfo      `json:"capacity,omitempty"`
+	Crop           *crop              `json:"crop,omitempty"`
+	Signature      *signature         `json:"signature,omitempty"`
+	TamperedChunks []stego.ChunkIndex `json:"tampered_chunks,omitempty"`
+	Outputs        []string           `json:"outputs,omitempty"`
+	Error          string             `json:"error,omitempty"`
+
+	// exitCode is the exit code this record contributes to the overall exit code.
+	exitCode int
+}
+
+// grid holds the number of chunks along the width and height of an image.
+type grid struct {
+	Cols int `json:"cols"`
+	Rows int `json:"rows"`
+}
+
+// capacityInfo describes how many least significant bits of the chunks of an image are occupied.
+type capacityInfo struct {
+	Width            int             `json:"width"`
+	Height           int             `json:"height"`
+	MinChunkWidth    int             `json:"min_chunk_width"`
+	MinChunkHeight   int             `json:"min_chunk_height"`
+	MaxChunkWidth    int             `json:"max_chunk_width"`
+	MaxChunkHeight   int             `json:"max_chunk_height"`
+	MinRegionWidth   int             `json:"min_region_width"`
+	MinRegionHeight  int             `json:"min_region_height"`
+	MinRequiredBits  int             `json:"min_required_bits"`
+	MaxRequiredBits  int             `json:"max_required_bits"`
+	MinAvailableBits int             `json:"min_available_bits"`
+	MaxAvailableBits int             `json:"max_available_bits"`
+	MinSpareBytes    int             `json:"min_spare_bytes"`
+	MaxSpareBytes    int             `json:"max_spare_bytes"`
+	FreeBytes        int             `json:"free_bytes"`
+	MessageCapacity  int             `json:"message_capacity"`
+	Chunks           []chunkCapacity `json:"chunks"`
+}
+
+// chunkCapacity describes how many least significant bits of a single chunk are occupied.
+type chunkCapacity struct {
+	X             int `json:"x"`
+	Y             int `json:"y"`
+	Width         int `json:"width"`
+	Height        int `json:"height"`
+	RequiredBits  int `json:"required_bits"`
+	AvailableBits int `json:"available_bits"`
+	SpareBytes    int `json:"spare_bytes"`
+}
+
+// newCapacityInfo summarises the given capacity report.
+func newCapacityInfo(report *stego.CapacityReport) *capacityInfo {
+	info := &capacityInfo{
+		Width:           report.Width,
+		Height:          report.Height,
+		MinChunkWidth:   report.MinChunkSize.X,
+		MinChunkHeight:  report.MinChunkSize.Y,
+		MaxChunkWidth:   report.MaxChunkSize.X,
+		MaxChunkHeight:  report.MaxChunkSize.Y,
+		MinRegionWidth:  report.MinRegionSize.X,
+		MinRegionHeight: report.MinRegionSize.Y,
+		FreeBytes:       report.FreeBytes,
+		MessageCapacity: report.MessageCapacity,
+	}
+
+	for i, c := range report.Chunks {
+		if i == 0 || c.RequiredBits < info.MinRequiredBits {
+			info.MinRequiredBits = c.RequiredBits
+		}
+		if c.RequiredBits > info.MaxRequiredBits {
+			info.MaxRequiredBits = c.RequiredBits
+		}
+		if i == 0 || c.AvailableBits < info.MinAvailableBits {
+			info.MinAvailableBits = c.AvailableBits
+		}
+		if c.AvailableBits > info.MaxAvailableBits {
+			info.MaxAvailableBits = c.AvailableBits
+		}
+		if i == 0 || c.SpareBytes < info.MinSpareBytes {
+			info.MinSpareBytes = c.SpareBytes
+		}
+		if c.SpareBytes > info.MaxSpareBytes {
+			info.MaxSpareBytes = c.SpareBytes
+		}
+
+		info.Chunks = append(info.Chunks, chunkCapacity{
+			X:             c.Index.X,
+			Y:             c.Index.Y,
+			Width:         c.Bounds.Dx(),
+			Height:        c.Bounds.Dy(),
+			RequiredBits:  c.RequiredBits,
+			AvailableBits: c.AvailableBits,
+			SpareBytes:    c.SpareBytes,
+		})
+	}
+
+	return info
+}
+
+// crop describes the region of the encoded image that a cropped image covers.
+type crop struct {
+	OriginalWidth  int `json:"original_width"`
+	OriginalHeight int `json:"original_height"`
+	X              int `json:"x"`
+	Y              int `json:"y"`
+	Width          int `json:"width"`
+	Height         int `json:"height"`
+}
+
+// signature describes the signature over the Merkle root of an image.
+type signature struct {
+	Algorithm stego.SignatureAlgorithm `json:"algorithm,omitempty"`
+	KeyID     stego.HexBytes           `json:"key_id,omitempty"`
+	Signer    string                   `json:"signer,omitempty"`
+	Verified  bool                     `json:"verified"`
+}
+
+// fail records the given error and exit code and returns the record itself.
+func (r *record) fail(exitCode int, err error) *record {
+	r.exitCode = exitCode
+	r.Error = err.Error()
+	return r
+}
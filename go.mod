@@ -5,6 +5,10 @@ go 1.14
 require (
 	github.com/cbergoon/merkletree v0.2.0
 	github.com/icza/bitio v1.0.0
+	github.com/klauspost/reedsolomon v1.9.16
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/stretchr/testify v1.6.1
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+	golang.org/x/image v0.10.0
+	lukechampine.com/blake3 v1.1.7
 )
@@ -0,0 +1,104 @@
+package chunk
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+
+	"golang.org/x/image/bmp"
+)
+
+// bmpV4Header is the file header followed by a BITMAPV4HEADER of a 32-bit BMP file whose bit fields
+// declare the fourth byte of every pixel as alpha. Decoders ignore the alpha of 32-bit BMP files with
+// the older BITMAPINFOHEADER, which is the only one golang.org/x/image/bmp writes.
+type bmpV4Header struct {
+	Signature    [2]byte
+	FileSize     uint32
+	Reserved     uint32
+	PixOffset    uint32
+	HeaderSize   uint32
+	Width        int32
+	Height       int32
+	Planes       uint16
+	BitsPerPixel uint16
+	Compression  uint32
+	ImageSize    uint32
+	XPixelsPerM  uint32
+	YPixelsPerM  uint32
+	ColorsUsed   uint32
+	ColorsImp    uint32
+	RedMask      uint32
+	GreenMask    uint32
+	BlueMask     uint32
+	AlphaMask    uint32
+	ColorSpace   [4]byte
+	Endpoints    [36]byte
+	GammaRGB     [3]uint32
+}
+
+// bmpV4HeaderLength is the length of the file header (14 bytes) plus the BITMAPV4HEADER (108 bytes).
+const bmpV4HeaderLength = 14 + 108
+
+// EncodeBMP writes the given image as BMP to w. Images with transparent pixels are written with 32 bits
+// per pixel and a BITMAPV4HEADER so that their alpha survives. It doesn't check whether the format
+// stores the image losslessly (see FormatBMP.Supports).
+func EncodeBMP(w io.Writer, img image.Image) error {
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok || nrgba.Opaque() {
+		return bmp.Encode(w, img)
+	}
+
+	d := nrgba.Bounds().Size()
+	h := bmpV4Header{
+		Signature:    [2]byte{'B', 'M'},
+		FileSize:     uint32(bmpV4HeaderLength + 4*d.X*d.Y),
+		PixOffset:    bmpV4HeaderLength,
+		HeaderSize:   bmpV4HeaderLength - 14,
+		Width:        int32(d.X),
+		Height:       -int32(d.Y), // top-down
+		Planes:       1,
+		BitsPerPixel: 32,
+		Compression:  3, // BI_BITFIELDS
+		ImageSize:    uint32(4 * d.X * d.Y),
+		RedMask:      0x00ff0000,
+		GreenMask:    0x0000ff00,
+		BlueMask:     0x000000ff,
+		AlphaMask:    0xff000000,
+		ColorSpace:   [4]byte{'B', 'G', 'R', 's'},
+	}
+	if err := binary.Write(w, binary.LittleEndian, h); err != nil {
+		return err
+	}
+
+	// BMP files store the samples of a pixel in the order blue, green, red and alpha
+	row := make([]byte, 4*d.X)
+	for y := 0; y < d.Y; y++ {
+		pix := nrgba.Pix[nrgba.PixOffset(nrgba.Rect.Min.X, nrgba.Rect.Min.Y+y):]
+		for i := 0; i < len(row); i += 4 {
+			row[i+0], row[i+1], row[i+2], row[i+3] = pix[i+2], pix[i+1], pix[i+0], pix[i+3]
+		}
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// grayBMP returns the given image as *image.Gray if it is a BMP image with the palette of gray levels
+// that golang.org/x/image/bmp writes grayscale images with, so that they are read back unchanged.
+func grayBMP(img image.Image) image.Image {
+	p, ok := img.(*image.Paletted)
+	if !ok || len(p.Palette) != 256 {
+		return img
+	}
+
+	for i, c := range p.Palette {
+		if c != (color.RGBA{R: uint8(i), G: uint8(i), B: uint8(i), A: 0xff}) {
+			return img
+		}
+	}
+
+	return &image.Gray{Pix: p.Pix, Stride: p.Stride, Rect: p.Rect}
+}
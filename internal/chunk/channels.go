@@ -0,0 +1,93 @@
+package chunk
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Channels is a bit mask of the color channels of a pixel whose least significant bits carry payload.
+type Channels uint8
+
+const (
+	// ChannelR selects the red channel.
+	ChannelR Channels = 1 << iota
+
+	// ChannelG selects the green channel.
+	ChannelG
+
+	// ChannelB selects the blue channel.
+	ChannelB
+
+	// ChannelA selects the alpha channel.
+	ChannelA
+
+	// DefaultChannels are the channels that are used if no channels are configured.
+	DefaultChannels = ChannelR | ChannelG | ChannelB
+
+	// AllChannels selects all four channels.
+	AllChannels = ChannelR | ChannelG | ChannelB | ChannelA
+)
+
+// HeaderChannels returns the channels that carry the header and locator of the chunks of a Pixels
+// buffer whose pixels consist of the given channels (see Pixels.PixelChannels): the R, G and B channels
+// of color buffers and the only channel of grayscale and paletted buffers.
+func HeaderChannels(available Channels) Channels {
+	return available & DefaultChannels
+}
+
+// channelNames maps the position of a channel in a pixel to its name.
+var channelNames = [4]byte{'r', 'g', 'b', 'a'}
+
+// ParseChannels parses a channel selection like "rgb" or "a". Every character
+// denotes a channel and may only occur once.
+func ParseChannels(s string) (Channels, error) {
+	var channels Channels
+	for _, r := range strings.ToLower(s) {
+		idx := strings.IndexRune(string(channelNames[:]), r)
+		if idx < 0 {
+			return 0, fmt.Errorf("unknown channel %q", r)
+		}
+
+		channel := Channels(1 << uint(idx))
+		if channels&channel != 0 {
+			return 0, fmt.Errorf("duplicate channel %q", r)
+		}
+		channels |= channel
+	}
+
+	if !channels.Valid() {
+		return 0, fmt.Errorf("no channels selected")
+	}
+
+	return channels, nil
+}
+
+// Valid reports whether at least one and only known channels are selected.
+func (c Channels) Valid() bool {
+	return c != 0 && c&^AllChannels == 0
+}
+
+// Count returns the number of selected channels.
+func (c Channels) Count() int {
+	return len(c.Offsets())
+}
+
+// Offsets returns the byte offsets of the selected channels within a pixel in ascending order.
+func (c Channels) Offsets() []int {
+	offsets := []int{}
+	for i := range channelNames {
+		if c&(1<<uint(i)) != 0 {
+			offsets = append(offsets, i)
+		}
+	}
+	return offsets
+}
+
+// String returns the selected channels like "rgb".
+func (c Channels) String() string {
+	s := ""
+	for _, offset := range c.Offsets() {
+		s += string(channelNames[offset])
+	}
+	return s
+}
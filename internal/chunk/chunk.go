@@ -2,9 +2,9 @@ package chunk
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"crypto/cipher"
 	"errors"
-	"image"
+	"hash"
 	"io"
 
 	"dennis-tra/image-stego/pkg/bit"
@@ -13,21 +13,152 @@ import (
 	"github.com/icza/bitio"
 )
 
-// Chunk is a wrapper around an image.RGBA struct that keeps track of
-// the read and written bytes to the least significant bits of the underlying *image.RGBA.
+// Chunk is a wrapper around a Pixels buffer that keeps track of the read and written
+// bytes to the least significant bits of its color samples in their native bit depth.
+// Non-premultiplied pixels are used so that least significant bits in the alpha
+// channel survive a round trip through a PNG file.
+//
+// The header pixels at the beginning of a chunk always carry one payload bit in their R, G and B
+// channels, or in their only channel for grayscale and paletted buffers (see HeaderChannels). All
+// following pixels carry Planes payload bits in each of the configured Channels.
 type Chunk struct {
-	*image.RGBA
+	Pixels
 
-	// The number of read bytes. Subsequent calls to read will continue where the last read left off.
+	// The number of read bits. Subsequent calls to read will continue where the last read left off.
 	rOff int
 
-	// The number of written bytes. Subsequent calls to write will continue where the last write left off.
+	// The number of written bits. Subsequent calls to write will continue where the last write left off.
 	wOff int
+
+	// HashLSB indicates whether the least significant bits are considered in CalculateHash and Equals.
+	// This should only be set if no data is written to the least significant bits.
+	HashLSB bool
+
+	// Channels are the color channels whose least significant bits carry payload after the header
+	// pixels. Must be a subset of the channels of the Pixels. Defaults to DefaultChannels, or the
+	// only channel of grayscale and paletted buffers.
+	Channels Channels
+
+	// Planes is the number of low bits of each configured channel that carry payload after
+	// the header pixels. Must be between 1 and MaxPlanes. Defaults to 1.
+	Planes int
+
+	// HashAlgorithm is the hash function of CalculateHash and CalculateRowHash. Defaults to DefaultHashAlgorithm.
+	HashAlgorithm HashAlgorithm
+
+	// HashBits is the number of bits the result of CalculateHash is truncated to. Must be a multiple of
+	// BitsPerByte. Defaults to HashBitLength, i.e. the hash isn't truncated.
+	HashBits int
+
+	// Key is the secret key of the message authentication code that CalculateHash computes instead of a
+	// plain hash (see HashAlgorithm.NewKeyed). Without the key nobody can calculate the hash of the chunk.
+	// Defaults to an empty key, i.e. CalculateHash computes a plain hash.
+	Key []byte
+
+	// Seed enables the pseudo-random placement of the payload. All LSBs after the first SequentialBits
+	// are permuted with a pseudo-random number generator seeded from Seed, so that the payload is spread
+	// across the whole chunk instead of filling it from the top left pixel. Write and Read apply the same
+	// permutation. Defaults to an empty seed, i.e. the LSBs are filled sequentially.
+	Seed []byte
+
+	// SequentialBits is the number of LSBs at the beginning of the chunk that are filled sequentially
+	// even if a Seed is set, e.g. to keep the header locatable without knowing the seed.
+	SequentialBits int
+
+	// SkipTransparent excludes fully transparent pixels, whose alpha sample is 0, from carrying payload after
+	// the header pixels and the pixels that hold the first SequentialBits LSBs. The color samples of all fully
+	// transparent pixels aren't considered in CalculateHash and Equals either, as they are invisible and
+	// commonly discarded by conversions that premultiply alpha. The alpha channel must not carry payload
+	// then. Buffers without an alpha channel have no transparent pixels. Defaults to false.
+	SkipTransparent bool
+
+	// AEAD encrypts and authenticates all LSBs after SequentialBits. Everything written after SequentialBits
+	// is buffered until Seal encrypts it together with zero padding up to the capacity of the chunk, so that
+	// the LSBs are indistinguishable from noise without the key. Reading after SequentialBits implicitly
+	// calls Open, which fails with ErrAuthentication if the LSBs were manipulated or the key is wrong.
+	// Defaults to no encryption.
+	AEAD cipher.AEAD
+
+	// Nonce is the nonce of the AEAD. It must be unique for every chunk that is encrypted with the same key.
+	Nonce []byte
+
+	// AdditionalData is authenticated by the AEAD but not encrypted, e.g. the sequentially written header.
+	AdditionalData []byte
+
+	// plain buffers the plaintext of the LSBs after SequentialBits if an AEAD is set.
+	plain []byte
+
+	// opened is set once the LSBs after SequentialBits were decrypted into plain.
+	opened bool
+
+	// offsets caches the byte offsets within a pixel of the configured Channels.
+	offsets []int
+
+	// headerChannels caches the number of channels of the header pixels that carry payload.
+	headerChannels int
+
+	// perm caches the permutation of the LSBs after SequentialBits (see Seed).
+	perm []int
+
+	// visible caches the indexes of the pixels after the sequential pixels that
+	// aren't fully transparent if transparent pixels are skipped.
+	visible []int
+}
+
+// channelOffsets returns the byte offsets within a pixel of the configured Channels.
+func (c *Chunk) channelOffsets() []int {
+	if c.offsets == nil {
+		channels := c.Channels
+		if channels == 0 {
+			channels = HeaderChannels(c.PixelChannels())
+		}
+		c.offsets = channels.Offsets()
+	}
+	return c.offsets
+}
+
+// headerChannelCount returns the number of channels of the header pixels that carry payload (see HeaderChannels).
+func (c *Chunk) headerChannelCount() int {
+	if c.headerChannels == 0 {
+		c.headerChannels = HeaderChannels(c.PixelChannels()).Count()
+	}
+	return c.headerChannels
+}
+
+// headerPixels returns the number of pixels at the beginning of the chunk that hold the header.
+func (c *Chunk) headerPixels() int {
+	return (HeaderBitLength + c.headerChannelCount() - 1) / c.headerChannelCount()
+}
+
+// newHash returns a new hash.Hash of the configured HashAlgorithm and Key truncated to HashBits bits.
+func (c *Chunk) newHash() hash.Hash {
+	return c.hashAlgorithm().KeyedTruncated(c.Key, c.HashBits)()
+}
+
+// hashAlgorithm returns the configured HashAlgorithm.
+func (c *Chunk) hashAlgorithm() HashAlgorithm {
+	if c.HashAlgorithm == 0 {
+		return DefaultHashAlgorithm
+	}
+	return c.HashAlgorithm
+}
+
+// planes returns the configured number of Planes.
+func (c *Chunk) planes() int {
+	if c.Planes == 0 {
+		return 1
+	}
+	return c.Planes
 }
 
 // MaxPayloadSize returns the maximum number of bytes that can be written to this chunk
 func (c *Chunk) MaxPayloadSize() int {
-	return c.LSBCount() / 8
+	return c.bitCapacity() / 8
+}
+
+// RemainingPayloadSize returns the number of bytes that can still be written to this chunk
+func (c *Chunk) RemainingPayloadSize() int {
+	return (c.bitCapacity() - c.wOff) / 8
 }
 
 // Width is a short hand to return the width in pixels of the chunk
@@ -42,13 +173,49 @@ func (c *Chunk) Height() int {
 
 // PixelCount returns the total number of pixels
 func (c *Chunk) PixelCount() int {
-	return len(c.Pix) / 4
+	return c.Width() * c.Height()
 }
 
 // LSBCount returns the total number of least significant bits (LSB) available for encoding a message.
-// Currently only the RGB values are considered not the A.
+// These are the LSBs of the header channels of the header pixels and the Planes low bits of the
+// configured channels of all remaining pixels that aren't skipped (see SkipTransparent).
 func (c *Chunk) LSBCount() int {
-	return c.PixelCount() * BitsPerPixel
+	pixelCount := c.PixelCount()
+	if c.skipsTransparent() {
+		pixelCount = c.sequentialPixels() + len(c.visiblePixels())
+	}
+	return lsbCount(pixelCount, c.headerPixels(), c.headerChannelCount(), len(c.channelOffsets()), c.planes())
+}
+
+// LSBCount returns the total number of least significant bits available for encoding a message in a chunk
+// with the given number of pixels, channel and plane configuration of a Pixels buffer whose pixels consist
+// of the available channels (see Pixels.PixelChannels).
+func LSBCount(pixelCount int, available Channels, channels Channels, planes int) int {
+	if channels == 0 {
+		channels = HeaderChannels(available)
+	}
+	return lsbCount(pixelCount, HeaderPixelCount(available, HeaderBitLength), HeaderChannels(available).Count(), channels.Count(), planes)
+}
+
+// HeaderPixelCount returns the number of pixels at the beginning of a chunk that hold a header of the given
+// number of bits in a Pixels buffer whose pixels consist of the available channels (see HeaderChannels).
+func HeaderPixelCount(available Channels, headerBits int) int {
+	count := HeaderChannels(available).Count()
+	return (headerBits + count - 1) / count
+}
+
+// lsbCount returns the total number of least significant bits available for encoding a message in a chunk
+// with the given number of pixels, header pixels, header channels, payload channels and planes.
+func lsbCount(pixelCount int, headerPixels int, headerChannels int, channels int, planes int) int {
+	if planes == 0 {
+		planes = 1
+	}
+
+	if pixelCount <= headerPixels {
+		return pixelCount * headerChannels
+	}
+
+	return headerPixels*headerChannels + (pixelCount-headerPixels)*channels*planes
 }
 
 // MinX in this context returns the starting value for iterating over the horizontal axis of the image
@@ -71,30 +238,160 @@ func (c *Chunk) MaxY() int {
 	return c.Bounds().Max.Y
 }
 
-// CalculateHash calculates the SHA256 hash of the 7 most significant bits. The least
-// significant bit (LSB) is not considered in the hash generation as it is used to
-// store the (derived) Merkle leaves/nodes.
+// pixel returns the bytes of the n-th pixel of the chunk (see Pixels.Pixel).
+// Pixels are counted row by row starting at the top left pixel.
+func (c *Chunk) pixel(n int) []byte {
+	return c.Pixel(c.MinX()+n%c.Width(), c.MinY()+n/c.Width())
+}
+
+// sampleLowByte returns the index of the least significant byte of the sample at the given
+// channel offset within the bytes of a pixel. It holds all payload bits of the sample.
+func (c *Chunk) sampleLowByte(offset int) int {
+	return (offset+1)*c.SampleSize() - 1
+}
+
+// skipsTransparent reports whether fully transparent pixels are excluded from carrying payload.
+func (c *Chunk) skipsTransparent() bool {
+	return c.SkipTransparent && c.PixelChannels()&ChannelA != 0
+}
+
+// sequentialPixels returns the number of pixels at the beginning of the chunk that hold the first
+// SequentialBits LSBs. These pixels carry payload even if they are fully transparent.
+func (c *Chunk) sequentialPixels() int {
+	n := c.SequentialBits - c.headerPixels()*c.headerChannelCount()
+	if n <= 0 {
+		return c.headerPixels()
+	}
+
+	bitsPerPixel := len(c.channelOffsets()) * c.planes()
+	return c.headerPixels() + (n+bitsPerPixel-1)/bitsPerPixel
+}
+
+// visiblePixels returns the indexes of the pixels after the sequential pixels that aren't fully transparent.
+func (c *Chunk) visiblePixels() []int {
+	if c.visible == nil {
+		c.visible = []int{}
+		for n := c.sequentialPixels(); n < c.PixelCount(); n++ {
+			if !transparent(c.Pixels, c.pixel(n)) {
+				c.visible = append(c.visible, n)
+			}
+		}
+	}
+	return c.visible
+}
+
+// lsbIndex returns the pixel, the channel offset and the bit position within the least significant
+// byte of the sample that hold the n-th LSB of the chunk. The low bits of a channel are filled starting
+// at the least significant bit before moving on to the next channel. If a Seed is set all LSBs after
+// SequentialBits are permuted. Skipped transparent pixels are left out.
+func (c *Chunk) lsbIndex(n int) (int, int, int) {
+	if perm := c.permutation(); n >= c.SequentialBits && perm != nil {
+		n = c.SequentialBits + perm[n-c.SequentialBits]
+	}
+
+	headerLSBs := c.headerPixels() * c.headerChannelCount()
+	if n < headerLSBs {
+		return n / c.headerChannelCount(), n % c.headerChannelCount(), 0
+	}
+
+	n -= headerLSBs
+	offsets := c.channelOffsets()
+	planes := c.planes()
+	slot := n % (len(offsets) * planes)
+	px := c.headerPixels() + n/(len(offsets)*planes)
+	if c.skipsTransparent() && px >= c.sequentialPixels() {
+		px = c.visiblePixels()[px-c.sequentialPixels()]
+	}
+	return px, offsets[slot/planes], slot % planes
+}
+
+// payloadBits returns the number of low bits at the given channel offset
+// of the n-th pixel of the chunk that carry payload.
+func (c *Chunk) payloadBits(n int, offset int) int {
+	if n < c.headerPixels() {
+		if offset < c.headerChannelCount() {
+			return 1
+		}
+		return 0
+	}
+
+	for _, o := range c.channelOffsets() {
+		if o == offset {
+			return c.planes()
+		}
+	}
+	return 0
+}
+
+// hashPixel appends the given bytes of the n-th pixel of the chunk as they are considered in CalculateHash
+// and Equals to buf and returns the extended buffer. The low bits that carry payload are set to 0. The bytes
+// are followed by the color they refer to (see Pixels.AppendColor), which is the color of the palette entry
+// whose index is the one of the pixel without the payload bits for paletted buffers. If transparent pixels
+// are skipped they are considered transparent black.
+func (c *Chunk) hashPixel(buf []byte, pixel []byte, n int) []byte {
+	start := len(buf)
+	buf = append(buf, pixel...)
+
+	px := buf[start:]
+	if c.skipsTransparent() && transparent(c.Pixels, px) {
+		for i := range px {
+			px[i] = 0
+		}
+	} else if !c.HashLSB {
+		size := c.SampleSize()
+		for offset := 0; offset < len(px)/size; offset++ {
+			i := (offset+1)*size - 1
+			px[i] = bit.WithLowBits(px[i], 0, c.payloadBits(n, offset))
+		}
+	}
+
+	return c.AppendColor(buf, px)
+}
+
+// hashRow appends the bytes of all pixels of the given pixel row of the chunk as they
+// are considered in CalculateHash (see hashPixel) to buf and returns the extended buffer.
+func (c *Chunk) hashRow(buf []byte, y int) []byte {
+	bounds := c.Bounds()
+	for x := 0; x < bounds.Dx(); x++ {
+		buf = c.hashPixel(buf, c.Pixel(bounds.Min.X+x, bounds.Min.Y+y), y*bounds.Dx()+x)
+	}
+	return buf
+}
+
+// CalculateHash calculates the hash of all color values of the chunk with the configured
+// HashAlgorithm and Key truncated to HashBits bits. The least significant bits (LSB) that carry
+// payload are not considered in the hash generation as they are used to store the
+// (derived) Merkle leaves/nodes. With multiple Planes the lowest Planes bits of the configured
+// channels are not considered. If HashLSB is set all bits are considered. Every color sample
+// is hashed in its native bit depth, i.e. as two big-endian bytes for 16-bit images.
 // Note: From an implementation point of view the LSB is actually considered but
 // always overwritten by a 0.
 // This method (among Equal) lets Chunk conform to the merkletree.Content interface.
 func (c *Chunk) CalculateHash() ([]byte, error) {
 
-	h := sha256.New()
+	h := c.newHash()
 
-	for x := c.MinX(); x < c.MaxX(); x++ {
-		for y := c.MinY(); y < c.MaxY(); y++ {
+	var row []byte
+	for y := 0; y < c.Height(); y++ {
+		row = c.hashRow(row[:0], y)
+		if _, err := h.Write(row); err != nil {
+			return nil, err
+		}
+	}
 
-			rgba := c.RGBAAt(x, y)
+	return h.Sum(nil), nil
+}
 
-			byt := []byte{
-				bit.WithLSB(rgba.R, false),
-				bit.WithLSB(rgba.G, false),
-				bit.WithLSB(rgba.B, false),
-			}
-			if _, err := h.Write(byt); err != nil {
-				return nil, err
-			}
-		}
+// CalculateRowHash calculates the untruncated hash of all color values of the given pixel row of the chunk with the
+// configured HashAlgorithm, starting at 0 for the top row. Just like in CalculateHash the LSBs that carry payload
+// are not considered.
+// Row hashes allow localising modifications within a chunk.
+func (c *Chunk) CalculateRowHash(y int) ([]byte, error) {
+
+	h := c.hashAlgorithm().New()
+
+	if _, err := h.Write(c.hashRow(nil, y)); err != nil {
+		return nil, err
 	}
 
 	return h.Sum(nil), nil
@@ -108,14 +405,10 @@ func (c *Chunk) CalculateHash() ([]byte, error) {
 func (c *Chunk) Write(p []byte) (n int, err error) {
 	r := bitio.NewReader(bytes.NewBuffer(p))
 
-	defer func() { c.wOff += n }()
-
 	for i := 0; i < len(p); i++ {
 
-		bitOff := (c.wOff + i) * BitsPerByte
-
 		// Stop early if there is not enough LSB space left
-		if bitOff+7 >= len(c.Pix)-len(c.Pix)/4 {
+		if c.wOff+BitsPerByte > c.bitCapacity() {
 			return n, io.EOF
 		}
 
@@ -127,8 +420,9 @@ func (c *Chunk) Write(p []byte) (n int, err error) {
 				return n, err
 			}
 
-			idx := bitOff + j + (bitOff+j)/BitsPerPixel
-			c.Pix[idx] = bit.WithLSB(c.Pix[idx], bitVal)
+			if err = c.WriteBool(bitVal); err != nil {
+				return n, err
+			}
 		}
 
 		// As one byte was written increment the counter
@@ -148,31 +442,26 @@ func (c *Chunk) Read(p []byte) (n int, err error) {
 
 	b.Reset()
 
-	defer func() {
-		w.Close()
-		c.rOff += n
-	}()
+	defer w.Close()
 
 	for i := 0; i < len(p); i++ {
 
-		// calculate current read bit offset: static read offset from potential last run plus idx-var times bits in a byte
-		bitOff := (c.rOff + i) * BitsPerByte
-
 		// Stop early if there are not enough LSBs left
-		if bitOff+BitsPerByte+(bitOff+BitsPerByte)/BitsPerPixel > len(c.Pix) {
+		if c.rOff+BitsPerByte > c.bitCapacity() {
 			return n, io.EOF
 		}
 
 		// At this point we're sure that a whole byte can still be read
 		for j := 0; j < BitsPerByte; j++ {
 
-			idx := bitOff + j + (bitOff+j)/BitsPerPixel
-			v := bit.GetLSB(c.Pix[idx])
-
-			err := w.WriteBool(v)
+			v, err := c.ReadBool()
 			if err != nil {
 				return n, err
 			}
+
+			if err = w.WriteBool(v); err != nil {
+				return n, err
+			}
 		}
 
 		// As one whole byte was read increment the counter
@@ -182,8 +471,105 @@ func (c *Chunk) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
-// Equals tests for equality of two Contents. It only considers the 7 most significant bits since the last bit contains
-// the hash data of the other chunks and doesn't count to the equality.
+// WriteBool writes a single bit to the least significant bits of the chunk, while true means 1
+// and false means 0. Subsequent calls to write will continue were the last write left off.
+// It returns io.EOF if there is no LSB space left.
+func (c *Chunk) WriteBool(b bool) error {
+	if c.wOff >= c.bitCapacity() {
+		return io.EOF
+	}
+
+	if c.AEAD != nil && c.wOff >= c.SequentialBits {
+		c.setPlainBit(c.wOff-c.SequentialBits, b)
+	} else {
+		c.writeLSB(c.wOff, b)
+	}
+	c.wOff += 1
+
+	return nil
+}
+
+// writeLSB sets the n-th LSB of the chunk.
+func (c *Chunk) writeLSB(n int, b bool) {
+	px, offset, pos := c.lsbIndex(n)
+	i, pixel := c.sampleLowByte(offset), c.pixel(px)
+	pixel[i] = bit.WithBit(pixel[i], pos, b)
+}
+
+// readLSB returns the n-th LSB of the chunk.
+func (c *Chunk) readLSB(n int) bool {
+	px, offset, pos := c.lsbIndex(n)
+	return bit.GetBit(c.pixel(px)[c.sampleLowByte(offset)], pos)
+}
+
+// WriteBits writes the n lowest bits of r to the least significant bits of the chunk, starting
+// with the highest of these bits. Either all n bits are written or none. It returns io.EOF if
+// there is not enough LSB space left.
+func (c *Chunk) WriteBits(r uint64, n uint8) error {
+	if c.wOff+int(n) > c.bitCapacity() {
+		return io.EOF
+	}
+
+	for i := int(n) - 1; i >= 0; i-- {
+		if err := c.WriteBool(r&(1<<uint(i)) != 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadBool reads a single bit from the least significant bits of the chunk.
+// Subsequent calls to read will continue where the last read left off.
+// It returns io.EOF if there are no LSBs left.
+func (c *Chunk) ReadBool() (bool, error) {
+	if c.rOff >= c.bitCapacity() {
+		return false, io.EOF
+	}
+
+	if c.AEAD != nil && c.rOff >= c.SequentialBits {
+		if err := c.Open(); err != nil {
+			return false, err
+		}
+
+		v := c.plainBit(c.rOff - c.SequentialBits)
+		c.rOff += 1
+		return v, nil
+	}
+
+	v := c.readLSB(c.rOff)
+	c.rOff += 1
+
+	return v, nil
+}
+
+// ReadBits reads n bits from the least significant bits of the chunk and returns them as the
+// lowest bits of the result, the first read bit being the highest. Either all n bits are read or
+// none. It returns io.EOF if there are not enough LSBs left.
+func (c *Chunk) ReadBits(n uint8) (uint64, error) {
+	if c.rOff+int(n) > c.bitCapacity() {
+		return 0, io.EOF
+	}
+
+	var u uint64
+	for i := 0; i < int(n); i++ {
+		b, err := c.ReadBool()
+		if err != nil {
+			return 0, err
+		}
+
+		u <<= 1
+		if b {
+			u |= 1
+		}
+	}
+
+	return u, nil
+}
+
+// Equals tests for equality of two Contents. It doesn't consider the low bits that carry
+// payload since they contain the hash data of the other chunks and don't count to the equality.
+// If HashLSB is set all bits are considered. Chunks of different bit depths are never equal.
 func (c *Chunk) Equals(o merkletree.Content) (bool, error) {
 
 	oc, ok := o.(*Chunk) // other chunk
@@ -191,31 +577,19 @@ func (c *Chunk) Equals(o merkletree.Content) (bool, error) {
 		return false, errors.New("invalid type casting")
 	}
 
-	if oc.Width() != c.Width() || oc.Height() != c.Height() {
+	if oc.Width() != c.Width() || oc.Height() != c.Height() || oc.SampleSize() != c.SampleSize() {
 		return false, nil
 	}
 
-	for x := c.MinX(); x < c.MaxX(); x++ {
-		for y := c.MinY(); y < c.MaxY(); y++ {
-
-			thisColor := c.RGBAAt(x, y)
-			otherColor := oc.RGBAAt(x, y)
+	bounds, obounds := c.Bounds(), oc.Bounds()
 
-			if bit.WithLSB(thisColor.R, false) != bit.WithLSB(otherColor.R, false) {
-				return false, nil
-			}
-
-			if bit.WithLSB(thisColor.G, false) != bit.WithLSB(otherColor.G, false) {
-				return false, nil
-			}
-
-			if bit.WithLSB(thisColor.B, false) != bit.WithLSB(otherColor.B, false) {
-				return false, nil
-			}
-
-			if bit.WithLSB(thisColor.A, false) != bit.WithLSB(otherColor.A, false) {
-				return false, nil
-			}
+	var px, opx []byte
+	for n := 0; n < c.PixelCount(); n++ {
+		x, y := n%bounds.Dx(), n/bounds.Dx()
+		px = c.hashPixel(px[:0], c.Pixel(bounds.Min.X+x, bounds.Min.Y+y), n)
+		opx = oc.hashPixel(opx[:0], oc.Pixel(obounds.Min.X+x, obounds.Min.Y+y), n)
+		if !bytes.Equal(px, opx) {
+			return false, nil
 		}
 	}
 
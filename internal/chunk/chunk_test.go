@@ -2,16 +2,27 @@ package chunk
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path"
 	"testing"
 
 	"dennis-tra/image-stego/pkg/bit"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
 )
 
 // ones is a byte with all bits set to one
@@ -20,39 +31,73 @@ const ones = 0b11111111
 // zeroes is a byte with all bits set to zero
 const zeroes = 0b00000000
 
-// blackImage creates an RGBA image with the given width and height
+// blackImage creates an NRGBA buffer with the given width and height
 // where all pixels are black. The underlying Pix byte array
 // contains w x h x 4 entries.
-func blackImage(w, h int) *image.RGBA {
-	return image.NewRGBA(image.Rect(0, 0, w, h))
+func blackImage(w, h int) NRGBA {
+	return NRGBA{image.NewNRGBA(image.Rect(0, 0, w, h))}
 }
 
-// whiteImage creates an RGBA image with the given width and height
+// whiteImage creates an NRGBA buffer with the given width and height
 // where all pixels are white. The underlying Pix byte array
 // contains w x h x 4 entries.
-func whiteImage(w, h int) *image.RGBA {
-	img := image.NewRGBA(image.Rect(0, 0, w, h))
+func whiteImage(w, h int) NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
 	for i := range img.Pix {
 		img.Pix[i] = ones
 	}
-	return img
+	return NRGBA{img}
 }
 
-func TestBitsPerPixelInRange(t *testing.T) {
-	assert.GreaterOrEqual(t, BitsPerPixel, 1)
-	assert.LessOrEqual(t, BitsPerPixel, 4)
+// pix returns the underlying Pix byte array of the given NRGBA buffer.
+func pix(p Pixels) []uint8 {
+	return p.(NRGBA).Pix
+}
+
+func TestDefaultChannelsInRange(t *testing.T) {
+	assert.True(t, DefaultChannels.Valid())
+	assert.GreaterOrEqual(t, DefaultChannels.Count(), 1)
+	assert.LessOrEqual(t, DefaultChannels.Count(), 4)
+}
+
+func TestParseChannels(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Channels
+		str  string
+		err  bool
+	}{
+		{in: "rgb", want: ChannelR | ChannelG | ChannelB, str: "rgb"},
+		{in: "a", want: ChannelA, str: "a"},
+		{in: "BGRA", want: AllChannels, str: "rgba"},
+		{in: "", err: true},
+		{in: "rr", err: true},
+		{in: "x", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseChannels(tt.in)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.str, got.String())
+		})
+	}
 }
 
 func TestChunk_PixelCount(t *testing.T) {
 	width := rand.Int() % 100
 	height := rand.Int() % 100
-	chunk := Chunk{RGBA: blackImage(width, height)}
+	chunk := Chunk{Pixels: blackImage(width, height)}
 	assert.Equal(t, width*height, chunk.PixelCount())
 }
 
 func TestChunk_LSBCount(t *testing.T) {
-	chunk := Chunk{RGBA: blackImage(5, 5)}
-	assert.Equal(t, 5*5*BitsPerPixel, chunk.LSBCount())
+	chunk := Chunk{Pixels: blackImage(5, 5)}
+	assert.Equal(t, 5*5*DefaultChannels.Count(), chunk.LSBCount())
 }
 
 func TestChunk_MaxPayloadSize1(t *testing.T) {
@@ -65,10 +110,10 @@ func TestChunk_MaxPayloadSize1(t *testing.T) {
 		{100, 100},
 	}
 	for _, tt := range tests {
-		want := tt.width * tt.height * BitsPerPixel / 8
+		want := tt.width * tt.height * DefaultChannels.Count() / 8
 		name := fmt.Sprintf("An image of size %d x %d can hold %d bytes", tt.width, tt.height, want)
 		t.Run(name, func(t *testing.T) {
-			c := &Chunk{RGBA: whiteImage(tt.width, tt.height)}
+			c := &Chunk{Pixels: whiteImage(tt.width, tt.height)}
 			got := c.MaxPayloadSize()
 			assert.Equal(t, want, got, "MaxPayloadSize() = %v, want %v", got, want)
 		})
@@ -77,7 +122,7 @@ func TestChunk_MaxPayloadSize1(t *testing.T) {
 
 func TestChunk_WriteEmptyInput(t *testing.T) {
 
-	chunk := Chunk{RGBA: blackImage(2, 2)}
+	chunk := Chunk{Pixels: blackImage(2, 2)}
 
 	n, err := chunk.Write([]byte{})
 	require.NoError(t, err)
@@ -86,23 +131,23 @@ func TestChunk_WriteEmptyInput(t *testing.T) {
 	assert.Equal(t, 0, chunk.wOff)
 
 	// Test expected bit representation
-	for _, p := range chunk.Pix {
+	for _, p := range pix(chunk.Pixels) {
 		assert.EqualValues(t, 0, p)
 	}
 }
 
 func TestChunk_WriteSetAllBitsToOne(t *testing.T) {
 
-	chunk := Chunk{RGBA: blackImage(2, 2)}
+	chunk := Chunk{Pixels: blackImage(2, 2)}
 
 	n, err := chunk.Write([]byte{ones})
 	require.NoError(t, err)
 
 	assert.Equal(t, 1, n)
-	assert.Equal(t, 1, chunk.wOff)
+	assert.Equal(t, 1*BitsPerByte, chunk.wOff)
 
 	// Test expected bit representation
-	for i, p := range chunk.Pix {
+	for i, p := range pix(chunk.Pixels) {
 		if i >= 8 {
 			break
 		}
@@ -116,13 +161,13 @@ func TestChunk_WriteSetAllBitsToOne(t *testing.T) {
 
 func TestChunk_WriteSetMixedBits(t *testing.T) {
 
-	chunk := Chunk{RGBA: blackImage(3, 2)}
+	chunk := Chunk{Pixels: blackImage(3, 2)}
 
 	n, err := chunk.Write([]byte{0b11110000, 0b00001111})
 	require.NoError(t, err)
 
 	assert.Equal(t, 2, n)
-	assert.Equal(t, 2, chunk.wOff)
+	assert.Equal(t, 2*BitsPerByte, chunk.wOff)
 
 	// Test expected bit representation
 	expects := []PixExpect{
@@ -145,27 +190,27 @@ func TestChunk_WriteSetMixedBits(t *testing.T) {
 
 func TestChunk_WriteMoreThanPossible(t *testing.T) {
 
-	chunk := Chunk{RGBA: blackImage(3, 2)}
+	chunk := Chunk{Pixels: blackImage(3, 2)}
 
 	n, err := chunk.Write([]byte{ones, ones, ones})
 	assert.EqualError(t, err, io.EOF.Error())
 
 	assert.Equal(t, 2, n)
-	assert.Equal(t, 2, chunk.wOff)
+	assert.Equal(t, 2*BitsPerByte, chunk.wOff)
 
 	// Test expected bit representation
-	assert.EqualValues(t, 1, chunk.Pix[20])
+	assert.EqualValues(t, 1, pix(chunk.Pixels)[20])
 }
 
 func TestChunk_WritePartialByteWritten(t *testing.T) {
 
-	chunk := Chunk{RGBA: blackImage(1, 3)} // 12 bytes
+	chunk := Chunk{Pixels: blackImage(1, 3)} // 12 bytes
 
 	n, err := chunk.Write([]byte{ones, ones})
 	assert.EqualError(t, err, io.EOF.Error())
 
 	assert.Equal(t, 1, n)
-	assert.Equal(t, 1, chunk.wOff)
+	assert.Equal(t, 1*BitsPerByte, chunk.wOff)
 
 	// Test expected bit representation
 	expects := []PixExpect{
@@ -186,14 +231,14 @@ func TestChunk_WritePartialByteWritten(t *testing.T) {
 }
 
 func TestRead_MatchingLength(t *testing.T) {
-	chunk := Chunk{RGBA: whiteImage(4, 6)} // 24 pixel -> 24*3=72 available LSBs -> 72/8 = 9 bytes
+	chunk := Chunk{Pixels: whiteImage(4, 6)} // 24 pixel -> 24*3=72 available LSBs -> 72/8 = 9 bytes
 
 	buffer := make([]byte, 9)
 	n, err := chunk.Read(buffer)
 	require.NoError(t, err)
 
 	assert.Equal(t, 9, n)
-	assert.Equal(t, 9, chunk.rOff)
+	assert.Equal(t, 9*BitsPerByte, chunk.rOff)
 
 	for _, b := range buffer {
 		assert.EqualValues(t, ones, b)
@@ -201,14 +246,14 @@ func TestRead_MatchingLength(t *testing.T) {
 }
 
 func TestRead_SmallerReadBuffer(t *testing.T) {
-	chunk := Chunk{RGBA: whiteImage(2, 3)} // 6 Pixel -> 6*3=18 available LSBs -> 18/8 = 2.25 bytes
+	chunk := Chunk{Pixels: whiteImage(2, 3)} // 6 Pixel -> 6*3=18 available LSBs -> 18/8 = 2.25 bytes
 
 	buffer := make([]byte, 1)
 	n, err := chunk.Read(buffer)
 	require.NoError(t, err)
 
 	assert.Equal(t, 1, n)
-	assert.Equal(t, 1, chunk.rOff)
+	assert.Equal(t, 1*BitsPerByte, chunk.rOff)
 
 	for _, b := range buffer {
 		assert.EqualValues(t, ones, b)
@@ -216,28 +261,28 @@ func TestRead_SmallerReadBuffer(t *testing.T) {
 }
 
 func TestRead_LargerReadBuffer(t *testing.T) {
-	chunk := Chunk{RGBA: whiteImage(2, 3)} // 6 Pixel -> 6*3=18 available LSBs -> 18/8 = 2.25 bytes
+	chunk := Chunk{Pixels: whiteImage(2, 3)} // 6 Pixel -> 6*3=18 available LSBs -> 18/8 = 2.25 bytes
 
 	buffer := make([]byte, 3)
 	n, err := chunk.Read(buffer)
 	require.EqualError(t, err, io.EOF.Error())
 
 	assert.Equal(t, 2, n)
-	assert.Equal(t, 2, chunk.rOff)
+	assert.Equal(t, 2*BitsPerByte, chunk.rOff)
 
 	assert.EqualValues(t, ones, buffer[0])
 	assert.EqualValues(t, ones, buffer[0])
 }
 
 func TestRead_PartialReadBuffer(t *testing.T) {
-	chunk := Chunk{RGBA: whiteImage(1, 3)} // 3 Pixel -> 3*3=9 available LSBs -> 9/8 = 1 byte
+	chunk := Chunk{Pixels: whiteImage(1, 3)} // 3 Pixel -> 3*3=9 available LSBs -> 9/8 = 1 byte
 
 	buffer := make([]byte, 2)
 	n, err := chunk.Read(buffer)
 	require.EqualError(t, err, io.EOF.Error())
 
 	assert.Equal(t, 1, n)
-	assert.Equal(t, 1, chunk.rOff)
+	assert.Equal(t, 1*BitsPerByte, chunk.rOff)
 
 	assert.EqualValues(t, ones, buffer[0])
 	assert.EqualValues(t, zeroes, buffer[1])
@@ -245,19 +290,19 @@ func TestRead_PartialReadBuffer(t *testing.T) {
 
 func TestReadWrite(t *testing.T) {
 	payload := []byte{42, 24}
-	chunk := Chunk{RGBA: whiteImage(2, 3)} // 6 Pixel -> 6*3=18 available LSBs -> 18/8 = 2.25 byte
+	chunk := Chunk{Pixels: whiteImage(2, 3)} // 6 Pixel -> 6*3=18 available LSBs -> 18/8 = 2.25 byte
 
 	n, err := chunk.Write(payload)
 	require.NoError(t, err)
 	assert.Equal(t, 2, n)
-	assert.Equal(t, 2, chunk.wOff)
+	assert.Equal(t, 2*BitsPerByte, chunk.wOff)
 
 	parsed := make([]byte, 2)
 	n, err = chunk.Read(parsed)
 	require.NoError(t, err)
 
 	assert.Equal(t, 2, n)
-	assert.Equal(t, 2, chunk.rOff)
+	assert.Equal(t, 2*BitsPerByte, chunk.rOff)
 
 	assert.EqualValues(t, 42, parsed[0])
 	assert.EqualValues(t, 24, parsed[1])
@@ -267,31 +312,31 @@ func TestReadWriteSeparate(t *testing.T) {
 	hash := sha256.New()
 	payload := hash.Sum([]byte{})
 
-	chunk := Chunk{RGBA: whiteImage(100, 100)}
+	chunk := Chunk{Pixels: whiteImage(100, 100)}
 
 	n, err := chunk.Write(payload[0:20])
 	require.NoError(t, err)
 	assert.Equal(t, 20, n)
-	assert.Equal(t, 20, chunk.wOff)
+	assert.Equal(t, 20*BitsPerByte, chunk.wOff)
 
 	n, err = chunk.Write(payload[20:])
 	require.NoError(t, err)
 	assert.Equal(t, 12, n)
-	assert.Equal(t, 32, chunk.wOff)
+	assert.Equal(t, 32*BitsPerByte, chunk.wOff)
 
 	parsed1 := make([]byte, 20)
 	n, err = chunk.Read(parsed1)
 	require.NoError(t, err)
 
 	assert.Equal(t, 20, n)
-	assert.Equal(t, 20, chunk.rOff)
+	assert.Equal(t, 20*BitsPerByte, chunk.rOff)
 
 	parsed2 := make([]byte, 12)
 	n, err = chunk.Read(parsed2)
 	require.NoError(t, err)
 
 	assert.Equal(t, 12, n)
-	assert.Equal(t, 32, chunk.rOff)
+	assert.Equal(t, 32*BitsPerByte, chunk.rOff)
 
 	assert.True(t, bytes.Equal(payload, append(parsed1, parsed2...)))
 }
@@ -305,9 +350,894 @@ type PixExpect struct {
 func assertPixExpect(t *testing.T, chunk Chunk, expects []PixExpect) {
 	for _, e := range expects {
 		got := 0
-		if bit.GetLSB(chunk.Pix[e.idx]) {
+		if bit.GetLSB(pix(chunk.Pixels)[e.idx]) {
 			got = 1
 		}
-		assert.EqualValues(t, e.bit, got, "Pixel at idx %d has val %d, want: %d", e.idx, chunk.Pix[e.idx], e.bit)
+		assert.EqualValues(t, e.bit, got, "Pixel at idx %d has val %d, want: %d", e.idx, pix(chunk.Pixels)[e.idx], e.bit)
+	}
+}
+
+func TestReadWrite_AlphaChannel(t *testing.T) {
+	chunk := Chunk{Pixels: blackImage(HeaderPixels, 2), Channels: ChannelA} // HeaderPixels*3 header LSBs + HeaderPixels LSBs
+
+	// Fill all but the last LSB of the header pixels
+	spare := HeaderPixels*DefaultChannels.Count() - HeaderBitLength
+	require.Equal(t, 1, spare)
+	_, err := chunk.Write(make([]byte, HeaderBitLength/BitsPerByte))
+	require.NoError(t, err)
+
+	payload := []byte{0b10101010, 0b01010101}
+	n, err := chunk.Write(payload)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// The first bit is written to B of the last header pixel
+	last := 4 * (HeaderPixels - 1)
+	expects := []PixExpect{
+		{last + 2, 1},
+		{last + 3, 0},
+		// The remaining bits are written to A of the following pixels
+		{last + 4, 0},
+		{last + 7, 0},
+		{last + 8 + 3, 1},
+		{last + 12 + 3, 0},
+		{last + 16 + 3, 1},
+		{last + 28 + 3, 0},
+		{last + 32 + 3, 0},
+		{last + 36 + 3, 1},
+	}
+	assertPixExpect(t, chunk, expects)
+
+	parsed := make([]byte, 2)
+	_, err = chunk.Read(make([]byte, HeaderBitLength/BitsPerByte))
+	require.NoError(t, err)
+	n, err = chunk.Read(parsed)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, payload, parsed)
+}
+
+func TestCalculateHash_IgnoresPayloadLSBs(t *testing.T) {
+	chunk := &Chunk{Pixels: whiteImage(HeaderPixels, 2), Channels: ChannelA}
+	before, err := chunk.CalculateHash()
+	require.NoError(t, err)
+
+	// LSB of the red channel of a header pixel carries payload
+	pix(chunk.Pixels)[0] = bit.WithLSB(pix(chunk.Pixels)[0], false)
+	// LSB of the alpha channel of a non-header pixel carries payload
+	pix(chunk.Pixels)[4*HeaderPixels+3] = bit.WithLSB(pix(chunk.Pixels)[4*HeaderPixels+3], false)
+
+	after, err := chunk.CalculateHash()
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	// LSB of the red channel of a non-header pixel doesn't carry payload
+	pix(chunk.Pixels)[4*HeaderPixels] = bit.WithLSB(pix(chunk.Pixels)[4*HeaderPixels], false)
+
+	after, err = chunk.CalculateHash()
+	require.NoError(t, err)
+	assert.NotEqual(t, before, after)
+}
+
+func TestReadWrite_Planes(t *testing.T) {
+	chunk := Chunk{Pixels: blackImage(HeaderPixels, 2), Channels: ChannelR | ChannelG, Planes: 4}
+
+	// Fill all but the last LSB of the header pixels
+	_, err := chunk.Write(make([]byte, HeaderBitLength/BitsPerByte))
+	require.NoError(t, err)
+
+	payload := []byte{0b10101010, 0b01010101, 0b11110000}
+	n, err := chunk.Write(payload)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// The first bit is written to B of the last header pixel. The remaining bits fill
+	// the four low bits of R and G of the following pixels, starting at the LSB.
+	assert.EqualValues(t, 0b00001010, pix(chunk.Pixels)[4*HeaderPixels])   // 0, 1, 0, 1 of 0b10101010
+	assert.EqualValues(t, 0b00000010, pix(chunk.Pixels)[4*HeaderPixels+1]) // 0, 1, 0 of 0b10101010 and 0 of 0b01010101
+	assert.EqualValues(t, 0b00000000, pix(chunk.Pixels)[4*HeaderPixels+2]) // B doesn't carry payload
+
+	parsed := make([]byte, 3)
+	_, err = chunk.Read(make([]byte, HeaderBitLength/BitsPerByte))
+	require.NoError(t, err)
+	n, err = chunk.Read(parsed)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, payload, parsed)
+}
+
+func TestCalculateHash_IgnoresPayloadPlanes(t *testing.T) {
+	chunk := &Chunk{Pixels: whiteImage(HeaderPixels, 2), Planes: 3}
+	before, err := chunk.CalculateHash()
+	require.NoError(t, err)
+
+	// The three low bits of the green channel of a non-header pixel carry payload
+	pix(chunk.Pixels)[4*HeaderPixels+1] = bit.WithLowBits(pix(chunk.Pixels)[4*HeaderPixels+1], 0, 3)
+
+	after, err := chunk.CalculateHash()
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	// The second bit of the red channel of a header pixel doesn't carry payload
+	pix(chunk.Pixels)[0] = bit.WithBit(pix(chunk.Pixels)[0], 1, false)
+
+	after, err = chunk.CalculateHash()
+	require.NoError(t, err)
+	assert.NotEqual(t, before, after)
+}
+
+func TestCalculateChunkBounds_Planes(t *testing.T) {
+	img := blackImage(800, 600)
+	one := CalculateChunkBounds(img, DefaultChannels, 1, HashBitLength, 0, false, nil)
+	four := CalculateChunkBounds(img, DefaultChannels, MaxPlanes, HashBitLength, 0, false, nil)
+	assert.Greater(t, len(four)*len(four[0]), len(one)*len(one[0]))
+}
+
+func TestCalculateChunkBounds_TooSmall(t *testing.T) {
+	assert.Nil(t, CalculateChunkBounds(blackImage(HeaderPixels-1, 100), DefaultChannels, 1, HashBitLength, 0, false, nil))
+	assert.Nil(t, CalculateChunkBounds(blackImage(10, 10), DefaultChannels, 1, HashBitLength, 0, false, nil))
+}
+
+func TestChunkBounds(t *testing.T) {
+	bounds := ChunkBounds(10, 7, 3, 2)
+	require.Len(t, bounds, 3)
+	require.Len(t, bounds[0], 2)
+
+	// The remainders are distributed to the first chunks along each axis
+	assert.Equal(t, image.Rect(0, 0, 4, 4), bounds[0][0])
+	assert.Equal(t, image.Rect(4, 4, 7, 7), bounds[1][1])
+	assert.Equal(t, image.Rect(7, 0, 10, 4), bounds[2][0])
+}
+
+func TestReadWriteBits(t *testing.T) {
+	chunk := Chunk{Pixels: blackImage(HeaderPixels, 2), Channels: ChannelA}
+
+	require.NoError(t, chunk.WriteBool(true))
+	require.NoError(t, chunk.WriteBits(0b101, 3))
+	n, err := chunk.Write([]byte{0b11001100})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 12, chunk.wOff)
+
+	// Not enough LSBs left, nothing is written
+	left := chunk.LSBCount() - chunk.wOff
+	assert.Equal(t, io.EOF, chunk.WriteBits(0, uint8(left+1)))
+	assert.Equal(t, 12, chunk.wOff)
+
+	b, err := chunk.ReadBool()
+	require.NoError(t, err)
+	assert.True(t, b)
+
+	v, err := chunk.ReadBits(3)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0b101, v)
+
+	parsed := make([]byte, 1)
+	_, err = chunk.Read(parsed)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0b11001100, parsed[0])
+
+	_, err = chunk.ReadBits(uint8(left + 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestPathCountBitLength(t *testing.T) {
+	tests := []struct {
+		chunkCount int
+		depth      int
+		want       int
+	}{
+		{chunkCount: 2, depth: 1, want: 1},
+		{chunkCount: 4, depth: 2, want: 2},
+		{chunkCount: 6, depth: 3, want: 2},
+		{chunkCount: 128, depth: 7, want: 3},
+		{chunkCount: 130, depth: 8, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d chunks", tt.chunkCount), func(t *testing.T) {
+			assert.Equal(t, tt.depth, TreeDepth(tt.chunkCount))
+			assert.Equal(t, tt.want, PathCountBitLength(tt.chunkCount))
+		})
+	}
+}
+
+func TestMinChunkWidth(t *testing.T) {
+	assert.Equal(t, HeaderPixels+21, MinChunkWidth(AllChannels, DefaultChannels, 1)) // 63 locator bits in R, G and B
+	assert.Equal(t, HeaderPixels+63, MinChunkWidth(AllChannels, ChannelA, 1))
+	assert.Equal(t, HeaderPixels+4, MinChunkWidth(AllChannels, AllChannels, MaxPlanes))
+}
+
+func TestCalculateRowHash(t *testing.T) {
+	chunk := &Chunk{Pixels: whiteImage(HeaderPixels, 3)}
+
+	before := [][]byte{}
+	for y := 0; y < chunk.Height(); y++ {
+		hash, err := chunk.CalculateRowHash(y)
+		require.NoError(t, err)
+		before = append(before, hash)
+	}
+
+	// LSBs that carry payload are not considered
+	pix(chunk.Pixels)[chunk.Pixels.(NRGBA).PixOffset(3, 1)] = bit.WithLSB(pix(chunk.Pixels)[chunk.Pixels.(NRGBA).PixOffset(3, 1)], false)
+	hash, err := chunk.CalculateRowHash(1)
+	require.NoError(t, err)
+	assert.Equal(t, before[1], hash)
+
+	// Only the hash of the modified row changes
+	pix(chunk.Pixels)[chunk.Pixels.(NRGBA).PixOffset(3, 1)] = 0
+	for y := 0; y < chunk.Height(); y++ {
+		hash, err := chunk.CalculateRowHash(y)
+		require.NoError(t, err)
+		if y == 1 {
+			assert.NotEqual(t, before[y], hash)
+		} else {
+			assert.Equal(t, before[y], hash)
+		}
+	}
+}
+
+func TestParseHashAlgorithm(t *testing.T) {
+	for _, a := range []HashAlgorithm{SHA256, SHA512_256, SHA3_256, BLAKE2b256, BLAKE3} {
+		parsed, err := ParseHashAlgorithm(a.String())
+		require.NoError(t, err)
+		assert.Equal(t, a, parsed)
+		assert.Equal(t, HashBitLength/BitsPerByte, a.New().Size())
+	}
+
+	_, err := ParseHashAlgorithm("md5")
+	assert.Error(t, err)
+	assert.False(t, HashAlgorithm(0).Valid())
+}
+
+func TestCalculateHash_Truncated(t *testing.T) {
+	full := &Chunk{Pixels: whiteImage(100, 100), HashAlgorithm: BLAKE3}
+	truncated := &Chunk{Pixels: whiteImage(100, 100), HashAlgorithm: BLAKE3, HashBits: 96}
+
+	fullHash, err := full.CalculateHash()
+	require.NoError(t, err)
+	assert.Len(t, fullHash, HashBitLength/BitsPerByte)
+
+	truncatedHash, err := truncated.CalculateHash()
+	require.NoError(t, err)
+	assert.Equal(t, fullHash[:12], truncatedHash)
+
+	// The default algorithm is SHA256
+	sha256Hash, err := (&Chunk{Pixels: whiteImage(100, 100)}).CalculateHash()
+	require.NoError(t, err)
+	assert.NotEqual(t, fullHash, sha256Hash)
+	assert.Len(t, SHA256.Truncated(96)().Sum(nil), 12)
+}
+
+func TestCalculateHash_Keyed(t *testing.T) {
+	key := []byte("secret")
+
+	plain, err := (&Chunk{Pixels: whiteImage(100, 100)}).CalculateHash()
+	require.NoError(t, err)
+
+	keyed, err := (&Chunk{Pixels: whiteImage(100, 100), Key: key}).CalculateHash()
+	require.NoError(t, err)
+	assert.NotEqual(t, plain, keyed)
+
+	// SHA256 is used as HMAC
+	mac := hmac.New(sha256.New, key)
+	for n := 0; n < 100*100; n++ {
+		mac.Write([]byte{0xFE, 0xFE, 0xFE, 0xFF})
+	}
+	assert.Equal(t, mac.Sum(nil), keyed)
+
+	// BLAKE2b accepts keys of any length
+	long := bytes.Repeat(key, 20)
+	assert.NotEqual(t, BLAKE2b256.NewKeyed(long).Sum(nil), BLAKE2b256.NewKeyed(long[:64]).Sum(nil))
+}
+
+func TestReadWrite_Seed(t *testing.T) {
+	payload := make([]byte, 64)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	sequential := Chunk{Pixels: blackImage(100, 100)}
+	_, err := sequential.Write(payload)
+	require.NoError(t, err)
+
+	scattered := Chunk{Pixels: blackImage(100, 100), Seed: []byte("seed"), SequentialBits: 24}
+	_, err = scattered.Write(payload)
+	require.NoError(t, err)
+
+	parsed := make([]byte, len(payload))
+	_, err = scattered.Read(parsed)
+	require.NoError(t, err)
+	assert.Equal(t, payload, parsed)
+
+	// The first three bytes are written sequentially, the remaining ones spread across the whole chunk
+	assert.Equal(t, pix(sequential.Pixels)[:4*8], pix(scattered.Pixels)[:4*8])
+	assert.NotEqual(t, pix(sequential.Pixels), pix(scattered.Pixels))
+	assert.False(t, bytes.Equal(make([]byte, len(pix(scattered.Pixels))/2), pix(scattered.Pixels)[len(pix(scattered.Pixels))/2:]))
+
+	// Reading with another seed doesn't reveal the payload
+	other := Chunk{Pixels: scattered.Pixels, Seed: []byte("other"), SequentialBits: 24}
+	_, err = other.Read(parsed)
+	require.NoError(t, err)
+	assert.Equal(t, payload[:3], parsed[:3])
+	assert.NotEqual(t, payload[3:], parsed[3:])
+}
+
+func TestScatter(t *testing.T) {
+	perm := scatter([]byte("seed"), 1000)
+	assert.Equal(t, perm, scatter([]byte("seed"), 1000))
+	assert.NotEqual(t, perm, scatter([]byte("other"), 1000))
+
+	seen := make([]bool, len(perm))
+	for _, p := range perm {
+		require.False(t, seen[p])
+		seen[p] = true
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	newAEAD := func(key string) cipher.AEAD {
+		sum := sha256.Sum256([]byte(key))
+		block, err := aes.NewCipher(sum[:])
+		require.NoError(t, err)
+		aead, err := cipher.NewGCM(block)
+		require.NoError(t, err)
+		return aead
+	}
+	nonce := make([]byte, 12)
+
+	c := Chunk{Pixels: blackImage(20, 20), SequentialBits: 24, AEAD: newAEAD("key"), Nonce: nonce, AdditionalData: []byte("ad")}
+	assert.Equal(t, 24+((20*20*3-24)/8-16)*8, c.bitCapacity())
+
+	payload := []byte{1, 2, 3, 4, 5, 6}
+	_, err := c.Write(payload)
+	require.NoError(t, err)
+	require.NoError(t, c.Seal())
+
+	// Only the sequential bytes are readable without the key
+	raw := Chunk{Pixels: c.Pixels}
+	parsed := make([]byte, len(payload))
+	_, err = raw.Read(parsed)
+	require.NoError(t, err)
+	assert.Equal(t, payload[:3], parsed[:3])
+	assert.NotEqual(t, payload[3:], parsed[3:])
+
+	opened := Chunk{Pixels: c.Pixels, SequentialBits: 24, AEAD: newAEAD("key"), Nonce: nonce, AdditionalData: []byte("ad")}
+	_, err = opened.Read(parsed)
+	require.NoError(t, err)
+	assert.Equal(t, payload, parsed)
+
+	wrong := Chunk{Pixels: c.Pixels, SequentialBits: 24, AEAD: newAEAD("other"), Nonce: nonce, AdditionalData: []byte("ad")}
+	assert.Equal(t, ErrAuthentication, wrong.Open())
+	_, err = wrong.Read(parsed)
+	assert.Equal(t, ErrAuthentication, err)
+
+	// Flipping a single LSB of the ciphertext is detected
+	pix(c.Pixels)[len(pix(c.Pixels))-4] ^= 1
+	tampered := Chunk{Pixels: c.Pixels, SequentialBits: 24, AEAD: newAEAD("key"), Nonce: nonce, AdditionalData: []byte("ad")}
+	assert.Equal(t, ErrAuthentication, tampered.Open())
+}
+
+func TestNewPixels(t *testing.T) {
+	assert.IsType(t, NRGBA{}, NewPixels(image.NewRGBA(image.Rect(0, 0, 2, 2))))
+	assert.IsType(t, NRGBA{}, NewPixels(image.NewYCbCr(image.Rect(0, 0, 2, 2), image.YCbCrSubsampleRatio420)))
+	assert.IsType(t, NRGBA64{}, NewPixels(image.NewRGBA64(image.Rect(0, 0, 2, 2))))
+	assert.IsType(t, NRGBA64{}, NewPixels(image.NewNRGBA64(image.Rect(0, 0, 2, 2))))
+	assert.IsType(t, Gray{}, NewPixels(image.NewGray(image.Rect(0, 0, 2, 2))))
+	assert.IsType(t, Gray16{}, NewPixels(image.NewGray16(image.Rect(0, 0, 2, 2))))
+	assert.IsType(t, Paletted{}, NewPixels(image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.Black})))
+
+	// The copy starts at the origin and keeps all 16 bits
+	src := image.NewRGBA64(image.Rect(3, 4, 6, 8))
+	src.SetRGBA64(3, 4, color.RGBA64{R: 0x1234, G: 0x5678, B: 0x9abc, A: 0xffff})
+	p := NewPixels(src)
+	assert.Equal(t, image.Rect(0, 0, 3, 4), p.Bounds())
+	assert.Equal(t, []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xff, 0xff}, p.Pixel(0, 0))
+}
+
+func TestImageToNRGBA(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	rand.New(rand.NewSource(1)).Read(src.Pix)
+	src.SetNRGBA(2, 1, color.NRGBA{R: 0x12, G: 0x34, B: 0x56, A: 0})
+
+	// The pixels of a sub image are copied verbatim, even the color of transparent ones
+	sub := src.SubImage(image.Rect(1, 1, 3, 4)).(*image.NRGBA)
+	dst := ImageToNRGBA(sub)
+	assert.Equal(t, image.Rect(0, 0, 2, 3), dst.Bounds())
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 2; x++ {
+			assert.Equal(t, sub.NRGBAAt(1+x, 1+y), dst.NRGBAAt(x, y))
+		}
+	}
+
+	// Other image types are converted
+	gray := image.NewGray16(image.Rect(5, 5, 7, 7))
+	gray.SetGray16(6, 5, color.Gray16{Y: 0xffff})
+	assert.Equal(t, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, ImageToNRGBA(gray).NRGBAAt(1, 0))
+	assert.Equal(t, color.Gray16{Y: 0xffff}, ImageToGray16(gray).Gray16At(1, 0))
+	assert.Equal(t, color.Gray{Y: 0xff}, ImageToGray(gray).GrayAt(1, 0))
+}
+
+func TestChunk_NRGBA64(t *testing.T) {
+	img := image.NewNRGBA64(image.Rect(0, 0, 40, 10))
+	for i := range img.Pix {
+		img.Pix[i] = ones
+	}
+	c := &Chunk{Pixels: NRGBA64{img}, Planes: 2}
+	assert.Equal(t, LSBCount(400, AllChannels, DefaultChannels, 2), c.LSBCount())
+
+	hash, err := c.CalculateHash()
+	require.NoError(t, err)
+
+	payload := make([]byte, c.MaxPayloadSize())
+	rand.New(rand.NewSource(1)).Read(payload)
+	n, err := c.Write(payload)
+	require.NoError(t, err)
+	assert.Equal(t, len(payload), n)
+
+	// The payload only occupies the low bits of the least significant byte of every sample
+	for i, p := range img.Pix {
+		if i%2 == 0 || i%8 == 7 {
+			assert.EqualValues(t, ones, p, "byte %d", i)
+		}
+	}
+
+	parsed := make([]byte, len(payload))
+	_, err = (&Chunk{Pixels: NRGBA64{img}, Planes: 2}).Read(parsed)
+	require.NoError(t, err)
+	assert.Equal(t, payload, parsed)
+
+	// The hash covers all 16 bits except for the payload bits
+	written, err := c.CalculateHash()
+	require.NoError(t, err)
+	assert.Equal(t, hash, written)
+
+	img.Pix[img.PixOffset(20, 5)] ^= 1
+	tampered, err := c.CalculateHash()
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, tampered)
+
+	// Chunks of different bit depths are never equal
+	equal, err := c.Equals(&Chunk{Pixels: whiteImage(40, 10), Planes: 2})
+	require.NoError(t, err)
+	assert.False(t, equal)
+}
+
+func TestChunk_Gray(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, HeaderPixelCount(ChannelR, HeaderBitLength)+20, 10))
+	for i := range img.Pix {
+		img.Pix[i] = ones
+	}
+	c := &Chunk{Pixels: Gray{img}, Planes: 2}
+
+	// The header pixels carry a single bit and all other pixels Planes bits in the gray sample
+	assert.Equal(t, HeaderBitLength, HeaderPixelCount(ChannelR, HeaderBitLength))
+	assert.Equal(t, HeaderBitLength+(img.Bounds().Dx()*10-HeaderBitLength)*2, c.LSBCount())
+	assert.Equal(t, LSBCount(img.Bounds().Dx()*10, ChannelR, ChannelR, 2), c.LSBCount())
+
+	hash, err := c.CalculateHash()
+	require.NoError(t, err)
+
+	payload := make([]byte, c.MaxPayloadSize())
+	rand.New(rand.NewSource(1)).Read(payload)
+	n, err := c.Write(payload)
+	require.NoError(t, err)
+	assert.Equal(t, len(payload), n)
+
+	for i, p := range img.Pix {
+		if i < HeaderBitLength {
+			assert.EqualValues(t, ones>>1, p>>1, "byte %d", i)
+		} else {
+			assert.EqualValues(t, ones>>2, p>>2, "byte %d", i)
+		}
+	}
+
+	parsed := make([]byte, len(payload))
+	_, err = (&Chunk{Pixels: Gray{img}, Planes: 2}).Read(parsed)
+	require.NoError(t, err)
+	assert.Equal(t, payload, parsed)
+
+	written, err := c.CalculateHash()
+	require.NoError(t, err)
+	assert.Equal(t, hash, written)
+
+	img.Pix[0] ^= 0b10
+	tampered, err := c.CalculateHash()
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, tampered)
+}
+
+func TestPaletted_Paired(t *testing.T) {
+	palette := color.Palette{color.Black, color.White, color.NRGBA{R: 0xff, A: 0xff}}
+	img := image.NewPaletted(image.Rect(0, 0, 3, 1), palette)
+	img.Pix = []uint8{0, 1, 2}
+
+	paired, ok := Paletted{img}.Paired(2)
+	require.True(t, ok)
+	assert.Len(t, paired.Palette, 12)
+	assert.Equal(t, []uint8{0, 4, 8}, paired.Pix)
+
+	// Every value of the payload bits keeps the color
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, palette[1], paired.Palette[4+i])
+	}
+
+	// The original image is untouched
+	assert.Equal(t, []uint8{0, 1, 2}, img.Pix)
+	assert.Len(t, img.Palette, 3)
+
+	_, ok = Paletted{image.NewPaletted(image.Rect(0, 0, 1, 1), make(color.Palette, 129))}.Paired(1)
+	assert.False(t, ok)
+}
+
+func TestChunk_Paletted(t *testing.T) {
+	palette := color.Palette{color.Black, color.Black, color.White, color.White}
+	img := image.NewPaletted(image.Rect(0, 0, HeaderBitLength+20, 2), palette)
+	c := &Chunk{Pixels: Paletted{img}}
+
+	hash, err := c.CalculateHash()
+	require.NoError(t, err)
+
+	_, err = c.Write([]byte("payload"))
+	require.NoError(t, err)
+
+	// The parity of the palette indexes carries the payload without changing the hash
+	written, err := c.CalculateHash()
+	require.NoError(t, err)
+	assert.Equal(t, hash, written)
+
+	// Pointing to another color or changing the palette is detected
+	img.Pix[len(img.Pix)-1] = 2
+	tampered, err := c.CalculateHash()
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, tampered)
+
+	img.Pix[len(img.Pix)-1] = 0
+	palette[0] = color.Gray{Y: 1}
+	tampered, err = c.CalculateHash()
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, tampered)
+}
+
+func TestChunk_SkipTransparent(t *testing.T) {
+	img := whiteImage(HeaderPixels+20, 4)
+	for y := 1; y < 4; y++ {
+		for x := 0; x < 10; x++ {
+			img.Pix[img.PixOffset(x, y)+3] = 0
+		}
+	}
+	// A transparent header pixel still carries the header
+	img.Pix[img.PixOffset(0, 0)+3] = 0
+
+	c := &Chunk{Pixels: img, SkipTransparent: true}
+	assert.Equal(t, LSBCount((HeaderPixels+20)*4-30, AllChannels, DefaultChannels, 1), c.LSBCount())
+
+	hash, err := c.CalculateHash()
+	require.NoError(t, err)
+
+	payload := make([]byte, c.MaxPayloadSize())
+	rand.New(rand.NewSource(1)).Read(payload)
+	_, err = c.Write(payload)
+	require.NoError(t, err)
+
+	// Transparent pixels after the header pixels are left untouched
+	for y := 1; y < 4; y++ {
+		for x := 0; x < 10; x++ {
+			assert.Equal(t, []byte{ones, ones, ones, 0}, img.Pixel(x, y))
+		}
+	}
+
+	parsed := make([]byte, len(payload))
+	_, err = (&Chunk{Pixels: img, SkipTransparent: true}).Read(parsed)
+	require.NoError(t, err)
+	assert.Equal(t, payload, parsed)
+
+	// Discarding the color of transparent pixels doesn't change the hash unless they aren't skipped
+	unskipped, err := (&Chunk{Pixels: img}).CalculateHash()
+	require.NoError(t, err)
+
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 10; x++ {
+			if img.Pixel(x, y)[3] == 0 {
+				copy(img.Pixel(x, y), []byte{0, 0, 0, 0})
+			}
+		}
+	}
+	written, err := c.CalculateHash()
+	require.NoError(t, err)
+	assert.Equal(t, hash, written)
+
+	changed, err := (&Chunk{Pixels: img}).CalculateHash()
+	require.NoError(t, err)
+	assert.NotEqual(t, unskipped, changed)
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, name := range []string{"png", "tiff", "bmp", "webp"} {
+		f, err := ParseFormat(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, f.String())
+	}
+
+	f, err := ParseFormat("TIF")
+	require.NoError(t, err)
+	assert.Equal(t, FormatTIFF, f)
+
+	_, err = ParseFormat("gif")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrLossyFormat))
+
+	// Lossy formats are refused with an explanation
+	_, err = ParseFormat("JPEG")
+	assert.True(t, errors.Is(err, ErrLossyFormat))
+	assert.Contains(t, err.Error(), "least significant bits")
+	err = SaveImageFile(path.Join(os.TempDir(), "encoded.JPG"), whiteImage(2, 2))
+	assert.True(t, errors.Is(err, ErrLossyFormat))
+
+	f, ok := FormatOf("dir/scan.TIF")
+	assert.True(t, ok)
+	assert.Equal(t, FormatTIFF, f)
+	assert.Equal(t, ".tiff", f.Extension())
+
+	_, ok = FormatOf("photo.jpg")
+	assert.False(t, ok)
+}
+
+// formatImages returns images of every color model an encoded image can have, with random samples
+// and transparent pixels.
+func formatImages() []image.Image {
+	rnd := rand.New(rand.NewSource(1))
+	r := image.Rect(0, 0, 37, 23)
+
+	nrgba := image.NewNRGBA(r)
+	nrgba64 := image.NewNRGBA64(r)
+	gray := image.NewGray(r)
+	gray16 := image.NewGray16(r)
+	for _, pix := range [][]byte{nrgba.Pix, nrgba64.Pix, gray.Pix, gray16.Pix} {
+		rnd.Read(pix)
+	}
+	for i := 0; i < 40; i++ {
+		nrgba.Pix[i*4+3] = 0
+		nrgba64.Pix[i*8+6], nrgba64.Pix[i*8+7] = 0, 0
+	}
+
+	palette := color.Palette{color.Black, color.White, color.NRGBA{R: 0x12, G: 0x34, B: 0x56, A: 0xff}, color.NRGBA{R: 0xfe, A: 0xff}}
+	paletted := image.NewPaletted(r, palette)
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(rnd.Intn(len(palette)))
+	}
+
+	return []image.Image{nrgba, nrgba64, gray, gray16, paletted}
+}
+
+// assertSamePixels asserts that both images have the same pixel buffer type and bytes.
+func assertSamePixels(t *testing.T, expected image.Image, actual image.Image) {
+	e, a := NewPixels(expected), NewPixels(actual)
+	require.IsType(t, e, a)
+	require.Equal(t, e.Bounds(), a.Bounds())
+	for y := 0; y < e.Bounds().Dy(); y++ {
+		for x := 0; x < e.Bounds().Dx(); x++ {
+			require.Equal(t, e.Pixel(x, y), a.Pixel(x, y), "pixel %d,%d", x, y)
+			require.Equal(t, e.AppendColor(nil, e.Pixel(x, y)), a.AppendColor(nil, a.Pixel(x, y)), "pixel %d,%d", x, y)
+		}
+	}
+}
+
+func TestSaveImageFile_Formats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stego")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, f := range []Format{FormatPNG, FormatTIFF, FormatBMP, FormatWebP} {
+		for _, img := range formatImages() {
+			t.Run(fmt.Sprintf("%s/%T", f, img), func(t *testing.T) {
+				converted := f.Convert(img)
+				require.True(t, f.Supports(converted))
+				if f.Supports(img) {
+					assert.Equal(t, img, converted)
+				}
+
+				filename := path.Join(dir, "image"+f.Extension())
+				require.NoError(t, SaveImageFile(filename, converted))
+
+				decoded, err := OpenImageFile(filename)
+				require.NoError(t, err)
+				assertSamePixels(t, converted, decoded)
+
+				pages, format, err := OpenImagePages(filename)
+				require.NoError(t, err)
+				assert.Equal(t, f.String(), format)
+				require.Len(t, pages, 1)
+				assertSamePixels(t, converted, pages[0])
+			})
+		}
+	}
+}
+
+func TestFormat_Convert(t *testing.T) {
+	r := image.Rect(0, 0, 2, 2)
+	transparent := image.NewPaletted(r, color.Palette{color.Transparent, color.Black})
+
+	assert.IsType(t, &image.Gray{}, FormatBMP.Convert(image.NewGray16(r)))
+	assert.IsType(t, &image.NRGBA{}, FormatBMP.Convert(image.NewNRGBA64(r)))
+	assert.IsType(t, &image.NRGBA{}, FormatBMP.Convert(transparent))
+	assert.IsType(t, &image.NRGBA{}, FormatTIFF.Convert(transparent))
+	assert.IsType(t, &image.NRGBA{}, FormatWebP.Convert(image.NewGray(r)))
+	assert.IsType(t, &image.NRGBA64{}, FormatTIFF.Convert(image.NewNRGBA64(r)))
+	assert.IsType(t, &image.NRGBA{}, FormatTIFF.Convert(image.NewYCbCr(r, image.YCbCrSubsampleRatio420)))
+
+	assert.Error(t, EncodeImage(ioutil.Discard, FormatWebP, image.NewGray(r)))
+	assert.Error(t, EncodeImage(ioutil.Discard, FormatBMP, transparent))
+	assert.Error(t, EncodeImage(ioutil.Discard, FormatTIFF, image.NewGray(r), PNGChunk{Type: "tEXt"}))
+}
+
+func TestSaveImagePages_TIFF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stego")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pages := formatImages()
+	filename := path.Join(dir, "pages.tif")
+	require.NoError(t, SaveImagePages(filename, pages))
+
+	decoded, format, err := OpenImagePages(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "tiff", format)
+	require.Len(t, decoded, len(pages))
+	for i := range pages {
+		assertSamePixels(t, pages[i], decoded[i])
+	}
+
+	// The first page is opened as a single image
+	first, err := OpenImageFile(filename)
+	require.NoError(t, err)
+	assertSamePixels(t, pages[0], first)
+
+	assert.Error(t, SaveImagePages(path.Join(dir, "pages.png"), pages))
+}
+
+func TestEncodeTIFF_WordAligned(t *testing.T) {
+	// Pixel data of various lengths, so that some IFDs would start at odd offsets
+	var pages []image.Image
+	for i, page := range formatImages() {
+		pages = append(pages, page)
+		if sub, ok := page.(interface {
+			SubImage(image.Rectangle) image.Image
+		}); ok {
+			pages = append(pages, sub.SubImage(image.Rect(0, 0, 5+i, 3)))
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, EncodeTIFF(buf, pages...))
+	data := buf.Bytes()
+
+	count := 0
+	for ifd := binary.LittleEndian.Uint32(data[4:8]); ifd != 0; count++ {
+		assert.Zero(t, ifd%2, "IFD offset %d", ifd)
+
+		end := ifd + 2 + uint32(binary.LittleEndian.Uint16(data[ifd:]))*12
+		for e := ifd + 2; e < end; e += 12 {
+			typ := binary.LittleEndian.Uint16(data[e+2:])
+			if tiffTypeSizes[typ]*binary.LittleEndian.Uint32(data[e+4:]) > 4 {
+				assert.Zero(t, binary.LittleEndian.Uint32(data[e+8:])%2, "value offset of tag %d", binary.LittleEndian.Uint16(data[e:]))
+			}
+		}
+		ifd = binary.LittleEndian.Uint32(data[end:])
+	}
+	assert.Equal(t, len(pages), count)
+
+	decoded, err := DecodeTIFF(append([]byte{}, data...))
+	require.NoError(t, err)
+	require.Len(t, decoded, len(pages))
+	for i := range pages {
+		assertSamePixels(t, FormatTIFF.Convert(pages[i]), decoded[i])
+	}
+}
+
+func TestTIFFIFD_MultipleStrips(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, tiff.Encode(buf, image.NewGray(image.Rect(0, 0, 4, 4)), nil))
+	data := buf.Bytes()
+
+	ifd, end, err := tiffIFD(data)
+	require.NoError(t, err)
+
+	// The offsets of multiple strips wouldn't be relocated
+	for e := ifd + 2; e < end; e += 12 {
+		if binary.LittleEndian.Uint16(data[e:]) == tiffStripOffsets {
+			binary.LittleEndian.PutUint32(data[e+4:], 2)
+		}
+	}
+	_, _, err = tiffIFD(data)
+	assert.Error(t, err)
+}
+
+func TestEncodeWebP_PrefixCodes(t *testing.T) {
+	// A single color needs no bits per pixel
+	img := whiteImage(3, 2).NRGBA
+	buf := &bytes.Buffer{}
+	require.NoError(t, EncodeWebP(buf, img))
+	decoded, err := webp.Decode(buf)
+	require.NoError(t, err)
+	assertSamePixels(t, img, decoded)
+
+	// Fibonacci distributed samples lead to Huffman codes beyond the maximum code length
+	img = image.NewNRGBA(image.Rect(0, 0, 256, 128))
+	i, a, b := 0, 1, 1
+	for v := 0; i < len(img.Pix)/4; v++ {
+		for n := 0; n < a && i < len(img.Pix)/4; n++ {
+			copy(img.Pix[i*4:], []byte{uint8(v), uint8(v), uint8(v), 0xff - uint8(v)})
+			i++
+		}
+		a, b = b, a+b
+	}
+	assert.Greater(t, maxDepth(huffmanDepths([]uint32{1, 1, 2, 3, 5, 8, 13, 21, 34, 55, 89, 144, 233, 377, 610, 987, 1597, 2584})), webpMaxCodeLength)
+
+	buf.Reset()
+	require.NoError(t, EncodeWebP(buf, img))
+	decoded, err = webp.Decode(buf)
+	require.NoError(t, err)
+	assertSamePixels(t, img, decoded)
+
+	assert.Error(t, EncodeWebP(ioutil.Discard, image.NewNRGBA(image.Rect(0, 0, webpMaxSize+1, 1))))
+}
+
+func TestEncodeWebP_Decode(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, size := range []image.Point{{1, 1}, {1, 7}, {7, 1}, {2, 3}, {13, 5}, {37, 23}, {255, 3}, {129, 65}} {
+		// Random colors with fully transparent, semi-transparent and opaque pixels
+		noise := image.NewNRGBA(image.Rectangle{Max: size})
+		rnd.Read(noise.Pix)
+		for i := 3; i < len(noise.Pix); i += 4 {
+			noise.Pix[i] = []byte{0, 0x80, 0xff, noise.Pix[i]}[i/4%4]
+		}
+
+		// Only a few distinct samples in every channel and a constant alpha channel
+		few := image.NewNRGBA(image.Rectangle{Max: size})
+		for i := range few.Pix {
+			few.Pix[i] = uint8(rnd.Intn(3))
+			if i%4 == 3 {
+				few.Pix[i] = 0xff
+			}
+		}
+
+		// A sub image doesn't start at the origin
+		sub := noise.SubImage(image.Rect(size.X/2, size.Y/2, size.X, size.Y)).(*image.NRGBA)
+
+		for name, img := range map[string]*image.NRGBA{"noise": noise, "few": few, "sub": sub} {
+			t.Run(fmt.Sprintf("%s %dx%d", name, size.X, size.Y), func(t *testing.T) {
+				buf := &bytes.Buffer{}
+				require.NoError(t, EncodeWebP(buf, img))
+
+				decoded, err := webp.Decode(buf)
+				require.NoError(t, err)
+				assertSamePixels(t, ImageToNRGBA(img), decoded)
+			})
+		}
+	}
+}
+
+func TestReadPNGChunk_Length(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, EncodePNG(buf, image.NewGray(image.Rect(0, 0, 4, 4)), PNGChunk{Type: "stEg", Data: []byte("proof")}))
+	valid := buf.Bytes()
+
+	data, err := ReadPNGChunk(bytes.NewReader(valid), "stEg", 5)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("proof"), data)
+
+	_, err = ReadPNGChunk(bytes.NewReader(valid), "stEg", 4)
+	assert.Error(t, err)
+
+	// Crafted lengths are rejected or fail once the stream ends instead of allocating the whole length upfront
+	for _, length := range []uint32{MaxPNGChunkLength, MaxPNGChunkLength + 1, 0xFFFFFFFF} {
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header, length)
+		copy(header[4:], "stEg")
+		stream := append(append(append([]byte{}, pngSignature...), header...), []byte("proof")...)
+
+		_, err = ReadPNGChunk(bytes.NewReader(stream), "stEg", MaxPNGChunkLength)
+		assert.Error(t, err, length)
+
+		_, err = ReadPNGChunk(bytes.NewReader(stream), "IDAT", MaxPNGChunkLength)
+		assert.Error(t, err, length)
 	}
 }
@@ -1,18 +1,34 @@
 package chunk
 
 const (
-	// BitsPerPixel says how many colors should be used for LSB encoding.
-	// 1 - only R, 2 - R and G, 3 - R, G and B, 4 - R, G, B and A
-	BitsPerPixel = 3
+	// The number of bits occupied by the chunk header. The header holds a magic value, the format version,
+	// the hash algorithm, the channel and plane configuration, the chunk grid dimensions, flags and the
+	// configuration of optional payload like row hashes.
+	HeaderBitLength = 104
 
-	// The number of bits occupied by one SHA256 hash.
+	// The number of pixels at the beginning of a chunk of a color image that hold the header. The header
+	// is always written to the R, G and B channels of these pixels, so that it can be read without knowing
+	// the channel configuration. Grayscale and paletted images need more header pixels (see HeaderPixelCount).
+	HeaderPixels = (HeaderBitLength + 2) / 3
+
+	// The number of bits occupied by the chunk locator. The locator directly follows the header and holds
+	// the position of the chunk in the chunk grid as well as the dimensions of the encoded image.
+	LocatorBitLength = 64
+
+	// The maximum number of low bits per channel that can carry payload.
+	MaxPlanes = 4
+
+	// The maximum number of bits of the truncated hash of every pixel row of a chunk.
+	MaxRowHashBits = 32
+
+	// The number of bits occupied by one untruncated hash. All supported hash algorithms produce digests of this length.
 	HashBitLength = 256
 
-	// The number of bits occupied by the side information of a merkle tree leaf.
-	MerkleSideBitLength = 8
+	// The minimum number of bits hashes can be truncated to.
+	MinHashBits = 64
 
-	// The number of bits occupied by the information of how many merkle tree leaves are encoded in the chunk.
-	PathCountBitLength = 8
+	// The number of bits occupied by the side information of a merkle tree leaf.
+	MerkleSideBitLength = 1
 
 	// The number of bits in a byte.
 	BitsPerByte = 8
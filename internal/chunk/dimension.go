@@ -3,10 +3,18 @@ package chunk
 import (
 	"image"
 	"math"
+	"math/bits"
 )
 
-// CalculateChunkBounds takes the given *image.RGBA and calculates the optimal distribution of image chunks
-// to encode the merkle tree data.
+// CalculateChunkBounds takes the given Pixels buffer and calculates the optimal distribution of image chunks
+// to encode the merkle tree data into the given number of low bits (planes) of the given channels.
+// More planes mean more available bits per chunk and therefore a finer chunk grid. If rowHashBits is
+// not 0 every pixel row of a chunk additionally needs to store a hash truncated to that number of bits.
+// Every Merkle node occupies hashBits bits, so truncated hashes allow for a finer chunk grid as well. Payload
+// that every chunk carries in addition to the Merkle tree information, like a signature, occupies as many bits
+// as extraBits returns for the number of chunks. extraBits may be nil if there is no additional payload.
+// If skipTransparent is set fully transparent pixels don't carry payload (see Chunk.SkipTransparent), so
+// only the pixels of the chunk with the fewest visible pixels are considered available.
 //
 // The more chunks we anticipate the smaller they become, the more of them are there and the more data needs
 // to be encoded in each chunk to store all the merkle tree data. So there is an optimum of the number of chunks.
@@ -19,92 +27,214 @@ import (
 // the number of available bits will usually be much larger than the required bits.
 //
 // If the amount of required bits exceeds the available least significant bits we stop and are sure we have found
-// the maximum number of chunks that this image can be divided into.
+// the maximum number of chunks that this image can be divided into. Chunk counts whose distribution would make
+// the chunks narrower than MinChunkWidth are skipped.
 //
-// Beware that with one merkle tree leaf hash (256 bits) the side of the merkle node (1 byte) needs to be encoded
-// and the number of leaf nodes (offset of 8) as well.
+// Beware that with one merkle tree leaf hash (hashBits bits) the side of the merkle node (1 bit) needs to be encoded
+// and the number of leaf nodes (see PathCountBitLength) as well as the chunk header and locator. Furthermore, each chunk
+// needs to be at least MinChunkWidth wide, so that the header and locator of every chunk can be found in its first row.
 //
-// As a last step we built a matrix of bounds that represent the chunks in the given image. Since the chunks may
-// not divide the side lengths perfectly we need to handle the clipping as well.
-func CalculateChunkBounds(rgba *image.RGBA) [][]image.Rectangle {
+// As a last step we built a matrix of bounds that represent the chunks in the given image (see ChunkBounds).
+// If the image is too small to be divided into at least two chunks nil is returned.
+func CalculateChunkBounds(pixels Pixels, channels Channels, planes int, hashBits int, rowHashBits int, skipTransparent bool, extraBits func(chunkCount int) int) [][]image.Rectangle {
 
-	chunk := Chunk{RGBA: rgba}
+	width, height := pixels.Bounds().Dx(), pixels.Bounds().Dy()
+
+	minChunkWidth := MinChunkWidth(pixels.PixelChannels(), channels, planes)
+
+	var visible *visibleCounter
+	if skipTransparent && pixels.PixelChannels()&ChannelA != 0 {
+		visible = newVisibleCounter(pixels)
+	}
 
 	// Calculate maximum number of chunks that this image can be divided into taken into account
 	chunkCount := 0
-	for {
-		chunkCount += 2
+	for count := 2; count <= width/minChunkWidth*height; count += 2 {
 		// neededBitsPerChunk answers the question: How many bits do we need to store the merkle tree leaves if
-		// we had chunkCount many chunks. The more chunks -> the more merkle leaves -> the less data can be saved
+		// we had count many chunks. The more chunks -> the more merkle leaves -> the less data can be saved
 		// into one chunk.
 
-		// The number of hashes that need to be saved into each chunk based on the total chunk count.
-		hashesPerChunk := int(math.Ceil(math.Log2(float64(chunkCount))))
-		neededBitsPerChunk := hashesPerChunk*(HashBitLength+MerkleSideBitLength) + PathCountBitLength
+		// The number of bits of the Merkle path that need to be saved into each chunk based on the total chunk count.
+		neededBitsPerChunk := HeaderBitLength + LocatorBitLength + PathBitLength(count, hashBits)
+		if extraBits != nil {
+			neededBitsPerChunk += extraBits(count)
+		}
 
-		chunkCountX, chunkCountY := chunkDist(chunkCount)
+		chunkCountX, chunkCountY := chunkDist(count)
 
 		// guaranteed width and height of each chunk (could be more due to clipping
-		chunkWidth := chunk.Width() / chunkCountX
-		chunkHeight := chunk.Height() / chunkCountY
+		chunkWidth := width / chunkCountX
+		chunkHeight := height / chunkCountY
+
+		// Every pixel row of the chunk may carry a truncated hash. Due to clipping a chunk can be one row higher.
+		neededBitsPerChunk += (chunkHeight + 1) * rowHashBits
+
+		// If the header and locator don't fit into the first row of the chunks with this distribution
+		// we skip this count. A larger count may distribute more evenly.
+		if chunkWidth < minChunkWidth || chunkHeight == 0 {
+			continue
+		}
+
+		// Every chunk contains at least this many pixels that carry payload. As the skipped pixels follow the
+		// header and the sequentially filled pixels, all visible pixels of a chunk carry payload.
+		pixelsPerChunk := chunkWidth * chunkHeight
+		if visible != nil {
+			pixelsPerChunk = visible.min(ChunkBounds(width, height, chunkCountX, chunkCountY))
+		}
 
 		// The available amount of bits in each chunk
-		availableBitsPerChunk := chunkWidth * chunkHeight * 3
+		availableBitsPerChunk := LSBCount(pixelsPerChunk, pixels.PixelChannels(), channels, planes)
 
-		// If we need more bits than are available we stop and decrement the chunk count to the last
-		// "working" count.
+		// If we need more bits than are available we stop and keep the last "working" count.
 		if neededBitsPerChunk > availableBitsPerChunk {
-			chunkCount -= 2
 			break
 		}
+
+		chunkCount = count
+	}
+
+	// The image is too small to hold even two chunks
+	if chunkCount < 2 {
+		return nil
 	}
 
 	// Calculate the number of chunks along the width and height
 	chunkCountX, chunkCountY := chunkDist(chunkCount)
 
-	// guaranteed width and height of each chunk
-	chunkWidth := chunk.Width() / chunkCountX
-	chunkHeight := chunk.Height() / chunkCountY
+	return ChunkBounds(width, height, chunkCountX, chunkCountY)
+}
 
-	// Add clippings (the side length to chunk count ratio will likely be rational so we add the remainder to the
-	// side lengths equally.
-	chunkWidthClippings := chunk.Width() % chunkCountX
-	chunkHeightClippings := chunk.Height() % chunkCountY
+// visibleCounter counts the pixels of arbitrary regions of a Pixels buffer that aren't fully transparent
+// in constant time with a summed-area table.
+type visibleCounter struct {
+	// sums holds the number of visible pixels above and left of every pixel position, indexed by y*(width+1)+x.
+	sums []int
 
-	bounds := make([][]image.Rectangle, chunkCountX)
-	for i := range bounds {
-		bounds[i] = make([]image.Rectangle, chunkCountY)
-	}
+	// stride is the width of the buffer plus one.
+	stride int
+}
 
-	cxOff := 0
-	cyOff := 0
-	for cx := 0; cx < chunkCountX; cx++ {
+// newVisibleCounter builds the summed-area table of the visible pixels of the given buffer.
+func newVisibleCounter(pixels Pixels) *visibleCounter {
+	bounds := pixels.Bounds()
+	vc := &visibleCounter{
+		sums:   make([]int, (bounds.Dx()+1)*(bounds.Dy()+1)),
+		stride: bounds.Dx() + 1,
+	}
 
-		cw := chunkWidth
-		if cx < chunkWidthClippings {
-			cw += 1
-			cxOff = 0
-		} else {
-			cxOff = chunkWidthClippings
+	for y := 0; y < bounds.Dy(); y++ {
+		row := 0
+		for x := 0; x < bounds.Dx(); x++ {
+			if !transparent(pixels, pixels.Pixel(bounds.Min.X+x, bounds.Min.Y+y)) {
+				row++
+			}
+			vc.sums[(y+1)*vc.stride+x+1] = vc.sums[y*vc.stride+x+1] + row
 		}
+	}
+
+	return vc
+}
 
-		for cy := 0; cy < chunkCountY; cy++ {
+// count returns the number of visible pixels within the given region, relative to the origin of the buffer.
+func (vc *visibleCounter) count(r image.Rectangle) int {
+	return vc.sums[r.Max.Y*vc.stride+r.Max.X] - vc.sums[r.Min.Y*vc.stride+r.Max.X] -
+		vc.sums[r.Max.Y*vc.stride+r.Min.X] + vc.sums[r.Min.Y*vc.stride+r.Min.X]
+}
 
-			ch := chunkHeight
-			if cy < chunkHeightClippings {
-				ch += 1
-				cyOff = 0
-			} else {
-				cyOff = chunkHeightClippings
+// min returns the smallest number of visible pixels of all the given chunks.
+func (vc *visibleCounter) min(bounds [][]image.Rectangle) int {
+	m := -1
+	for _, boundsRow := range bounds {
+		for _, bound := range boundsRow {
+			if n := vc.count(bound); m < 0 || n < m {
+				m = n
 			}
+		}
+	}
+	return m
+}
+
+// TreeDepth returns the depth of a Merkle tree with the given number of leaves. This is the
+// number of nodes on the Merkle path of every leaf.
+func TreeDepth(leafCount int) int {
+	return int(math.Ceil(math.Log2(float64(leafCount))))
+}
+
+// PathBitLength returns the number of bits occupied by the Merkle path of every chunk of an image that is divided
+// into the given number of chunks with hashes of the given number of bits: the number of nodes followed by the
+// side bit and the hash of every node.
+func PathBitLength(chunkCount int, hashBits int) int {
+	return PathCountBitLength(chunkCount) + TreeDepth(chunkCount)*(hashBits+MerkleSideBitLength)
+}
+
+// PathCountBitLength returns the number of bits occupied by the information of how many merkle tree
+// nodes are encoded in each chunk of an image that is divided into the given number of chunks.
+func PathCountBitLength(chunkCount int) int {
+	return bits.Len(uint(TreeDepth(chunkCount)))
+}
+
+// MinChunkWidth returns the minimum width of a chunk with the given channel and plane configuration of a Pixels
+// buffer whose pixels consist of the available channels (see Pixels.PixelChannels), so that its header and
+// locator fit into its first row. This allows reading them without knowing the chunk grid, e.g. in a cropped image.
+func MinChunkWidth(available Channels, channels Channels, planes int) int {
+	if channels == 0 {
+		channels = HeaderChannels(available)
+	}
+
+	if planes == 0 {
+		planes = 1
+	}
+
+	// The header pixels may have some LSBs left that are used by the locator
+	headerPixels := HeaderPixelCount(available, HeaderBitLength)
+	spareBits := headerPixels*HeaderChannels(available).Count() - HeaderBitLength
+	bitsPerPixel := channels.Count() * planes
+
+	return headerPixels + (LocatorBitLength-spareBits+bitsPerPixel-1)/bitsPerPixel
+}
 
-			bounds[cx][cy] = image.Rect(cw, ch, 0, 0).Add(image.Pt(cxOff+cx*cw, cyOff+cy*ch))
+// ChunkBounds divides an image with the given width and height into a grid of chunkCountX x chunkCountY
+// chunks and returns their bounds indexed by [x][y].
+func ChunkBounds(width, height, chunkCountX, chunkCountY int) [][]image.Rectangle {
+
+	bounds := make([][]image.Rectangle, chunkCountX)
+	for cx := range bounds {
+		bounds[cx] = make([]image.Rectangle, chunkCountY)
+		for cy := range bounds[cx] {
+			bounds[cx][cy] = ChunkBound(width, height, chunkCountX, chunkCountY, cx, cy)
 		}
 	}
 
 	return bounds
 }
 
+// ChunkBound returns the bounds of the chunk at position cx, cy in the grid of chunkCountX x chunkCountY chunks
+// of an image with the given width and height. Since the chunks may not divide the side lengths perfectly the
+// remainders are distributed to the first chunks along each axis.
+func ChunkBound(width, height, chunkCountX, chunkCountY, cx, cy int) image.Rectangle {
+	x0, x1 := chunkSpan(width, chunkCountX, cx)
+	y0, y1 := chunkSpan(height, chunkCountY, cy)
+	return image.Rect(x0, y0, x1, y1)
+}
+
+// chunkSpan returns the start and end of the i-th of count chunks along a side with the given length.
+func chunkSpan(length, count, i int) (int, int) {
+
+	// guaranteed side length of each chunk
+	size := length / count
+
+	// Add clippings (the side length to chunk count ratio will likely be rational so we add the remainder to the
+	// side lengths equally.
+	clippings := length % count
+
+	if i < clippings {
+		return i * (size + 1), (i + 1) * (size + 1)
+	}
+
+	start := clippings + i*size
+	return start, start + size
+}
+
 // chunkDist calculates the chunk distribution along the width and height.
 // The aim is to get an evenly distributed field of chunks.
 func chunkDist(count int) (int, int) {
@@ -1,23 +1,34 @@
 package chunk
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"image"
 	"image/draw"
 	_ "image/jpeg"
-	"image/png"
 	_ "image/png"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
-// OpenImageFile opens the file at the given path and returns the decoded *image.RGBA
-func OpenImageFile(filename string) (*image.RGBA, error) {
+// OpenImageFile opens the file at the given path and returns the decoded image in its original bit depth.
+// PNG, JPEG, TIFF, BMP and WebP files are supported. Only the first page of a multi-page TIFF file is
+// returned (see OpenImagePages).
+func OpenImageFile(filename string) (image.Image, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	img, _, err := image.Decode(file)
+	img, format, err := image.Decode(file)
 	if err != nil {
 		return nil, err
 	}
@@ -27,18 +38,64 @@ func OpenImageFile(filename string) (*image.RGBA, error) {
 		return nil, err
 	}
 
-	return ImageToRGBA(img), nil
+	if format == FormatBMP.String() {
+		img = grayBMP(img)
+	}
+
+	return img, nil
+}
+
+// OpenImagePages opens the file at the given path and returns all decoded images (pages) it holds along
+// with the name of its format as reported by image.Decode, e.g. "jpeg" or "tiff". Only TIFF files can
+// hold more than one page.
+func OpenImagePages(filename string) ([]image.Image, string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if format == FormatTIFF.String() {
+		pages, err := DecodeTIFF(data)
+		return pages, format, err
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if format == FormatBMP.String() {
+		img = grayBMP(img)
+	}
+
+	return []image.Image{img}, format, nil
 }
 
-// SaveImageFile saves the given image data to the given filepath as a PNG image.
-func SaveImageFile(filepath string, img image.Image) error {
+// SaveImageFile saves the given image data to the given filepath in the format its extension denotes
+// (see FormatOf) or as a PNG image if the extension denotes no format. Images with 16 bits per color
+// sample are saved with a bit depth of 16 if the format supports it. The given PNG chunks are embedded
+// into the file as well, which requires the PNG format. Extensions of lossy formats like .jpg are refused
+// with ErrLossyFormat.
+func SaveImageFile(filepath string, img image.Image, chunks ...PNGChunk) error {
+	format, ok := FormatOf(filepath)
+	if ext := strings.ToLower(strings.TrimPrefix(path.Ext(filepath), ".")); lossyFormats[ext] {
+		return lossyFormatError(ext)
+	} else if !ok {
+		format = FormatPNG
+	}
+
 	file, err := os.Create(filepath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	err = png.Encode(file, img)
+	err = EncodeImage(file, format, img, chunks...)
 	if err != nil {
 		return err
 	}
@@ -46,6 +103,63 @@ func SaveImageFile(filepath string, img image.Image) error {
 	return nil
 }
 
+// SaveImagePages saves the given images as the pages of a single image file to the given filepath like
+// SaveImageFile does. Only TIFF files can hold more than one page.
+func SaveImagePages(filepath string, pages []image.Image) error {
+	if len(pages) == 1 {
+		return SaveImageFile(filepath, pages[0])
+	}
+
+	if format, _ := FormatOf(filepath); format != FormatTIFF {
+		return fmt.Errorf("%d pages can only be saved in a tiff file", len(pages))
+	}
+
+	file, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return EncodeTIFF(file, pages...)
+}
+
+// EncodeImage writes the given image in the given format to w. It refuses formats that don't store the
+// image losslessly (see Format.Supports). The given PNG chunks are embedded with the PNG format only.
+func EncodeImage(w io.Writer, format Format, img image.Image, chunks ...PNGChunk) error {
+	if len(chunks) > 0 && format != FormatPNG {
+		return fmt.Errorf("png chunks can't be embedded into a %s file", format)
+	}
+
+	if !format.Supports(img) {
+		return fmt.Errorf("%s files can't store %T images losslessly", format, img)
+	}
+
+	switch format {
+	case FormatPNG:
+		return EncodePNG(w, img, chunks...)
+	case FormatTIFF:
+		return EncodeTIFF(w, img)
+	case FormatBMP:
+		return EncodeBMP(w, img)
+	case FormatWebP:
+		return EncodeWebP(w, img.(*image.NRGBA))
+	}
+
+	return fmt.Errorf("unknown format %d", uint8(format))
+}
+
+// OpenPNGChunk opens the PNG file at the given path and returns the data of the first chunk with the given type,
+// which may be at most maxLength bytes long (see ReadPNGChunk).
+func OpenPNGChunk(filepath string, typ string, maxLength int64) ([]byte, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadPNGChunk(bufio.NewReader(file), typ, maxLength)
+}
+
 // SetExtension sets the file extension to nexExt and removes the old one
 func SetExtension(filename string, newExt string) string {
 	ext := path.Ext(filename)
@@ -54,8 +168,69 @@ func SetExtension(filename string, newExt string) string {
 
 // ImageToRGBA converts an image.Image to an *image.RGBA
 func ImageToRGBA(src image.Image) *image.RGBA {
+	return convertImage(src, func(r image.Rectangle) draw.Image { return image.NewRGBA(r) }).(*image.RGBA)
+}
+
+// ImageToNRGBA converts an image.Image to an *image.NRGBA. The pixels of an *image.NRGBA
+// source are copied verbatim, so that their least significant bits stay untouched.
+func ImageToNRGBA(src image.Image) *image.NRGBA {
+	return convertImage(src, func(r image.Rectangle) draw.Image { return image.NewNRGBA(r) }).(*image.NRGBA)
+}
+
+// ImageToNRGBA64 converts an image.Image to an *image.NRGBA64. The pixels of an *image.NRGBA64
+// source are copied verbatim, so that their least significant bits stay untouched.
+func ImageToNRGBA64(src image.Image) *image.NRGBA64 {
+	return convertImage(src, func(r image.Rectangle) draw.Image { return image.NewNRGBA64(r) }).(*image.NRGBA64)
+}
+
+// ImageToGray converts an image.Image to an *image.Gray. The pixels of an *image.Gray
+// source are copied verbatim, so that their least significant bits stay untouched.
+func ImageToGray(src image.Image) *image.Gray {
+	return convertImage(src, func(r image.Rectangle) draw.Image { return image.NewGray(r) }).(*image.Gray)
+}
+
+// ImageToGray16 converts an image.Image to an *image.Gray16. The pixels of an *image.Gray16
+// source are copied verbatim, so that their least significant bits stay untouched.
+func ImageToGray16(src image.Image) *image.Gray16 {
+	return convertImage(src, func(r image.Rectangle) draw.Image { return image.NewGray16(r) }).(*image.Gray16)
+}
+
+// convertImage draws the given image into the image that newImage allocates with the size of src at the origin.
+// If both images store the same color model in a pixel buffer (see pixBuffer) the pixels are copied verbatim
+// row by row instead, so that no payload bit depends on the color conversions of draw.Draw.
+func convertImage(src image.Image, newImage func(r image.Rectangle) draw.Image) draw.Image {
 	bounds := src.Bounds()
-	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
-	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
-	return rgba
+	dst := newImage(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	srcPix, srcStride, srcOK := pixBuffer(src)
+	dstPix, dstStride, dstOK := pixBuffer(dst)
+	if !srcOK || !dstOK || src.ColorModel() != dst.ColorModel() {
+		draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Src)
+		return dst
+	}
+
+	for y := 0; y < bounds.Dy(); y++ {
+		copy(dstPix[y*dstStride:(y+1)*dstStride], srcPix[y*srcStride:])
+	}
+	return dst
+}
+
+// pixBuffer returns the pixels of the given image starting at the top left pixel of its bounds along with
+// the stride between two pixel rows. It returns false for images that aren't stored in a pixel buffer or
+// whose color model depends on the image, like the palette of an *image.Paletted.
+func pixBuffer(img image.Image) ([]byte, int, bool) {
+	min := img.Bounds().Min
+	switch img := img.(type) {
+	case *image.RGBA:
+		return img.Pix[img.PixOffset(min.X, min.Y):], img.Stride, true
+	case *image.NRGBA:
+		return img.Pix[img.PixOffset(min.X, min.Y):], img.Stride, true
+	case *image.NRGBA64:
+		return img.Pix[img.PixOffset(min.X, min.Y):], img.Stride, true
+	case *image.Gray:
+		return img.Pix[img.PixOffset(min.X, min.Y):], img.Stride, true
+	case *image.Gray16:
+		return img.Pix[img.PixOffset(min.X, min.Y):], img.Stride, true
+	}
+	return nil, 0, false
 }
@@ -0,0 +1,163 @@
+package chunk
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"path"
+	"strings"
+)
+
+// ErrLossyFormat is returned if an image should be saved in a lossy format like JPEG. Lossy compression
+// destroys the least significant bits of an image and with them the Merkle tree information.
+var ErrLossyFormat = errors.New("lossy format")
+
+// Format identifies a lossless image file format that encoded images can be saved in.
+type Format uint8
+
+const (
+	// FormatPNG is the Portable Network Graphics format. It stores every image losslessly.
+	FormatPNG Format = iota + 1
+
+	// FormatTIFF is the Tagged Image File Format, written with lossless Deflate compression.
+	// A TIFF file can hold multiple images (pages).
+	FormatTIFF
+
+	// FormatBMP is the Windows bitmap format. It stores 8 bits per sample and palettes without alpha.
+	FormatBMP
+
+	// FormatWebP is the lossless variant (VP8L) of the WebP format. It stores 8-bit NRGBA images only.
+	FormatWebP
+)
+
+// formatNames maps every format to its textual representation, which is also the name that
+// image.Decode reports for it.
+var formatNames = map[Format]string{
+	FormatPNG:  "png",
+	FormatTIFF: "tiff",
+	FormatBMP:  "bmp",
+	FormatWebP: "webp",
+}
+
+// formatExtensions maps the lower case file extensions to the format they denote.
+var formatExtensions = map[string]Format{
+	".png":  FormatPNG,
+	".tif":  FormatTIFF,
+	".tiff": FormatTIFF,
+	".bmp":  FormatBMP,
+	".webp": FormatWebP,
+}
+
+// lossyFormats holds the names and file extensions (without the dot) of the lossy formats that are refused.
+var lossyFormats = map[string]bool{"jpeg": true, "jpg": true, "jpe": true}
+
+// ParseFormat parses the textual representation of a format like "png" or "tiff". It returns
+// ErrLossyFormat for lossy formats like "jpeg".
+func ParseFormat(s string) (Format, error) {
+	s = strings.ToLower(s)
+	if s == "tif" {
+		return FormatTIFF, nil
+	} else if lossyFormats[s] {
+		return 0, lossyFormatError(s)
+	}
+
+	for f, name := range formatNames {
+		if name == s {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown format %q", s)
+}
+
+// FormatOf returns the format that the extension of the given filename denotes.
+func FormatOf(filename string) (Format, bool) {
+	f, ok := formatExtensions[strings.ToLower(path.Ext(filename))]
+	return f, ok
+}
+
+// lossyFormatError returns ErrLossyFormat along with an explanation for the lossy format with the given name.
+func lossyFormatError(name string) error {
+	return fmt.Errorf("%w: %s compression destroys the Merkle tree information in the least significant bits of an encoded image, use a lossless format like png instead", ErrLossyFormat, name)
+}
+
+// Valid reports whether f is a supported format.
+func (f Format) Valid() bool {
+	_, ok := formatNames[f]
+	return ok
+}
+
+// String returns the textual representation of the format, e.g. "webp".
+func (f Format) String() string {
+	if name, ok := formatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(f))
+}
+
+// Extension returns the file extension of the format including the leading dot, e.g. ".tiff".
+func (f Format) Extension() string {
+	return "." + f.String()
+}
+
+// Supports reports whether the format stores the pixels of the given image verbatim, so that no
+// least significant bit is lost. TIFF and BMP files can't store transparent palette entries,
+// BMP files can't store 16 bits per sample and WebP files only store non-premultiplied colors.
+func (f Format) Supports(img image.Image) bool {
+	switch f {
+	case FormatPNG:
+		return true
+	case FormatTIFF:
+		switch img := img.(type) {
+		case *image.Gray, *image.Gray16, *image.NRGBA, *image.NRGBA64, *image.RGBA, *image.RGBA64:
+			return true
+		case *image.Paletted:
+			return opaquePalette(img.Palette)
+		}
+	case FormatBMP:
+		switch img := img.(type) {
+		case *image.Gray, *image.NRGBA:
+			return true
+		case *image.RGBA:
+			return img.Opaque()
+		case *image.Paletted:
+			return opaquePalette(img.Palette)
+		}
+	case FormatWebP:
+		_, ok := img.(*image.NRGBA)
+		return ok
+	}
+	return false
+}
+
+// Convert returns the given image if the format supports it (see Supports) and a copy in a color model
+// that the format supports otherwise. The copy keeps grayscale images gray where possible and reduces
+// 16-bit images to 8 bits for formats that don't store 16 bits per sample.
+func (f Format) Convert(img image.Image) image.Image {
+	if f.Supports(img) {
+		return img
+	}
+
+	switch img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		if gray := ImageToGray(img); f.Supports(gray) {
+			return gray
+		}
+	case color.RGBA64Model, color.NRGBA64Model:
+		if nrgba := ImageToNRGBA64(img); f.Supports(nrgba) {
+			return nrgba
+		}
+	}
+
+	return ImageToNRGBA(img)
+}
+
+// opaquePalette reports whether every color of the given palette is fully opaque.
+func opaquePalette(palette color.Palette) bool {
+	for _, c := range palette {
+		if _, _, _, a := c.RGBA(); a != 0xffff {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,168 @@
+package chunk
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+	"lukechampine.com/blake3"
+)
+
+// HashAlgorithm identifies the hash function that is used for the chunk hashes (Merkle leaves)
+// and the Merkle nodes. All supported algorithms produce digests of HashBitLength bits.
+type HashAlgorithm uint8
+
+const (
+	// SHA256 is SHA-256 as defined in FIPS 180-4.
+	SHA256 HashAlgorithm = iota + 1
+
+	// SHA512_256 is SHA-512/256 as defined in FIPS 180-4.
+	SHA512_256
+
+	// SHA3_256 is SHA3-256 as defined in FIPS 202.
+	SHA3_256
+
+	// BLAKE2b256 is BLAKE2b with a 256 bit digest as defined in RFC 7693.
+	BLAKE2b256
+
+	// BLAKE3 is BLAKE3 with a 256 bit digest.
+	BLAKE3
+
+	// DefaultHashAlgorithm is the hash algorithm that is used if no algorithm is configured.
+	DefaultHashAlgorithm = SHA256
+)
+
+// hashNames maps every hash algorithm to its textual representation.
+var hashNames = map[HashAlgorithm]string{
+	SHA256:     "sha256",
+	SHA512_256: "sha512/256",
+	SHA3_256:   "sha3-256",
+	BLAKE2b256: "blake2b-256",
+	BLAKE3:     "blake3",
+}
+
+// ParseHashAlgorithm parses the textual representation of a hash algorithm like "sha256" or "blake3".
+func ParseHashAlgorithm(s string) (HashAlgorithm, error) {
+	for a, name := range hashNames {
+		if name == s {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hash algorithm %q", s)
+}
+
+// Valid reports whether a is a supported hash algorithm.
+func (a HashAlgorithm) Valid() bool {
+	_, ok := hashNames[a]
+	return ok
+}
+
+// String returns the textual representation of the hash algorithm, e.g. "sha3-256".
+func (a HashAlgorithm) String() string {
+	if name, ok := hashNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(a))
+}
+
+// MarshalText encodes the hash algorithm as its textual representation.
+func (a HashAlgorithm) MarshalText() ([]byte, error) {
+	if !a.Valid() {
+		return nil, fmt.Errorf("unknown hash algorithm %d", uint8(a))
+	}
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText decodes the hash algorithm from its textual representation.
+func (a *HashAlgorithm) UnmarshalText(text []byte) error {
+	parsed, err := ParseHashAlgorithm(string(text))
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// New returns a new hash.Hash computing the full digest of the hash algorithm.
+// It panics if the algorithm is not Valid.
+func (a HashAlgorithm) New() hash.Hash {
+	switch a {
+	case SHA256:
+		return sha256.New()
+	case SHA512_256:
+		return sha512.New512_256()
+	case SHA3_256:
+		return sha3.New256()
+	case BLAKE2b256:
+		// The error is only non-nil for keys longer than 64 bytes
+		h, _ := blake2b.New256(nil)
+		return h
+	case BLAKE3:
+		return blake3.New(HashBitLength/BitsPerByte, nil)
+	default:
+		panic(fmt.Sprintf("unknown hash algorithm %d", uint8(a)))
+	}
+}
+
+// NewKeyed returns a new hash.Hash computing a message authentication code of the hash algorithm with the
+// given secret key. BLAKE2b256 is used in its native keyed mode, all other algorithms as HMAC (RFC 2104).
+// Just like HMAC does, keys that are longer than the maximum BLAKE2b key size are hashed first.
+// If key is empty an unkeyed hash.Hash is returned (see New).
+func (a HashAlgorithm) NewKeyed(key []byte) hash.Hash {
+	if len(key) == 0 {
+		return a.New()
+	}
+
+	if a != BLAKE2b256 {
+		return hmac.New(a.New, key)
+	}
+
+	if len(key) > blake2b.Size {
+		hashed := blake2b.Sum512(key)
+		key = hashed[:]
+	}
+
+	// The error is only non-nil for keys longer than 64 bytes
+	h, _ := blake2b.New256(key)
+	return h
+}
+
+// Truncated returns a function that creates hashes of the algorithm whose digests are truncated to
+// the given number of bits, which must be a multiple of BitsPerByte. Truncated hashes are weaker but
+// need less space in the least significant bits of a chunk. If bits is 0 the digest isn't truncated.
+// The returned function can be used as the hash strategy of a Merkle tree.
+func (a HashAlgorithm) Truncated(bits int) func() hash.Hash {
+	return a.KeyedTruncated(nil, bits)
+}
+
+// KeyedTruncated is like Truncated but creates message authentication codes with the given
+// secret key (see NewKeyed). If key is empty it is equivalent to Truncated.
+func (a HashAlgorithm) KeyedTruncated(key []byte, bits int) func() hash.Hash {
+	return func() hash.Hash {
+		h := a.NewKeyed(key)
+		if bits == 0 || bits >= h.Size()*BitsPerByte {
+			return h
+		}
+		return &truncatedHash{Hash: h, size: bits / BitsPerByte}
+	}
+}
+
+// truncatedHash is a hash.Hash whose digest is cut off after size bytes.
+type truncatedHash struct {
+	hash.Hash
+	size int
+}
+
+// Sum appends the truncated digest of the data written so far to b.
+func (t *truncatedHash) Sum(b []byte) []byte {
+	return append(b, t.Hash.Sum(nil)[:t.size]...)
+}
+
+// Size returns the number of bytes of the truncated digest.
+func (t *truncatedHash) Size() int {
+	return t.size
+}
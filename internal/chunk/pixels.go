@@ -0,0 +1,299 @@
+package chunk
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Pixels is a buffer of non-premultiplied pixels in the native bit depth and color model of an image. The
+// payload of a chunk is embedded into the low bits of its samples, so images with 16 bits per sample are
+// hashed and embedded without losing precision. As there are at most MaxPlanes payload bits per sample they
+// always lie within the least significant byte of a sample. Grayscale and paletted buffers have a single
+// sample per pixel, the gray value or the palette index, which is addressed as the red channel.
+type Pixels interface {
+	draw.Image
+
+	// Pixel returns the bytes of the pixel at x, y: the samples of its channels (see PixelChannels) in
+	// the order red, green, blue and alpha, each consisting of SampleSize bytes in big-endian order.
+	// Changes to the bytes alter the pixel.
+	Pixel(x, y int) []byte
+
+	// SampleSize returns the number of bytes of every sample.
+	SampleSize() int
+
+	// PixelChannels returns the channels every pixel consists of: AllChannels for color buffers and
+	// ChannelR for grayscale and paletted buffers.
+	PixelChannels() Channels
+
+	// AppendColor appends the color that the given bytes of a pixel refer to to buf and returns the
+	// extended buffer. Only paletted buffers append the color of the palette entry, as the bytes of
+	// the pixels of all other buffers are color samples already.
+	AppendColor(buf []byte, pixel []byte) []byte
+
+	// Crop returns a copy of the given region of the buffer whose bounds start at the origin.
+	Crop(r image.Rectangle) Pixels
+
+	// Image returns the underlying image.
+	Image() draw.Image
+}
+
+// NRGBA is a Pixels buffer with 8 bits per color sample.
+type NRGBA struct {
+	*image.NRGBA
+}
+
+// Pixel returns the four bytes of the pixel at x, y.
+func (p NRGBA) Pixel(x, y int) []byte {
+	i := p.PixOffset(x, y)
+	return p.Pix[i : i+4]
+}
+
+// SampleSize returns 1 as every color sample occupies a single byte.
+func (p NRGBA) SampleSize() int {
+	return 1
+}
+
+// PixelChannels returns AllChannels.
+func (p NRGBA) PixelChannels() Channels {
+	return AllChannels
+}
+
+// AppendColor returns buf unchanged as the pixel bytes are color samples already.
+func (p NRGBA) AppendColor(buf []byte, pixel []byte) []byte {
+	return buf
+}
+
+// Crop returns a copy of the given region of the buffer whose bounds start at the origin.
+func (p NRGBA) Crop(r image.Rectangle) Pixels {
+	return NRGBA{ImageToNRGBA(p.SubImage(r))}
+}
+
+// Image returns the underlying *image.NRGBA.
+func (p NRGBA) Image() draw.Image {
+	return p.NRGBA
+}
+
+// NRGBA64 is a Pixels buffer with 16 bits per color sample.
+type NRGBA64 struct {
+	*image.NRGBA64
+}
+
+// Pixel returns the eight bytes of the pixel at x, y.
+func (p NRGBA64) Pixel(x, y int) []byte {
+	i := p.PixOffset(x, y)
+	return p.Pix[i : i+8]
+}
+
+// SampleSize returns 2 as every color sample occupies two bytes.
+func (p NRGBA64) SampleSize() int {
+	return 2
+}
+
+// PixelChannels returns AllChannels.
+func (p NRGBA64) PixelChannels() Channels {
+	return AllChannels
+}
+
+// AppendColor returns buf unchanged as the pixel bytes are color samples already.
+func (p NRGBA64) AppendColor(buf []byte, pixel []byte) []byte {
+	return buf
+}
+
+// Crop returns a copy of the given region of the buffer whose bounds start at the origin.
+func (p NRGBA64) Crop(r image.Rectangle) Pixels {
+	return NRGBA64{ImageToNRGBA64(p.SubImage(r))}
+}
+
+// Image returns the underlying *image.NRGBA64.
+func (p NRGBA64) Image() draw.Image {
+	return p.NRGBA64
+}
+
+// Gray is a Pixels buffer with a single 8-bit gray sample per pixel.
+type Gray struct {
+	*image.Gray
+}
+
+// Pixel returns the byte of the pixel at x, y.
+func (p Gray) Pixel(x, y int) []byte {
+	i := p.PixOffset(x, y)
+	return p.Pix[i : i+1]
+}
+
+// SampleSize returns 1 as the gray sample occupies a single byte.
+func (p Gray) SampleSize() int {
+	return 1
+}
+
+// PixelChannels returns ChannelR, which addresses the gray sample.
+func (p Gray) PixelChannels() Channels {
+	return ChannelR
+}
+
+// AppendColor returns buf unchanged as the pixel bytes are color samples already.
+func (p Gray) AppendColor(buf []byte, pixel []byte) []byte {
+	return buf
+}
+
+// Crop returns a copy of the given region of the buffer whose bounds start at the origin.
+func (p Gray) Crop(r image.Rectangle) Pixels {
+	return Gray{ImageToGray(p.SubImage(r))}
+}
+
+// Image returns the underlying *image.Gray.
+func (p Gray) Image() draw.Image {
+	return p.Gray
+}
+
+// Gray16 is a Pixels buffer with a single 16-bit gray sample per pixel.
+type Gray16 struct {
+	*image.Gray16
+}
+
+// Pixel returns the two bytes of the pixel at x, y.
+func (p Gray16) Pixel(x, y int) []byte {
+	i := p.PixOffset(x, y)
+	return p.Pix[i : i+2]
+}
+
+// SampleSize returns 2 as the gray sample occupies two bytes.
+func (p Gray16) SampleSize() int {
+	return 2
+}
+
+// PixelChannels returns ChannelR, which addresses the gray sample.
+func (p Gray16) PixelChannels() Channels {
+	return ChannelR
+}
+
+// AppendColor returns buf unchanged as the pixel bytes are color samples already.
+func (p Gray16) AppendColor(buf []byte, pixel []byte) []byte {
+	return buf
+}
+
+// Crop returns a copy of the given region of the buffer whose bounds start at the origin.
+func (p Gray16) Crop(r image.Rectangle) Pixels {
+	return Gray16{ImageToGray16(p.SubImage(r))}
+}
+
+// Image returns the underlying *image.Gray16.
+func (p Gray16) Image() draw.Image {
+	return p.Gray16
+}
+
+// Paletted is a Pixels buffer with a single 8-bit palette index per pixel. Payload is embedded into the
+// low bits of the palette indexes, which only leaves the colors untouched if the palette holds every
+// color for all values of these bits (see Paired).
+type Paletted struct {
+	*image.Paletted
+}
+
+// Pixel returns the palette index of the pixel at x, y.
+func (p Paletted) Pixel(x, y int) []byte {
+	i := p.PixOffset(x, y)
+	return p.Pix[i : i+1]
+}
+
+// SampleSize returns 1 as the palette index occupies a single byte.
+func (p Paletted) SampleSize() int {
+	return 1
+}
+
+// PixelChannels returns ChannelR, which addresses the palette index.
+func (p Paletted) PixelChannels() Channels {
+	return ChannelR
+}
+
+// AppendColor appends the non-premultiplied red, green, blue and alpha samples of the palette
+// entry that the given palette index refers to, so that changes of the palette alter the hash.
+func (p Paletted) AppendColor(buf []byte, pixel []byte) []byte {
+	c := color.NRGBAModel.Convert(p.Palette[pixel[0]]).(color.NRGBA)
+	return append(buf, c.R, c.G, c.B, c.A)
+}
+
+// Crop returns a copy of the given region of the buffer whose bounds start at the origin.
+// The copy shares the palette of the buffer.
+func (p Paletted) Crop(r image.Rectangle) Pixels {
+	r = r.Intersect(p.Bounds())
+	dst := Paletted{image.NewPaletted(image.Rect(0, 0, r.Dx(), r.Dy()), p.Palette)}
+	Paste(dst, dst.Bounds(), p, r.Min)
+	return dst
+}
+
+// Image returns the underlying *image.Paletted.
+func (p Paletted) Image() draw.Image {
+	return p.Paletted
+}
+
+// Paired returns a copy of the buffer whose palette holds every color of the original palette 2^planes
+// times in a row, so that the given number of low bits of every palette index can carry payload without
+// changing the color of the pixel. It returns false if the paired palette would exceed 256 colors.
+func (p Paletted) Paired(planes int) (Paletted, bool) {
+	n := 1 << uint(planes)
+	if len(p.Palette)*n > 256 {
+		return Paletted{}, false
+	}
+
+	palette := make(color.Palette, 0, len(p.Palette)*n)
+	for _, c := range p.Palette {
+		for i := 0; i < n; i++ {
+			palette = append(palette, c)
+		}
+	}
+
+	paired := p.Crop(p.Bounds()).(Paletted)
+	paired.Palette = palette
+	for i, idx := range paired.Pix {
+		paired.Pix[i] = idx << uint(planes)
+	}
+
+	return paired, true
+}
+
+// Paste copies the pixels of src starting at sp verbatim into the given region of dst, so that no payload
+// bit is lost to color conversions. Both buffers need to be of the same type and paletted buffers need to
+// share their palette.
+func Paste(dst Pixels, r image.Rectangle, src Pixels, sp image.Point) {
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			copy(dst.Pixel(r.Min.X+x, r.Min.Y+y), src.Pixel(sp.X+x, sp.Y+y))
+		}
+	}
+}
+
+// transparent reports whether the given bytes of a pixel of the given buffer are fully transparent, i.e.
+// its alpha sample is 0. Buffers without an alpha channel have no transparent pixels.
+func transparent(p Pixels, pixel []byte) bool {
+	if p.PixelChannels()&ChannelA == 0 {
+		return false
+	}
+
+	// The alpha sample is the last one of a pixel
+	for _, b := range pixel[len(pixel)-p.SampleSize():] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// NewPixels copies the given image into a Pixels buffer whose bounds start at the origin. Grayscale and
+// paletted images keep their color model. Other images with 16 bits per color sample are copied into an
+// NRGBA64 buffer and all remaining images into an NRGBA buffer.
+func NewPixels(img image.Image) Pixels {
+	if p, ok := img.(*image.Paletted); ok {
+		return Paletted{p}.Crop(p.Bounds())
+	}
+
+	switch img.ColorModel() {
+	case color.GrayModel:
+		return Gray{ImageToGray(img)}
+	case color.Gray16Model:
+		return Gray16{ImageToGray16(img)}
+	case color.RGBA64Model, color.NRGBA64Model:
+		return NRGBA64{ImageToNRGBA64(img)}
+	default:
+		return NRGBA{ImageToNRGBA(img)}
+	}
+}
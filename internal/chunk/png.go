@@ -0,0 +1,151 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+)
+
+// pngSignature is the magic byte sequence every PNG file starts with.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// MaxPNGChunkLength is the maximum length of the data of a PNG chunk as defined by the PNG specification.
+const MaxPNGChunkLength = 1<<31 - 1
+
+// ErrPNGChunkNotFound is returned if a PNG stream does not contain the requested chunk
+// or isn't a PNG stream at all.
+var ErrPNGChunkNotFound = errors.New("png chunk not found")
+
+// PNGChunk is a chunk of a PNG file (not to be confused with Chunk which is a region of an image).
+type PNGChunk struct {
+	// Type is the four letter chunk type, e.g. "tEXt".
+	Type string
+
+	// Data is the raw chunk payload.
+	Data []byte
+}
+
+// EncodePNG writes the given image as PNG to w. The given chunks are inserted right before
+// the final IEND chunk. They should be ancillary chunks so that decoders that don't know
+// them can safely ignore them.
+func EncodePNG(w io.Writer, img image.Image, chunks ...PNGChunk) error {
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return err
+	}
+
+	// The IEND chunk is always the last 12 bytes: 4 bytes length (0), 4 bytes type and 4 bytes CRC
+	data := buf.Bytes()
+	iend := len(data) - 12
+
+	if _, err := w.Write(data[:iend]); err != nil {
+		return err
+	}
+
+	for _, c := range chunks {
+		if err := writePNGChunk(w, c); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(data[iend:])
+	return err
+}
+
+// writePNGChunk writes the length, type, data and CRC of the given chunk to w.
+func writePNGChunk(w io.Writer, c PNGChunk) error {
+
+	if len(c.Type) != 4 {
+		return errors.New("png chunk type must consist of four letters")
+	}
+
+	if int64(len(c.Data)) > MaxPNGChunkLength {
+		return errors.New("png chunk data too large")
+	}
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[:4], uint32(len(c.Data)))
+	copy(header[4:], c.Type)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(c.Data)
+
+	footer := make([]byte, 4)
+	binary.BigEndian.PutUint32(footer, crc.Sum32())
+
+	for _, b := range [][]byte{header, c.Data, footer} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadPNGChunk reads the PNG stream r and returns the data of the first chunk with the given type. The data
+// may be at most maxLength bytes long. As the length of a chunk is read from the stream, the data is only
+// buffered as it arrives, so that a crafted length doesn't allocate more memory than the stream holds.
+func ReadPNGChunk(r io.Reader, typ string, maxLength int64) ([]byte, error) {
+
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, signature); err != nil || !bytes.Equal(signature, pngSignature) {
+		return nil, ErrPNGChunkNotFound
+	}
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+		if length > MaxPNGChunkLength {
+			return nil, errors.New("png chunk length exceeds the maximum")
+		}
+
+		if chunkType == typ {
+			if length > maxLength {
+				return nil, fmt.Errorf("png chunk %q of %d bytes exceeds the maximum of %d bytes", typ, length, maxLength)
+			}
+
+			data, err := ioutil.ReadAll(io.LimitReader(r, length))
+			if err != nil {
+				return nil, err
+			} else if int64(len(data)) != length {
+				return nil, io.ErrUnexpectedEOF
+			}
+
+			footer := make([]byte, 4)
+			if _, err := io.ReadFull(r, footer); err != nil {
+				return nil, err
+			}
+
+			crc := crc32.NewIEEE()
+			crc.Write(header[4:])
+			crc.Write(data)
+			if crc.Sum32() != binary.BigEndian.Uint32(footer) {
+				return nil, errors.New("png chunk checksum mismatch")
+			}
+
+			return data, nil
+		}
+
+		if chunkType == "IEND" {
+			return nil, ErrPNGChunkNotFound
+		}
+
+		// Skip the data and CRC of this chunk
+		if _, err := io.CopyN(ioutil.Discard, r, length+4); err != nil {
+			return nil, err
+		}
+	}
+}
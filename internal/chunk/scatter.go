@@ -0,0 +1,64 @@
+package chunk
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// scatterBufferSize is the number of keystream bytes that are generated at once while shuffling.
+const scatterBufferSize = 4096
+
+// permutation returns the position of every LSB after the first SequentialBits LSBs of the chunk.
+// Without a Seed the LSBs are filled sequentially and nil is returned.
+func (c *Chunk) permutation() []int {
+	if len(c.Seed) == 0 {
+		return nil
+	}
+
+	if c.perm == nil {
+		n := c.LSBCount() - c.SequentialBits
+		if n < 0 {
+			n = 0
+		}
+		c.perm = scatter(c.Seed, n)
+	}
+
+	return c.perm
+}
+
+// scatter returns a pseudo-random permutation of the numbers 0 to n-1 that is derived from the given seed.
+// The numbers are shuffled with the Fisher-Yates algorithm whose random numbers are drawn from a ChaCha20
+// keystream keyed with the SHA-256 hash of the seed, so that seeds of any length are supported.
+func scatter(seed []byte, n int) []int {
+	key := sha256.Sum256(seed)
+
+	// The error is only non-nil for keys and nonces of the wrong length
+	stream, _ := chacha20.NewUnauthenticatedCipher(key[:], make([]byte, chacha20.NonceSize))
+
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+
+	buf := make([]byte, scatterBufferSize)
+	off := len(buf)
+	for i := n - 1; i > 0; i-- {
+		if off == len(buf) {
+			for j := range buf {
+				buf[j] = 0
+			}
+			stream.XORKeyStream(buf, buf)
+			off = 0
+		}
+
+		// The modulo bias is negligible as chunks carry far fewer than 2^32 LSBs
+		j := int(binary.BigEndian.Uint32(buf[off:]) % uint32(i+1))
+		off += 4
+
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+
+	return perm
+}
@@ -0,0 +1,102 @@
+package chunk
+
+import (
+	"errors"
+
+	"dennis-tra/image-stego/pkg/bit"
+)
+
+// ErrAuthentication is returned if the encrypted LSBs of a chunk can't be authenticated,
+// because they were manipulated or the key is wrong.
+var ErrAuthentication = errors.New("message authentication failed")
+
+// bitCapacity returns the number of LSBs that can be written to and read from the chunk. If an AEAD is set
+// the authentication tag occupies some of the LSBs after SequentialBits and only whole bytes are encrypted.
+func (c *Chunk) bitCapacity() int {
+	if c.AEAD == nil {
+		return c.LSBCount()
+	}
+	return c.SequentialBits + c.plainLength()*BitsPerByte
+}
+
+// sealedLength returns the number of bytes of the ciphertext including the authentication tag
+// that fit into the LSBs after SequentialBits.
+func (c *Chunk) sealedLength() int {
+	n := (c.LSBCount() - c.SequentialBits) / BitsPerByte
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// plainLength returns the number of bytes of the plaintext that fit into the LSBs after SequentialBits.
+func (c *Chunk) plainLength() int {
+	n := c.sealedLength() - c.AEAD.Overhead()
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// plainBit returns the n-th bit of the plaintext, the first bit being the highest bit of the first byte.
+func (c *Chunk) plainBit(n int) bool {
+	return bit.GetBit(c.plain[n/BitsPerByte], BitsPerByte-1-n%BitsPerByte)
+}
+
+// setPlainBit sets the n-th bit of the plaintext, the first bit being the highest bit of the first byte.
+func (c *Chunk) setPlainBit(n int, b bool) {
+	if c.plain == nil {
+		c.plain = make([]byte, c.plainLength())
+	}
+	c.plain[n/BitsPerByte] = bit.WithBit(c.plain[n/BitsPerByte], BitsPerByte-1-n%BitsPerByte, b)
+}
+
+// Seal encrypts everything that was written after SequentialBits together with zero padding up to the
+// capacity of the chunk and writes the ciphertext to the LSBs. It must be called after the last write.
+func (c *Chunk) Seal() error {
+	if c.AEAD == nil {
+		return errors.New("chunk has no AEAD")
+	}
+
+	if c.plain == nil {
+		c.plain = make([]byte, c.plainLength())
+	}
+
+	sealed := c.AEAD.Seal(nil, c.Nonce, c.plain, c.AdditionalData)
+	for n := 0; n < len(sealed)*BitsPerByte; n++ {
+		c.writeLSB(c.SequentialBits+n, bit.GetBit(sealed[n/BitsPerByte], BitsPerByte-1-n%BitsPerByte))
+	}
+
+	return nil
+}
+
+// Open reads the ciphertext from the LSBs after SequentialBits and decrypts it, so that subsequent reads
+// return the plaintext. It returns ErrAuthentication if the LSBs were manipulated or the key is wrong.
+// Reads after SequentialBits call Open implicitly, so it only needs to be called to check the authenticity
+// before reading.
+func (c *Chunk) Open() error {
+	if c.AEAD == nil {
+		return errors.New("chunk has no AEAD")
+	}
+
+	if c.opened {
+		return nil
+	}
+
+	sealed := make([]byte, c.sealedLength())
+	for n := 0; n < len(sealed)*BitsPerByte; n++ {
+		sealed[n/BitsPerByte] = bit.WithBit(sealed[n/BitsPerByte], BitsPerByte-1-n%BitsPerByte, c.readLSB(c.SequentialBits+n))
+	}
+
+	if len(sealed) < c.AEAD.Overhead() {
+		return ErrAuthentication
+	}
+
+	plain, err := c.AEAD.Open(nil, c.Nonce, sealed, c.AdditionalData)
+	if err != nil {
+		return ErrAuthentication
+	}
+
+	c.plain, c.opened = plain, true
+	return nil
+}
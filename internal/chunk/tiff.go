@@ -0,0 +1,157 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+
+	"golang.org/x/image/tiff"
+)
+
+// tiffStripOffsets is the tag of the IFD entry that holds the file offsets of the pixel data.
+const tiffStripOffsets = 273
+
+// tiffTypeSizes maps the TIFF field types to the size of a single value in bytes.
+var tiffTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// EncodeTIFF writes the given images as the pages of a single TIFF file to w. The pixel data is
+// compressed losslessly with Deflate. It doesn't check whether the format stores the images
+// losslessly (see FormatTIFF.Supports).
+func EncodeTIFF(w io.Writer, pages ...image.Image) error {
+	if len(pages) == 0 {
+		return errors.New("tiff file needs at least one page")
+	}
+
+	// Every page is encoded into a file of its own. All files are concatenated without their headers
+	// and the offsets of their IFDs are relocated, so that every IFD links to the IFD of the next page.
+	// This relies on the layout that golang.org/x/image/tiff writes: a little-endian header, the pixel
+	// data in a single strip, a single IFD and the values that don't fit into its entries, in this order.
+	var file []byte
+	var next uint32 // offset of the next IFD offset of the last page
+	for i, page := range pages {
+		buf := &bytes.Buffer{}
+		if err := tiff.Encode(buf, page, &tiff.Options{Compression: tiff.Deflate, Predictor: true}); err != nil {
+			return err
+		}
+		data := buf.Bytes()
+
+		ifd, end, err := tiffIFD(data)
+		if err != nil {
+			return err
+		}
+
+		// The IFD directly follows the pixel data, but TIFF requires it to begin on a word boundary
+		if ifd%2 != 0 {
+			padded := make([]byte, 0, len(data)+1)
+			data = append(append(append(padded, data[:ifd]...), 0), data[ifd:]...)
+			ifd, end = ifd+1, end+1
+			binary.LittleEndian.PutUint32(data[4:8], ifd)
+			relocateTIFF(data, ifd, end, 1, false)
+		}
+
+		if i == 0 {
+			file, next = data, end
+			continue
+		}
+
+		// Pages are appended at a word boundary as well, so that the relocated IFD stays aligned
+		if len(file)%2 != 0 {
+			file = append(file, 0)
+		}
+
+		// Offsets within data are moved from behind its header to the end of the file
+		delta := uint32(len(file)) - 8
+		relocateTIFF(data, ifd, end, delta, true)
+
+		binary.LittleEndian.PutUint32(file[next:], ifd+delta)
+		next = end + delta
+		file = append(file, data[8:]...)
+	}
+
+	_, err := w.Write(file)
+	return err
+}
+
+// tiffIFD returns the offset of the IFD of the TIFF file in data, which golang.org/x/image/tiff wrote,
+// along with the offset of the next IFD offset that follows its entries. It fails unless the file
+// has the layout that EncodeTIFF relies on, i.e. the pixel data is stored in a single strip.
+func tiffIFD(data []byte) (uint32, uint32, error) {
+	if len(data) < 8 || string(data[:2]) != "II" {
+		return 0, 0, errors.New("tiff: expected a little-endian file")
+	}
+
+	ifd := binary.LittleEndian.Uint32(data[4:8])
+	if int64(ifd)+2 > int64(len(data)) {
+		return 0, 0, errors.New("tiff: invalid IFD offset")
+	}
+
+	end := ifd + 2 + uint32(binary.LittleEndian.Uint16(data[ifd:]))*12
+	if int64(end)+4 > int64(len(data)) {
+		return 0, 0, errors.New("tiff: invalid IFD offset")
+	}
+
+	for e := ifd + 2; e < end; e += 12 {
+		if binary.LittleEndian.Uint16(data[e:]) == tiffStripOffsets && binary.LittleEndian.Uint32(data[e+4:]) != 1 {
+			return 0, 0, errors.New("tiff: expected the pixel data in a single strip")
+		}
+	}
+
+	return ifd, end, nil
+}
+
+// relocateTIFF adds delta to the offsets of the values that don't fit into the entries of the IFD between
+// the given offsets of data. With strips the offset of the pixel data (see tiffStripOffsets) is moved as well.
+func relocateTIFF(data []byte, ifd uint32, end uint32, delta uint32, strips bool) {
+	for e := ifd + 2; e < end; e += 12 {
+		tag := binary.LittleEndian.Uint16(data[e:])
+		typ := binary.LittleEndian.Uint16(data[e+2:])
+		n := binary.LittleEndian.Uint32(data[e+4:])
+		if (strips && tag == tiffStripOffsets) || tiffTypeSizes[typ]*n > 4 {
+			binary.LittleEndian.PutUint32(data[e+8:], binary.LittleEndian.Uint32(data[e+8:])+delta)
+		}
+	}
+}
+
+// DecodeTIFF reads all pages of the TIFF file in data. The data is altered while the pages are decoded.
+func DecodeTIFF(data []byte) ([]image.Image, error) {
+	if len(data) < 8 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("tiff: invalid format")
+	}
+
+	// golang.org/x/image/tiff only decodes the first IFD, so the header is pointed to every IFD in turn
+	var pages []image.Image
+	visited := map[uint32]bool{}
+	for ifd := order.Uint32(data[4:8]); ifd != 0; {
+		if visited[ifd] || int64(ifd)+2 > int64(len(data)) {
+			return nil, errors.New("tiff: invalid IFD offset")
+		}
+		visited[ifd] = true
+
+		order.PutUint32(data[4:8], ifd)
+		page, err := tiff.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+
+		next := int64(ifd) + 2 + int64(order.Uint16(data[ifd:]))*12
+		if next+4 > int64(len(data)) {
+			return nil, errors.New("tiff: invalid IFD offset")
+		}
+		ifd = order.Uint32(data[next:])
+	}
+
+	return pages, nil
+}
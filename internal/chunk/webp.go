@@ -0,0 +1,320 @@
+package chunk
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"sort"
+)
+
+const (
+	// webpMaxSize is the maximum width and height of a lossless WebP image.
+	webpMaxSize = 1 << 14
+
+	// webpGreenAlphabet is the number of symbols of the green prefix code without color cache:
+	// 256 literals and 24 backward reference lengths.
+	webpGreenAlphabet = 256 + 24
+
+	// webpDistanceAlphabet is the number of symbols of the backward reference distance prefix code.
+	webpDistanceAlphabet = 40
+
+	// webpMaxCodeLength and webpMaxLengthCodeLength are the maximum code lengths of the prefix codes
+	// of the samples and of the prefix code of their code lengths.
+	webpMaxCodeLength       = 15
+	webpMaxLengthCodeLength = 7
+)
+
+// webpCodeLengthOrder is the order in which the code lengths of the code length prefix code are stored.
+var webpCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// EncodeWebP writes the given image as lossless WebP (VP8L) to w. Only the subtract green transform is
+// applied and every pixel is stored as a literal without backward references, which keeps the encoder
+// simple at the cost of larger files than other encoders write.
+func EncodeWebP(w io.Writer, img *image.NRGBA) error {
+	d := img.Bounds().Size()
+	if d.X < 1 || d.Y < 1 || d.X > webpMaxSize || d.Y > webpMaxSize {
+		return errors.New("webp images must be between 1 and 16384 pixels wide and high")
+	}
+
+	// The green sample is subtracted from the red and blue samples (subtract green transform)
+	pix := make([][4]byte, 0, d.X*d.Y)
+	var histograms [4][]uint32
+	for i := range histograms {
+		histograms[i] = make([]uint32, 256)
+	}
+	for y := 0; y < d.Y; y++ {
+		for x := 0; x < d.X; x++ {
+			s := img.Pix[img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y):]
+			p := [4]byte{s[1], s[0] - s[1], s[2] - s[1], s[3]}
+			for i, v := range p {
+				histograms[i][v]++
+			}
+			pix = append(pix, p)
+		}
+	}
+
+	bw := &webpBitWriter{}
+	bw.write(0x2f, 8) // signature
+	bw.write(uint32(d.X-1), 14)
+	bw.write(uint32(d.Y-1), 14)
+	if img.Opaque() {
+		bw.write(0, 1)
+	} else {
+		bw.write(1, 1)
+	}
+	bw.write(0, 3) // version
+
+	bw.write(1, 1) // transform present
+	bw.write(2, 2) // subtract green
+	bw.write(0, 1) // no further transform
+	bw.write(0, 1) // no color cache
+	bw.write(0, 1) // no meta prefix codes
+
+	// The prefix codes of green, red, blue, alpha and the unused distance
+	greenHistogram := make([]uint32, webpGreenAlphabet)
+	copy(greenHistogram, histograms[0])
+	codes := [4]webpPrefixCode{
+		newWebPPrefixCode(greenHistogram, webpMaxCodeLength),
+		newWebPPrefixCode(histograms[1], webpMaxCodeLength),
+		newWebPPrefixCode(histograms[2], webpMaxCodeLength),
+		newWebPPrefixCode(histograms[3], webpMaxCodeLength),
+	}
+	for _, c := range codes {
+		c.writeTo(bw)
+	}
+	newWebPPrefixCode(make([]uint32, webpDistanceAlphabet), webpMaxCodeLength).writeTo(bw)
+
+	for _, p := range pix {
+		for i, v := range p {
+			codes[i].writeSymbol(bw, int(v))
+		}
+	}
+
+	data := bw.bytes()
+	padding := len(data) % 2
+
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+len(data)+padding))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+
+	for _, b := range [][]byte{header, data, make([]byte, padding)} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// webpBitWriter writes values of up to 32 bits to a byte slice, least significant bit first.
+type webpBitWriter struct {
+	buf  []byte
+	bits uint64
+	n    uint
+}
+
+// write writes the n low bits of v.
+func (bw *webpBitWriter) write(v uint32, n uint) {
+	bw.bits |= uint64(v) << bw.n
+	bw.n += n
+	for bw.n >= 8 {
+		bw.buf = append(bw.buf, byte(bw.bits))
+		bw.bits >>= 8
+		bw.n -= 8
+	}
+}
+
+// bytes returns the written bytes. The last byte is padded with zero bits.
+func (bw *webpBitWriter) bytes() []byte {
+	if bw.n > 0 {
+		return append(bw.buf, byte(bw.bits))
+	}
+	return bw.buf
+}
+
+// webpPrefixCode is a canonical Huffman code of a VP8L alphabet.
+type webpPrefixCode struct {
+	// lengths holds the code length of every symbol, 0 for unused symbols.
+	lengths []uint8
+
+	// codes holds the bit reversed code of every symbol, as codes are read most significant bit first.
+	codes []uint16
+
+	// symbols is the number of used symbols. Codes with up to one symbol occupy no bits at all,
+	// even though a single symbol has a code length of 1.
+	symbols int
+}
+
+// newWebPPrefixCode builds a canonical Huffman code for the given histogram of symbols whose
+// codes are at most maxLength bits long.
+func newWebPPrefixCode(histogram []uint32, maxLength int) webpPrefixCode {
+	c := webpPrefixCode{
+		lengths: make([]uint8, len(histogram)),
+		codes:   make([]uint16, len(histogram)),
+	}
+
+	var used []int
+	for sym, count := range histogram {
+		if count > 0 {
+			used = append(used, sym)
+		}
+	}
+	c.symbols = len(used)
+	if c.symbols == 1 {
+		c.lengths[used[0]] = 1
+	}
+	if c.symbols <= 1 {
+		return c
+	}
+
+	// Rare symbols are made more frequent until the Huffman tree doesn't exceed the maximum length
+	for minCount := uint32(1); ; minCount *= 2 {
+		counts := make([]uint32, len(used))
+		for i, sym := range used {
+			counts[i] = histogram[sym]
+			if counts[i] < minCount {
+				counts[i] = minCount
+			}
+		}
+
+		if depths := huffmanDepths(counts); maxDepth(depths) <= maxLength {
+			for i, sym := range used {
+				c.lengths[sym] = uint8(depths[i])
+			}
+			break
+		}
+	}
+
+	// Canonical codes are assigned in the order of their length and symbol
+	var lengthCounts, next [webpMaxCodeLength + 2]uint16
+	for _, l := range c.lengths {
+		lengthCounts[l]++
+	}
+	lengthCounts[0] = 0
+	for l := 1; l <= webpMaxCodeLength; l++ {
+		next[l+1] = (next[l] + lengthCounts[l]) << 1
+	}
+	for sym, l := range c.lengths {
+		if l == 0 {
+			continue
+		}
+		code := next[l]
+		next[l]++
+		for i := uint8(0); i < l; i++ {
+			c.codes[sym] = c.codes[sym]<<1 | code>>i&1
+		}
+	}
+
+	return c
+}
+
+// huffmanDepths returns the depth of every leaf of a Huffman tree over the given counts.
+func huffmanDepths(counts []uint32) []int {
+	leaves := make([]int, len(counts))
+	for i := range leaves {
+		leaves[i] = i
+	}
+	sort.SliceStable(leaves, func(i, j int) bool { return counts[leaves[i]] < counts[leaves[j]] })
+
+	// The nodes of the tree are the sorted leaves followed by the internal nodes, which are created in
+	// the order of their count. The two smallest nodes are always at the front of either part.
+	nodeCounts := make([]uint32, len(leaves), 2*len(leaves)-1)
+	for i, leaf := range leaves {
+		nodeCounts[i] = counts[leaf]
+	}
+	parents := make([]int, 2*len(leaves)-1)
+	nextLeaf, nextInternal := 0, len(leaves)
+	smallest := func() int {
+		if nextLeaf < len(leaves) && (nextInternal >= len(nodeCounts) || nodeCounts[nextLeaf] <= nodeCounts[nextInternal]) {
+			nextLeaf++
+			return nextLeaf - 1
+		}
+		nextInternal++
+		return nextInternal - 1
+	}
+	for len(nodeCounts) < cap(nodeCounts) {
+		a, b := smallest(), smallest()
+		parents[a], parents[b] = len(nodeCounts), len(nodeCounts)
+		nodeCounts = append(nodeCounts, nodeCounts[a]+nodeCounts[b])
+	}
+
+	// Parents always follow their children, so the depths are resolved from the root down
+	nodeDepths := make([]int, len(nodeCounts))
+	for n := len(nodeCounts) - 2; n >= 0; n-- {
+		nodeDepths[n] = nodeDepths[parents[n]] + 1
+	}
+
+	depths := make([]int, len(counts))
+	for i, leaf := range leaves {
+		depths[leaf] = nodeDepths[i]
+	}
+	return depths
+}
+
+// maxDepth returns the largest of the given depths.
+func maxDepth(depths []int) int {
+	max := 0
+	for _, d := range depths {
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// writeTo writes the code lengths of the prefix code. Codes with up to one symbol are written as a
+// simple code and all others as a normal code whose code lengths are coded with another prefix code.
+func (c webpPrefixCode) writeTo(bw *webpBitWriter) {
+	if c.symbols <= 1 {
+		sym := 0
+		for s, l := range c.lengths {
+			if l > 0 {
+				sym = s
+			}
+		}
+
+		bw.write(1, 1) // simple code
+		bw.write(0, 1) // single symbol
+		if sym < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(sym), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(sym), 8)
+		}
+		return
+	}
+
+	lengthHistogram := make([]uint32, len(webpCodeLengthOrder))
+	for _, l := range c.lengths {
+		lengthHistogram[l]++
+	}
+	lengthCode := newWebPPrefixCode(lengthHistogram, webpMaxLengthCodeLength)
+
+	count := 4
+	for i, l := range webpCodeLengthOrder {
+		if lengthCode.lengths[l] > 0 && i+1 > count {
+			count = i + 1
+		}
+	}
+
+	bw.write(0, 1) // normal code
+	bw.write(uint32(count-4), 4)
+	for _, l := range webpCodeLengthOrder[:count] {
+		bw.write(uint32(lengthCode.lengths[l]), 3)
+	}
+	bw.write(0, 1) // code lengths of all symbols follow
+	for _, l := range c.lengths {
+		lengthCode.writeSymbol(bw, int(l))
+	}
+}
+
+// writeSymbol writes the code of the given symbol.
+func (c webpPrefixCode) writeSymbol(bw *webpBitWriter, sym int) {
+	if c.symbols > 1 {
+		bw.write(uint32(c.codes[sym]), uint(c.lengths[sym]))
+	}
+}
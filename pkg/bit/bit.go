@@ -14,3 +14,35 @@ func WithLSB(b byte, bit bool) byte {
 func GetLSB(b byte) bool {
 	return b%2 != 0
 }
+
+// LowBitsMask returns a byte where the k least significant bits are set to 1.
+func LowBitsMask(k int) byte {
+	return byte(1<<uint(k) - 1)
+}
+
+// WithLowBits returns the given byte with its k least significant bits set to
+// the k least significant bits of v.
+func WithLowBits(b byte, v byte, k int) byte {
+	mask := LowBitsMask(k)
+	return b&^mask | v&mask
+}
+
+// GetLowBits given a byte, will return the value of its k least significant bits.
+func GetLowBits(b byte, k int) byte {
+	return b & LowBitsMask(k)
+}
+
+// WithBit returns the given byte with the n-th least significant bit (starting at 0)
+// set to the given bit value, while true means 1 and false means 0.
+func WithBit(b byte, n int, bit bool) byte {
+	if bit {
+		return b | 1<<uint(n)
+	} else {
+		return b &^ (1 << uint(n))
+	}
+}
+
+// GetBit given a byte, will return the n-th least significant bit (starting at 0) of that byte.
+func GetBit(b byte, n int) bool {
+	return b&(1<<uint(n)) != 0
+}
@@ -45,3 +45,48 @@ func TestWithLSB(t *testing.T) {
 		})
 	}
 }
+
+func TestWithLowBits(t *testing.T) {
+	tests := []struct {
+		byte byte
+		v    byte
+		k    int
+		want byte
+	}{
+		{byte: 0b11111111, v: 0b00000000, k: 1, want: 0b11111110},
+		{byte: 0b11111111, v: 0b00000010, k: 2, want: 0b11111110},
+		{byte: 0b00000000, v: 0b11111111, k: 3, want: 0b00000111},
+		{byte: 0b10101010, v: 0b00000101, k: 4, want: 0b10100101},
+		{byte: 0b10101010, v: 0b11111111, k: 0, want: 0b10101010},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("setting %d low bits of %08b to %08b should be %08b", tt.k, tt.byte, tt.v, tt.want)
+		t.Run(name, func(t *testing.T) {
+			got := WithLowBits(tt.byte, tt.v, tt.k)
+			assert.Equal(t, tt.want, got, "WithLowBits() = %v, want %v", got, tt.want)
+			assert.Equal(t, tt.v&LowBitsMask(tt.k), GetLowBits(got, tt.k))
+		})
+	}
+}
+
+func TestWithBit(t *testing.T) {
+	tests := []struct {
+		byte byte
+		n    int
+		bit  bool
+		want byte
+	}{
+		{byte: 0b00000000, n: 0, bit: true, want: 0b00000001},
+		{byte: 0b00000000, n: 3, bit: true, want: 0b00001000},
+		{byte: 0b11111111, n: 2, bit: false, want: 0b11111011},
+		{byte: 0b11111111, n: 7, bit: true, want: 0b11111111},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("setting bit %d of %08b to %t should be %08b", tt.n, tt.byte, tt.bit, tt.want)
+		t.Run(name, func(t *testing.T) {
+			got := WithBit(tt.byte, tt.n, tt.bit)
+			assert.Equal(t, tt.want, got, "WithBit() = %v, want %v", got, tt.want)
+			assert.Equal(t, tt.bit, GetBit(got, tt.n))
+		})
+	}
+}
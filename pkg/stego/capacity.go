@@ -0,0 +1,181 @@
+package stego
+
+import (
+	"image"
+
+	"dennis-tra/image-stego/internal/chunk"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CapacityReport describes how Encode divides an image into chunks with some EncodeOptions
+// and how many least significant bits of every chunk are left for a message (see Inspect).
+type CapacityReport struct {
+	// Width and Height are the dimensions of the image in pixels.
+	Width  int
+	Height int
+
+	// Cols and Rows are the number of chunks along the width and height of the image.
+	Cols int
+	Rows int
+
+	// MinChunkSize and MaxChunkSize are the smallest and largest width and height of the chunks in pixels.
+	// As the image dimensions are rarely multiples of the grid dimensions chunks differ by up to one pixel.
+	MinChunkSize image.Point
+	MaxChunkSize image.Point
+
+	// MinRegionSize is the size in pixels of the smallest region a modification can be localised to:
+	// the smallest chunk or, with row hashes, a single pixel row of the narrowest chunk.
+	MinRegionSize image.Point
+
+	// Chunks holds the capacity of every chunk in the order of their index.
+	Chunks []ChunkCapacity
+
+	// FreeBytes is the number of bytes that are left in all chunks after the Merkle tree information.
+	FreeBytes int
+
+	// MessageCapacity is the maximum number of bytes of a message that can be hidden in the image
+	// (see EncodeOptions.Message). It is FreeBytes minus the framing of the message.
+	MessageCapacity int
+}
+
+// ChunkCapacity describes how many least significant bits of a single chunk are occupied.
+type ChunkCapacity struct {
+	// Index is the position of the chunk in the chunk grid.
+	Index ChunkIndex
+
+	// Bounds are the pixel bounds of the chunk in the image.
+	Bounds image.Rectangle
+
+	// RequiredBits is the number of LSBs the header, locator, Merkle path and any additional
+	// payload like the signature, the metadata shard, the encryption and the row hashes occupy.
+	// It is 0 in ModeSidecar and ModePNGChunk as nothing is embedded into the image.
+	RequiredBits int
+
+	// AvailableBits is the number of LSBs of the chunk.
+	AvailableBits int
+
+	// SpareBytes is the number of bytes that are left after the RequiredBits. With encryption only whole
+	// bytes are encrypted, so it may be one byte less than the difference suggests.
+	SpareBytes int
+}
+
+// Inspect divides the given image into chunks like Encode does with the given options and reports the chunk
+// grid along with the capacity of every chunk. Nothing is hashed or embedded and no key is derived, so it
+// is cheap compared to Encode. The message of the options is ignored.
+func Inspect(img image.Image, opts EncodeOptions) (*CapacityReport, error) {
+	opts.Message = nil
+
+	l, err := newLayout(img, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CapacityReport{
+		Width:  l.pixels.Bounds().Dx(),
+		Height: l.pixels.Bounds().Dy(),
+		Cols:   l.header.cols,
+		Rows:   l.header.rows,
+	}
+
+	for x, boundsRow := range l.bounds {
+		for y, bound := range boundsRow {
+			cc := ChunkCapacity{
+				Index:         ChunkIndex{x, y},
+				Bounds:        bound,
+				AvailableBits: l.availableBits(bound),
+			}
+
+			if opts.Mode == ModeLSB {
+				cc.RequiredBits = l.requiredBits(bound)
+				cc.SpareBytes = l.spareBytes(cc.RequiredBits, cc.AvailableBits)
+			}
+
+			report.FreeBytes += cc.SpareBytes
+			report.Chunks = append(report.Chunks, cc)
+
+			size := bound.Size()
+			if len(report.Chunks) == 1 {
+				report.MinChunkSize, report.MaxChunkSize = size, size
+				continue
+			}
+
+			if size.X < report.MinChunkSize.X {
+				report.MinChunkSize.X = size.X
+			}
+			if size.Y < report.MinChunkSize.Y {
+				report.MinChunkSize.Y = size.Y
+			}
+			if size.X > report.MaxChunkSize.X {
+				report.MaxChunkSize.X = size.X
+			}
+			if size.Y > report.MaxChunkSize.Y {
+				report.MaxChunkSize.Y = size.Y
+			}
+		}
+	}
+
+	report.MinRegionSize = report.MinChunkSize
+	if l.header.rowHashBits > 0 {
+		report.MinRegionSize.Y = 1
+	}
+
+	if opts.Mode == ModeLSB && report.FreeBytes > messageFrameLength {
+		report.MessageCapacity = report.FreeBytes - messageFrameLength
+	}
+
+	return report, nil
+}
+
+// Capacity returns the maximum number of bytes of a message that can be hidden in the given image
+// with the given options (see EncodeOptions.Message and Encoded.MessageCapacity).
+func Capacity(img image.Image, opts EncodeOptions) (int, error) {
+	report, err := Inspect(img, opts)
+	if err != nil {
+		return 0, err
+	}
+	return report.MessageCapacity, nil
+}
+
+// availableBits returns the number of LSBs of the chunk with the given bounds. Without skipped
+// transparent pixels it only depends on the size of the chunk.
+func (l *layout) availableBits(bound image.Rectangle) int {
+	if !l.header.skipsTransparent() {
+		return chunk.LSBCount(bound.Dx()*bound.Dy(), l.pixels.PixelChannels(), l.header.channels, l.header.planes)
+	}
+
+	c := &chunk.Chunk{
+		Pixels:          l.pixels.Crop(bound),
+		Channels:        l.header.channels,
+		Planes:          l.header.planes,
+		SequentialBits:  l.header.sequentialBits(),
+		SkipTransparent: true,
+	}
+	return c.LSBCount()
+}
+
+// requiredBits returns the number of LSBs that the Merkle tree information occupies in the chunk with the given bounds.
+func (l *layout) requiredBits(bound image.Rectangle) int {
+	chunkCount := l.header.cols * l.header.rows
+	bits := chunk.HeaderBitLength + chunk.LocatorBitLength + chunk.PathBitLength(chunkCount, l.header.hashBits)
+	bits += l.extraBits(chunkCount)
+	bits += bound.Dy() * l.header.rowHashBits
+	return bits
+}
+
+// spareBytes returns the number of bytes that are left in a chunk with the given number of available LSBs
+// after the given number of required bits. With encryption everything after the sequential bits is encrypted
+// in whole bytes followed by the authentication tag, which is part of the required bits.
+func (l *layout) spareBytes(requiredBits int, availableBits int) int {
+	spare := (availableBits - requiredBits) / chunk.BitsPerByte
+	if l.header.encrypted() {
+		sequential := l.header.sequentialBits()
+		plain := (availableBits-sequential)/chunk.BitsPerByte - chacha20poly1305.Overhead
+		spare = (sequential + plain*chunk.BitsPerByte - requiredBits + chacha20poly1305.Overhead*chunk.BitsPerByte) / chunk.BitsPerByte
+	}
+
+	if spare < 0 {
+		return 0
+	}
+	return spare
+}
@@ -0,0 +1,406 @@
+package stego
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+
+	"dennis-tra/image-stego/internal/chunk"
+)
+
+// ErrNotEncoded is returned if an image doesn't carry a valid chunk header.
+var ErrNotEncoded = errors.New("image is not encoded")
+
+// ErrUnsupportedFormat is returned if an image was encoded by an incompatible version of this package.
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+// ErrKeyRequired is returned if an image was encoded with a secret key but decoded without one.
+var ErrKeyRequired = errors.New("image was encoded with a key")
+
+// ErrProofMismatch is returned if an image is decoded with a proof that doesn't belong to it or whose
+// chunks don't cover the whole image.
+var ErrProofMismatch = errors.New("proof does not match the image")
+
+// DecodeOptions configures how an image is verified.
+type DecodeOptions struct {
+	// Proof holds the Merkle tree information of the image, e.g. loaded from a
+	// sidecar file. If set, the chunk grid and Merkle paths are taken from it
+	// instead of the least significant bits of the image.
+	Proof *Proof
+
+	// ExpectedRoot is the Merkle root that was anchored externally (e.g. in a
+	// timestamp proof). If set, every chunk is judged against this root instead of
+	// the root hash that most chunks agree on. This detects images where the whole
+	// image or more than half of its chunks were re-encoded.
+	ExpectedRoot []byte
+
+	// Key is the secret key the image was encoded with (see EncodeOptions.Key). If set, the chunk
+	// hashes and Merkle nodes are always calculated as message authentication codes with this key.
+	// As nobody without the key can embed Merkle paths that lead to a common root, this detects
+	// images that were encoded again without the key (or with another one) after tampering.
+	Key []byte
+
+	// TrustedKeys are the public keys whose signatures over the Merkle root are trusted. If the image
+	// was signed (see EncodeOptions.Signer) VerificationReport.Signature reports whether one of them
+	// verified the signature. Only the signatures of chunks that lead to the Merkle root are considered.
+	TrustedKeys []TrustedKey
+
+	// EncryptionKey is the encryption key the payload of the image was encrypted with (see
+	// EncodeOptions.EncryptionKey). The cipher and key derivation function are taken from the header.
+	// Chunks whose payload can't be authenticated with this key are reported as tampered.
+	EncryptionKey []byte
+}
+
+// Decode divides the given image into chunks and rebuilds the Merkle root of every
+// chunk from the information embedded in its least significant bits (or opts.Proof).
+// Every chunk is then judged against opts.ExpectedRoot or, if not given, against the root
+// hash recovered from the metadata of the image, the root hash that most chunks agree on
+// (or the root hash of opts.Proof).
+// The given image is not altered. Without opts.Proof, ErrNotEncoded is returned if
+// the image doesn't carry a chunk header and ErrUnsupportedFormat if it was
+// encoded by an incompatible version of this package. ErrKeyRequired is returned if the image
+// was encoded with a key but opts.Key isn't set. ErrEncryptionKeyRequired is returned if the payload
+// is encrypted but opts.EncryptionKey isn't set and ErrDecryption if the payload of no chunk
+// could be authenticated with it.
+//
+// Cropped images are supported without opts.Proof. The chunk grid is then restored from
+// the position every chunk records about itself and only the chunks that survived the
+// crop completely are verified. See VerificationReport.Region.
+func Decode(img image.Image, opts DecodeOptions) (*VerificationReport, error) {
+
+	if opts.Proof != nil {
+		return decodeProof(img, opts)
+	}
+
+	pixels := chunk.NewPixels(img)
+
+	// The chunk grid is taken from the chunk headers, so that it doesn't depend on the chunk
+	// size calculation of the version that encoded the image or the current image size.
+	g, err := locateGrid(pixels)
+	if err != nil {
+		return nil, err
+	}
+
+	if (g.header.keyed() || g.header.scattered()) && len(opts.Key) == 0 {
+		return nil, ErrKeyRequired
+	}
+
+	if g.header.encrypted() && len(opts.EncryptionKey) == 0 {
+		return nil, ErrEncryptionKeyRequired
+	}
+
+	// The region of the encoded image that remains in the (potentially cropped) image
+	region := pixels.Bounds().Add(g.offset)
+
+	// The key is only derived once from the salt that most chunks carry
+	var aead cipher.AEAD
+	salt := g.salt(pixels, region)
+	if g.header.encrypted() {
+		if aead, err = newAEAD(g.header.cipher, g.header.kdf, opts.EncryptionKey, salt); err != nil {
+			return nil, err
+		}
+	}
+	authenticated := 0
+
+	chunks := []ChunkReport{}
+	rowsByChunk := [][]int{}
+	signatures := []*Signature{}
+	shards := map[int][]byte{}
+	fragments := map[int][]byte{}
+	rootCounts := map[string]int{}
+	fullPathCounts := map[string]int{}
+	for x, boundRow := range g.bounds() {
+		for y, bound := range boundRow {
+
+			// Chunks that were cut off by cropping can't be verified
+			if !bound.In(region) {
+				continue
+			}
+			bound = bound.Sub(g.offset)
+
+			c := &chunk.Chunk{
+				Pixels:        pixels.Crop(bound),
+				Channels:      g.header.channels,
+				Planes:        g.header.planes,
+				HashAlgorithm: g.header.hashAlg,
+				HashBits:      g.header.hashBits,
+				Key:           opts.Key,
+			}
+			if g.header.scattered() || g.header.encrypted() || g.header.skipsTransparent() {
+				c.SequentialBits = g.header.sequentialBits()
+				c.SkipTransparent = g.header.skipsTransparent()
+			}
+			if g.header.scattered() {
+				c.Seed = scatterSeed(opts.Key, ChunkIndex{x, y})
+			}
+
+			hash, err := c.CalculateHash()
+			if err != nil {
+				return nil, err
+			}
+
+			// Every chunk carries the same header and its own locator. Manipulated headers
+			// and locators don't need special treatment as the root hash won't match anyway.
+			prefix := make([]byte, (chunk.HeaderBitLength+chunk.LocatorBitLength)/chunk.BitsPerByte)
+			if _, err = c.Read(prefix); err != nil {
+				return nil, err
+			}
+
+			// The header and the locator are authenticated as well. Chunks with
+			// manipulated payloads or salts are reported without a root hash.
+			if g.header.encrypted() {
+				c.AEAD, c.Nonce, c.AdditionalData = aead, chunkNonce(ChunkIndex{x, y}), prefix
+				if chunkSalt, err := readSalt(c); err != nil || !bytes.Equal(chunkSalt, salt) || c.Open() != nil {
+					chunks = append(chunks, ChunkReport{Index: ChunkIndex{x, y}, Bounds: bound})
+					rowsByChunk = append(rowsByChunk, nil)
+					signatures = append(signatures, nil)
+					continue
+				}
+				authenticated++
+			}
+
+			path, err := readPath(c, g.header)
+			if err != nil {
+				return nil, err
+			}
+			rootHash := foldPath(hash, path, g.header.hashAlg.KeyedTruncated(opts.Key, g.header.hashBits))
+
+			// Manipulated signatures just don't verify
+			var signature *Signature
+			if g.header.signed() {
+				signature, _ = readSignature(c)
+			}
+			signatures = append(signatures, signature)
+
+			// Manipulated metadata shards are revealed by their checksum
+			if shard, err := readMetadataShard(c, g.header); err == nil {
+				shards[x*g.header.rows+y] = shard
+			}
+
+			// Row hashes are only evaluated for tampered chunks, which is determined below.
+			// Manipulated row hashes just lead to a less precise localisation.
+			var rows []int
+			if g.header.rowHashBits > 0 {
+				rows, _ = tamperedRows(c, g.header.rowHashBits)
+			}
+			rowsByChunk = append(rowsByChunk, rows)
+
+			if g.header.hasMessage() {
+				fragments[x*g.header.rows+y] = readMessageFragment(c)
+			}
+
+			chunks = append(chunks, ChunkReport{
+				Index:  ChunkIndex{x, y},
+				Bounds: bound,
+				Root:   rootHash,
+			})
+			rootCounts[hex.EncodeToString(rootHash)]++
+
+			// Wiped chunks agree on roots that no Merkle path as deep as the tree leads to
+			if len(path) == chunk.TreeDepth(g.header.cols*g.header.rows) {
+				fullPathCounts[hex.EncodeToString(rootHash)]++
+			}
+		}
+	}
+
+	if g.header.encrypted() && authenticated == 0 && len(chunks) > 0 {
+		return nil, ErrDecryption
+	}
+
+	var report *VerificationReport
+	if opts.ExpectedRoot != nil {
+		report = newVerificationReport(opts.ExpectedRoot, rootExpected, chunks)
+	} else if m := g.recoverMetadata(opts.Key, shards); m != nil && !outvoted(m.root, fullPathCounts) {
+		report = newVerificationReport(m.root, rootRecovered, chunks)
+	} else {
+		merkleRootHash, err := hex.DecodeString(majorityRoot(rootCounts))
+		if err != nil {
+			return nil, err
+		}
+
+		report = newVerificationReport(merkleRootHash, rootMajority, chunks)
+	}
+	report.Original, report.Region = g.original, region
+
+	// The image carries a chunk header, so chunks that don't agree on a root under
+	// the key mean that it was encoded without the key (or with another one).
+	if len(opts.Key) > 0 && len(report.Chunks) >= 2 && report.Verdict == Unverifiable {
+		report.reject()
+	}
+
+	report.setTamperedRows(rowsByChunk)
+
+	if g.header.signed() {
+		report.setSignature(signatures, opts.TrustedKeys)
+	}
+
+	if g.header.hasMessage() {
+		// The message isn't covered by the chunk hashes, so only chunks that lead to the Merkle root contribute to it
+		for _, c := range report.Chunks {
+			if !c.Match {
+				delete(fragments, c.Index.X*g.header.rows+c.Index.Y)
+			}
+		}
+		report.message, report.messageErr = joinMessage(fragments, g.header.cols*g.header.rows)
+	}
+
+	return report, nil
+}
+
+// decodeProof rebuilds the Merkle root of every chunk from the chunk's hash and
+// the Merkle path of opts.Proof.
+func decodeProof(img image.Image, opts DecodeOptions) (*VerificationReport, error) {
+
+	proof := opts.Proof
+	if proof.Version != ProofVersion {
+		return nil, fmt.Errorf("unsupported proof version %d", proof.Version)
+	}
+
+	if proof.Keyed && len(opts.Key) == 0 {
+		return nil, ErrKeyRequired
+	}
+
+	hashAlg, hashBits := proof.HashAlgorithm, proof.HashBits
+	if !hashAlg.Valid() || hashBits < MinHashBits || hashBits > MaxHashBits || hashBits%chunk.BitsPerByte != 0 {
+		return nil, fmt.Errorf("unsupported proof hash %s truncated to %d bits", hashAlg, hashBits)
+	}
+
+	// The embedding configuration of ModeLSB determines which low bits are left out of the chunk hashes
+	if proof.Mode == ModeLSB {
+		if !proof.Channels.Valid() || proof.Planes < 1 || proof.Planes > MaxPlanes || proof.SequentialBits < 0 {
+			return nil, fmt.Errorf("unsupported proof channels %s with %d planes", proof.Channels, proof.Planes)
+		}
+	} else if proof.Channels != 0 || proof.Planes != 0 || proof.SkipTransparent || proof.SequentialBits != 0 {
+		return nil, fmt.Errorf("proof of mode %s must not hold an embedding configuration", proof.Mode)
+	}
+
+	pixels := chunk.NewPixels(img)
+	if pixels.Bounds().Dx() != proof.Width || pixels.Bounds().Dy() != proof.Height {
+		return nil, ErrProofMismatch
+	}
+	if proof.Channels&^pixels.PixelChannels() != 0 {
+		return nil, ErrProofMismatch
+	}
+
+	// A proof that leaves chunks out would report their pixels as intact
+	if err := proof.checkGrid(); err != nil {
+		return nil, err
+	}
+
+	chunks := []ChunkReport{}
+	for _, proofChunk := range proof.Chunks {
+
+		if !proofChunk.Bounds.In(pixels.Bounds()) {
+			return nil, ErrProofMismatch
+		}
+
+		c := &chunk.Chunk{
+			Pixels:          pixels.Crop(proofChunk.Bounds),
+			HashLSB:         proof.Mode.hashLSB(),
+			Channels:        proof.Channels,
+			Planes:          proof.Planes,
+			HashAlgorithm:   hashAlg,
+			HashBits:        hashBits,
+			Key:             opts.Key,
+			SequentialBits:  proof.SequentialBits,
+			SkipTransparent: proof.SkipTransparent,
+		}
+
+		hash, err := c.CalculateHash()
+		if err != nil {
+			return nil, err
+		}
+
+		chunks = append(chunks, ChunkReport{
+			Index:  proofChunk.Index,
+			Bounds: proofChunk.Bounds,
+			Root:   foldPath(hash, proofChunk.Path, hashAlg.KeyedTruncated(opts.Key, hashBits)),
+		})
+	}
+
+	merkleRoot, source := []byte(proof.MerkleRoot), rootMajority
+	if opts.ExpectedRoot != nil {
+		merkleRoot, source = opts.ExpectedRoot, rootExpected
+	}
+
+	report := newVerificationReport(merkleRoot, source, chunks)
+	report.Original = pixels.Bounds()
+	report.Region = pixels.Bounds()
+
+	// The proof carries the Merkle tree information, so
+	// the image can always be judged against its root.
+	if report.Verdict == Unverifiable {
+		report.Verdict = Tampered
+	}
+
+	if proof.Signature != nil {
+		signatures := make([]*Signature, len(chunks))
+		for i := range signatures {
+			signatures[i] = proof.Signature
+		}
+		report.setSignature(signatures, opts.TrustedKeys)
+	}
+
+	return report, nil
+}
+
+// majorityRoot returns the hex encoded root hash that appeared most often in the given root counts. Ties are
+// broken by the smaller root hash, so that the result doesn't depend on the iteration order of the map.
+func majorityRoot(rootCounts map[string]int) string {
+	rootCount := 0
+	merkleRoot := ""
+	for root, count := range rootCounts {
+		if count > rootCount || (count == rootCount && root < merkleRoot) {
+			rootCount = count
+			merkleRoot = root
+		}
+	}
+	return merkleRoot
+}
+
+// outvoted reports whether another root hash appeared more often than the given recovered root hash in the given
+// counts of the roots that chunks with a complete Merkle path lead to. The recovered root isn't trusted then, as
+// the metadata shards may have been spliced in from another image along with the chunks that carry them.
+func outvoted(root []byte, fullPathCounts map[string]int) bool {
+	majority := majorityRoot(fullPathCounts)
+	return fullPathCounts[majority] > fullPathCounts[hex.EncodeToString(root)]
+}
+
+// readPath reads the Merkle path that is embedded in the least significant bits of the given chunk
+// in the format of the given header. EOFs can happen if the number of path nodes is wrong due to image
+// manipulation of that specific chunk. It could be way larger than the maximum chunk payload. In this
+// case only the nodes up to the EOF are returned.
+func readPath(c *chunk.Chunk, h header) ([]ProofNode, error) {
+
+	// The number of nodes is sized to the depth of the Merkle tree
+	pathCount, err := c.ReadBits(uint8(chunk.PathCountBitLength(h.cols * h.rows)))
+	if err != nil {
+		return nil, err
+	}
+
+	path := []ProofNode{}
+	for i := 0; i < int(pathCount); i++ {
+		// The order in which the hashes should be concatenated to calculate the composite hash
+		side, err := c.ReadBool()
+		if err != nil {
+			break
+		}
+
+		// The hash data for the new composite hash
+		data := make([]byte, h.hashBits/chunk.BitsPerByte)
+		if _, err = c.Read(data); err != nil {
+			break
+		}
+
+		node := ProofNode{Hash: data}
+		if side {
+			node.Side = 1
+		}
+		path = append(path, node)
+	}
+
+	return path, nil
+}
@@ -0,0 +1,62 @@
+package stego
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"dennis-tra/image-stego/internal/chunk"
+)
+
+// CheckerImage returns a copy of the given image with a checker pattern drawn
+// on top of it to visualize the given chunk bounds.
+func CheckerImage(img image.Image, bounds [][]image.Rectangle) *image.RGBA {
+
+	checkerImg := chunk.ImageToRGBA(img)
+	for x, boundRow := range bounds {
+		for y, bound := range boundRow {
+
+			var clr color.RGBA
+			if (x%2 == 0 && y%2 == 0) || (x%2 != 0 && y%2 != 0) {
+				clr = color.RGBA{B: 255, A: 255}
+			} else {
+				clr = color.RGBA{R: 255, A: 255}
+			}
+
+			drawOverlay(checkerImg, bound, clr)
+		}
+	}
+
+	return checkerImg
+}
+
+// OverlayImage returns a copy of the given image with all chunks marked red
+// that do not lead to the Merkle root of the given report. The tampered rows
+// within these chunks are marked a second time to stand out.
+func OverlayImage(img image.Image, report *VerificationReport) *image.RGBA {
+
+	overlayImg := chunk.ImageToRGBA(img)
+	for _, c := range report.TamperedChunks() {
+		drawOverlay(overlayImg, c.Bounds, color.RGBA{R: 255, A: 255})
+
+		for _, y := range c.TamperedRows {
+			row := image.Rect(c.Bounds.Min.X, c.Bounds.Min.Y+y, c.Bounds.Max.X, c.Bounds.Min.Y+y+1)
+			drawOverlay(overlayImg, row, color.RGBA{R: 255, A: 255})
+		}
+	}
+
+	return overlayImg
+}
+
+// drawOverlay draws the given color semi-transparently on top of the given region of dst.
+func drawOverlay(dst draw.Image, r image.Rectangle, clr color.Color) {
+	draw.DrawMask(
+		dst,
+		r,
+		&image.Uniform{C: clr},
+		image.Point{},
+		&image.Uniform{C: color.RGBA{R: 255, G: 255, B: 255, A: 80}},
+		image.Point{},
+		draw.Over,
+	)
+}
@@ -0,0 +1,536 @@
+package stego
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+
+	"dennis-tra/image-stego/internal/chunk"
+
+	"github.com/cbergoon/merkletree"
+)
+
+// ErrImageTooSmall is returned if an image can't be divided into at least two chunks.
+var ErrImageTooSmall = errors.New("image is too small to be encoded")
+
+// ErrInvalidOptions is returned if the EncodeOptions are invalid or don't fit together.
+var ErrInvalidOptions = errors.New("invalid encode options")
+
+// ErrScatterWithoutKey is returned if the payload should be scattered without a key.
+var ErrScatterWithoutKey = errors.New("scattering the payload requires a key")
+
+// EncodeOptions configures how an image is encoded.
+type EncodeOptions struct {
+	// Mode determines where the Merkle tree information is stored. Defaults to ModeLSB.
+	Mode Mode
+
+	// Channels are the color channels whose least significant bits carry the Merkle tree
+	// information in ModeLSB. The configuration is recorded in the header of every
+	// chunk, so that Decode picks it up automatically. As Decode needs to read the
+	// header before it knows the channels, the header and the locator are always stored
+	// in the R, G and B channels of the first pixels of every chunk regardless of Channels.
+	// Grayscale and paletted images only have a single channel, the gray value or the
+	// palette index, which counts as the red channel. All other channels are ignored for
+	// them. Defaults to DefaultChannels.
+	Channels Channels
+
+	// RowHashBits enables an additional hash of every pixel row of a chunk in ModeLSB that is
+	// truncated to the given number of bits. This allows localising modifications within a
+	// tampered chunk (see ChunkReport.TamperedRows) at the cost of fewer and larger chunks.
+	// Must be between 0 (disabled) and MaxRowHashBits and 0 in other modes. Defaults to 0.
+	RowHashBits int
+
+	// Planes is the number of low bits of each channel that carry the Merkle tree
+	// information in ModeLSB. More planes allow for smaller chunks and therefore
+	// a finer tamper localisation at the cost of more visible noise. Must be between
+	// 1 and MaxPlanes and is recorded in the header of every chunk. Defaults to 1.
+	Planes int
+
+	// HashAlgorithm is the hash function of the chunk hashes and Merkle nodes. It is recorded
+	// in the header of every chunk and in the Proof, so that Decode picks it up automatically.
+	// Defaults to DefaultHashAlgorithm.
+	HashAlgorithm HashAlgorithm
+
+	// HashBits truncates the chunk hashes and Merkle nodes to the given number of bits. Shorter
+	// hashes need less space in ModeLSB and therefore allow for a finer chunk grid at the cost of
+	// a weaker collision resistance. Must be a multiple of 8 between MinHashBits and MaxHashBits.
+	// Defaults to MaxHashBits, i.e. hashes aren't truncated.
+	HashBits int
+
+	// Key turns the chunk hashes and Merkle nodes into message authentication codes with the
+	// given secret key: HMAC for most hash algorithms and keyed BLAKE2b for BLAKE2b256. Only
+	// holders of the key can produce a valid encoding, so a tampered image can't simply be
+	// encoded again. Decode needs the same key (see DecodeOptions.Key). Defaults to no key.
+	Key []byte
+
+	// Signer signs the Merkle root with an Ed25519 or ECDSA P-256 private key (see ed25519.PrivateKey and
+	// ecdsa.PrivateKey). The signature and an identifier of the public key (see KeyID) are embedded into
+	// every chunk in ModeLSB and are part of the Proof otherwise. Decode reports which of its trusted keys
+	// verified the signature (see DecodeOptions.TrustedKeys). Defaults to no signature.
+	Signer crypto.Signer
+
+	// Scatter spreads the payload of every chunk in ModeLSB across all of its LSBs with a pseudo-random
+	// permutation that is seeded from Key and the chunk index. Without it the payload fills the LSBs
+	// from the top left pixel of every chunk, which makes it trivially locatable. Only the header and
+	// the locator are still written sequentially, so that Decode can find the chunk grid. Requires a Key
+	// and is rejected in other modes.
+	Scatter bool
+
+	// EncryptionKey encrypts the payload of every chunk in ModeLSB with the Cipher, so that the LSBs are
+	// indistinguishable from noise without the key and manipulated payloads are detected. The key of the
+	// Cipher is derived from the encryption key with the KDF and a random salt. Only the header, the
+	// locator and the salt are embedded unencrypted. Decode needs the same encryption key (see
+	// DecodeOptions.EncryptionKey). It is rejected in other modes. Defaults to no encryption.
+	EncryptionKey []byte
+
+	// Cipher is the authenticated cipher that encrypts the payload. Defaults to DefaultCipher.
+	Cipher Cipher
+
+	// KDF derives the key of the Cipher from the EncryptionKey. With KDFNone the encryption key is
+	// used as is and must be EncryptionKeyLength bytes long. Defaults to DefaultKDF.
+	KDF KDF
+
+	// SkipTransparent excludes fully transparent pixels from carrying the Merkle tree information in ModeLSB
+	// and hashes them as transparent black, so that conversions which premultiply alpha and therefore discard
+	// the color of transparent pixels don't invalidate the encoding. Only the first pixels of every chunk,
+	// which hold the header and the locator, carry them even if they are transparent. Chunks whose header
+	// is lost that way still verify, except for an encrypted payload as the header is authenticated. The
+	// alpha channel must not be one of the Channels. Images without an alpha channel are not affected.
+	// It is rejected in other modes. Defaults to false.
+	SkipTransparent bool
+
+	// Message is an arbitrary byte stream that is hidden in the LSBs that are left over by the Merkle
+	// tree information in ModeLSB. It is spread across the chunks in the order of their index and framed
+	// with its length and a checksum. It doesn't affect the chunk grid, so it can be as long as the
+	// Encoded.MessageCapacity of the image without a message (see Capacity), otherwise ErrMessageTooLarge
+	// is returned. The message is not covered by the Merkle root or the signature and its checksum only
+	// reveals accidental corruption, so anyone can replace it without the image being judged as tampered.
+	// Set an EncryptionKey to keep it secret and to authenticate it. Defaults to no message.
+	Message []byte
+}
+
+// Encoded is the result of encoding an image.
+type Encoded struct {
+	// Image is a copy of the original image with the Merkle tree information
+	// embedded into the least significant bits of each chunk. In ModeSidecar
+	// and ModePNGChunk it is an unaltered copy of the original image. It keeps the
+	// color model and bit depth of the original image: grayscale images result in an
+	// *image.Gray or *image.Gray16, paletted images in an *image.Paletted, other images
+	// with 16 bits per color sample in an *image.NRGBA64 and all remaining images in an
+	// *image.NRGBA. Paletted images whose palette is too large to hold every color for
+	// all values of the payload bits (see EncodeOptions.Planes) are encoded in color
+	// and result in an *image.NRGBA in ModeLSB.
+	Image draw.Image
+
+	// MerkleRoot is the root hash of the Merkle tree built from all chunks.
+	// This is the hash that should be persisted externally (e.g. in a blockchain).
+	MerkleRoot []byte
+
+	// Bounds holds the chunk bounds the image was divided into, indexed by [x][y].
+	Bounds [][]image.Rectangle
+
+	// MessageCapacity is the maximum number of bytes of a message that can be hidden in the image with
+	// the same options (see EncodeOptions.Message). It is 0 in ModeSidecar and ModePNGChunk.
+	MessageCapacity int
+
+	// Proof holds all Merkle tree information of the encoded image. In ModeSidecar
+	// and ModePNGChunk it needs to be stored separately or embedded into the image
+	// file (see WritePNG) as it is the only way to verify the image.
+	Proof *Proof
+}
+
+// Encode divides the given image into chunks, builds a Merkle tree from the chunk
+// hashes and, in ModeLSB, embeds the Merkle path of each chunk into its least
+// significant bits. The given image is not altered.
+func Encode(img image.Image, opts EncodeOptions) (*Encoded, error) {
+
+	l, err := newLayout(img, opts)
+	if err != nil {
+		return nil, err
+	}
+	h, pixels, bounds := l.header, l.pixels, l.bounds
+
+	// The key is derived with a new salt for every image, so that the nonces of the chunks are never reused
+	var salt []byte
+	var aead cipher.AEAD
+	if h.encrypted() {
+		if salt, err = newSalt(); err != nil {
+			return nil, err
+		}
+
+		if aead, err = newAEAD(h.cipher, h.kdf, opts.EncryptionKey, salt); err != nil {
+			return nil, err
+		}
+	}
+
+	list := []merkletree.Content{}
+	for _, boundsRow := range bounds {
+		for _, bound := range boundsRow {
+			c := &chunk.Chunk{
+				Pixels:        pixels.Crop(bound),
+				HashLSB:       opts.Mode.hashLSB(),
+				Channels:      h.channels,
+				Planes:        h.planes,
+				HashAlgorithm: h.hashAlg,
+				HashBits:      h.hashBits,
+				Key:           opts.Key,
+			}
+			// Skipped transparent pixels follow the sequentially filled LSBs, which need to be known for hashing
+			if h.scattered() || h.encrypted() || h.skipsTransparent() {
+				c.SequentialBits = h.sequentialBits()
+				c.SkipTransparent = h.skipsTransparent()
+			}
+			list = append(list, c)
+		}
+	}
+
+	// Create a new Merkle Tree from the list of Content
+	tree, err := merkletree.NewTreeWithHashStrategy(list, h.hashAlg.KeyedTruncated(opts.Key, h.hashBits))
+	if err != nil {
+		return nil, err
+	}
+
+	var signature *Signature
+	if opts.Signer != nil {
+		if signature, err = sign(opts.Signer, tree.MerkleRoot()); err != nil {
+			return nil, err
+		}
+	}
+
+	var shards [][]byte
+	if opts.Mode == ModeLSB {
+		m := metadata{
+			version: FormatVersion,
+			cols:    h.cols,
+			rows:    h.rows,
+			width:   pixels.Bounds().Dx(),
+			height:  pixels.Bounds().Dy(),
+			root:    tree.MerkleRoot(),
+		}
+		if shards, err = m.shards(h, opts.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	proof := &Proof{
+		Version:       ProofVersion,
+		Mode:          opts.Mode,
+		Width:         pixels.Bounds().Dx(),
+		Height:        pixels.Bounds().Dy(),
+		HashAlgorithm: h.hashAlg,
+		HashBits:      h.hashBits,
+		Keyed:         len(opts.Key) > 0,
+		Signature:     signature,
+		MerkleRoot:    tree.MerkleRoot(),
+	}
+	if opts.Mode == ModeLSB {
+		c := list[0].(*chunk.Chunk)
+		proof.Channels, proof.Planes = c.Channels, c.Planes
+		proof.SkipTransparent, proof.SequentialBits = c.SkipTransparent, c.SequentialBits
+	}
+
+	var message []byte
+	if opts.Message != nil {
+		message = frameMessage(opts.Message)
+	}
+	capacity := 0
+
+	// Every pixel of the copy is overwritten by the chunks below
+	encodedImg := pixels.Crop(pixels.Bounds())
+	for x, boundsRow := range bounds {
+		for y, bound := range boundsRow {
+
+			c := list[x*len(boundsRow)+y].(*chunk.Chunk)
+
+			hash, err := c.CalculateHash()
+			if err != nil {
+				return nil, err
+			}
+
+			paths, sides, err := tree.GetMerklePath(c)
+			if err != nil {
+				return nil, err
+			}
+
+			proofChunk := ProofChunk{
+				Index:  ChunkIndex{x, y},
+				Bounds: bound,
+				Hash:   hash,
+			}
+			for i, path := range paths {
+				proofChunk.Path = append(proofChunk.Path, ProofNode{
+					Side: uint8(sides[i]),
+					Hash: path,
+				})
+			}
+			proof.Chunks = append(proof.Chunks, proofChunk)
+
+			if opts.Mode == ModeLSB {
+				if err = writeHeader(c, h); err != nil {
+					return nil, err
+				}
+
+				l := locator{index: proofChunk.Index, width: proof.Width, height: proof.Height}
+				if err = writeLocator(c, l); err != nil {
+					return nil, err
+				}
+
+				if h.encrypted() {
+					if err = writeSalt(c, salt); err != nil {
+						return nil, err
+					}
+
+					// The header and the locator are authenticated as well
+					if c.AdditionalData, err = additionalData(h, l); err != nil {
+						return nil, err
+					}
+					c.AEAD, c.Nonce = aead, chunkNonce(proofChunk.Index)
+				}
+
+				if h.scattered() {
+					c.Seed = scatterSeed(opts.Key, proofChunk.Index)
+				}
+
+				if err = writePath(c, proofChunk.Path, h.cols*h.rows); err != nil {
+					return nil, err
+				}
+
+				if signature != nil {
+					if err = writeSignature(c, signature); err != nil {
+						return nil, err
+					}
+				}
+
+				if err = writeMetadataShard(c, shards[(x*len(boundsRow)+y)%len(shards)]); err != nil {
+					return nil, err
+				}
+
+				if h.rowHashBits > 0 {
+					if err = writeRowHashes(c, h.rowHashBits); err != nil {
+						return nil, err
+					}
+				}
+
+				// The rest of the chunk carries the next fragment of the message
+				capacity += c.RemainingPayloadSize()
+				if message, err = writeMessageFragment(c, message); err != nil {
+					return nil, err
+				}
+
+				if h.encrypted() {
+					if err = c.Seal(); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			chunk.Paste(encodedImg, bound, c.Pixels, image.Point{})
+		}
+	}
+
+	capacity -= messageFrameLength
+	if capacity < 0 || opts.Mode != ModeLSB {
+		capacity = 0
+	}
+
+	if len(message) > 0 {
+		return nil, fmt.Errorf("%w: %d bytes exceed the capacity of %d bytes", ErrMessageTooLarge, len(opts.Message), capacity)
+	}
+
+	return &Encoded{
+		Image:           encodedImg.Image(),
+		MerkleRoot:      tree.MerkleRoot(),
+		Bounds:          bounds,
+		MessageCapacity: capacity,
+		Proof:           proof,
+	}, nil
+}
+
+// layout is the chunk grid and the chunk header of an image that is encoded with some EncodeOptions.
+type layout struct {
+	// header is the header every chunk carries in ModeLSB.
+	header header
+
+	// pixels is a copy of the image that is encoded.
+	pixels chunk.Pixels
+
+	// bounds holds the chunk bounds the image is divided into, indexed by [x][y].
+	bounds [][]image.Rectangle
+
+	// extraBits returns the number of bits every chunk carries besides its header, locator and Merkle path.
+	extraBits func(chunkCount int) int
+}
+
+// newLayout validates the given options and divides the given image into as many chunks
+// as can carry the Merkle tree information with these options.
+func newLayout(img image.Image, opts EncodeOptions) (*layout, error) {
+
+	channels := opts.Channels
+	if channels == 0 {
+		channels = DefaultChannels
+	} else if !channels.Valid() {
+		return nil, fmt.Errorf("%w: channels %08b", ErrInvalidOptions, channels)
+	}
+
+	planes := opts.Planes
+	if planes == 0 {
+		planes = 1
+	} else if planes < 0 || planes > MaxPlanes {
+		return nil, fmt.Errorf("%w: number of planes %d", ErrInvalidOptions, planes)
+	}
+
+	rowHashBits := opts.RowHashBits
+	if rowHashBits < 0 || rowHashBits > MaxRowHashBits {
+		return nil, fmt.Errorf("%w: number of row hash bits %d", ErrInvalidOptions, rowHashBits)
+	} else if rowHashBits > 0 && opts.Mode != ModeLSB {
+		return nil, fmt.Errorf("%w: row hashes can only be embedded in mode %s", ErrInvalidOptions, ModeLSB)
+	}
+
+	hashAlg := opts.HashAlgorithm
+	if hashAlg == 0 {
+		hashAlg = DefaultHashAlgorithm
+	} else if !hashAlg.Valid() {
+		return nil, fmt.Errorf("%w: hash algorithm %d", ErrInvalidOptions, hashAlg)
+	}
+
+	hashBits := opts.HashBits
+	if hashBits == 0 {
+		hashBits = MaxHashBits
+	} else if hashBits < MinHashBits || hashBits > MaxHashBits || hashBits%chunk.BitsPerByte != 0 {
+		return nil, fmt.Errorf("%w: number of hash bits %d", ErrInvalidOptions, hashBits)
+	}
+
+	scatter := opts.Scatter
+	if scatter && opts.Mode != ModeLSB {
+		return nil, fmt.Errorf("%w: the payload can only be scattered in mode %s", ErrInvalidOptions, ModeLSB)
+	} else if scatter && len(opts.Key) == 0 {
+		return nil, ErrScatterWithoutKey
+	}
+
+	skipTransparent := opts.SkipTransparent
+	if skipTransparent && opts.Mode != ModeLSB {
+		return nil, fmt.Errorf("%w: transparent pixels can only be skipped in mode %s", ErrInvalidOptions, ModeLSB)
+	} else if skipTransparent && channels&ChannelA != 0 {
+		return nil, fmt.Errorf("%w: transparent pixels can't be skipped if the alpha channel carries payload", ErrInvalidOptions)
+	}
+
+	if opts.Message != nil && opts.Mode != ModeLSB {
+		return nil, fmt.Errorf("%w: messages can only be hidden in mode %s", ErrInvalidOptions, ModeLSB)
+	}
+
+	encrypt := len(opts.EncryptionKey) > 0
+	if encrypt && opts.Mode != ModeLSB {
+		return nil, fmt.Errorf("%w: the payload can only be encrypted in mode %s", ErrInvalidOptions, ModeLSB)
+	}
+
+	cipherID := opts.Cipher
+	if cipherID == 0 {
+		cipherID = DefaultCipher
+	} else if !cipherID.Valid() {
+		return nil, fmt.Errorf("%w: cipher %d", ErrInvalidOptions, cipherID)
+	}
+
+	kdf := opts.KDF
+	if kdf == 0 {
+		kdf = DefaultKDF
+	} else if !kdf.Valid() {
+		return nil, fmt.Errorf("%w: key derivation function %d", ErrInvalidOptions, kdf)
+	}
+
+	// Besides the Merkle path every chunk carries a shard of the metadata and optionally the signature
+	// and the salt and authentication tag of the encryption
+	extraBits := func(chunkCount int) int {
+		if opts.Mode != ModeLSB {
+			return 0
+		}
+
+		bits := metadataShardLength(chunkCount, hashBits) * chunk.BitsPerByte
+		if opts.Signer != nil {
+			bits += signatureBitLength
+		}
+		if encrypt {
+			bits += encryptionBitLength
+		}
+		return bits
+	}
+
+	pixels := chunk.NewPixels(img)
+
+	// The palette indexes of paletted images only carry payload without changing any color if the palette
+	// holds every color for all values of the payload bits. Otherwise the image is encoded in color.
+	if p, ok := pixels.(chunk.Paletted); ok && opts.Mode == ModeLSB {
+		if paired, ok := p.Paired(planes); ok {
+			pixels = paired
+		} else {
+			pixels = chunk.NRGBA{NRGBA: chunk.ImageToNRGBA(img)}
+		}
+	}
+
+	// Grayscale and paletted images only have a single channel
+	if channels&pixels.PixelChannels() == 0 {
+		return nil, fmt.Errorf("%w: image has none of the channels %s", ErrInvalidOptions, channels)
+	}
+	channels &= pixels.PixelChannels()
+
+	bounds := chunk.CalculateChunkBounds(pixels, channels, planes, hashBits, rowHashBits, skipTransparent, extraBits)
+	if bounds == nil {
+		return nil, ErrImageTooSmall
+	}
+
+	h := header{
+		version:     FormatVersion,
+		hashAlg:     hashAlg,
+		channels:    channels,
+		planes:      planes,
+		cols:        len(bounds),
+		rows:        len(bounds[0]),
+		rowHashBits: rowHashBits,
+		hashBits:    hashBits,
+	}
+	if len(opts.Key) > 0 {
+		h.flags |= flagKeyed
+	}
+	if opts.Signer != nil {
+		h.flags |= flagSigned
+	}
+	if scatter {
+		h.flags |= flagScattered
+	}
+	if encrypt {
+		h.flags |= flagEncrypted
+		h.cipher, h.kdf = cipherID, kdf
+	}
+	if opts.Message != nil {
+		h.flags |= flagMessage
+	}
+	if skipTransparent {
+		h.flags |= flagSkipTransparent
+	}
+
+	return &layout{header: h, pixels: pixels, bounds: bounds, extraBits: extraBits}, nil
+}
+
+// writePath writes the given Merkle path to the least significant bits of the given chunk of an image
+// that is divided into chunkCount chunks. The number of nodes occupies chunk.PathCountBitLength bits
+// and every node consists of a single side bit followed by its hash.
+func writePath(c *chunk.Chunk, path []ProofNode, chunkCount int) error {
+
+	if err := c.WriteBits(uint64(len(path)), uint8(chunk.PathCountBitLength(chunkCount))); err != nil {
+		return err
+	}
+
+	for _, node := range path {
+		if err := c.WriteBool(node.Side == 1); err != nil {
+			return err
+		}
+
+		if _, err := c.Write(node.Hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
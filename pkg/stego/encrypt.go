@@ -0,0 +1,254 @@
+package stego
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+
+	"dennis-tra/image-stego/internal/chunk"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Cipher identifies the authenticated cipher that encrypts the payload of every chunk.
+type Cipher uint8
+
+const (
+	// AES256GCM is AES-256 in Galois/Counter Mode as defined in NIST SP 800-38D.
+	AES256GCM Cipher = iota + 1
+
+	// ChaCha20Poly1305 is ChaCha20-Poly1305 as defined in RFC 8439.
+	ChaCha20Poly1305
+
+	// DefaultCipher is the cipher that is used if no cipher is configured.
+	DefaultCipher = AES256GCM
+)
+
+// cipherNames maps every cipher to its textual representation.
+var cipherNames = map[Cipher]string{
+	AES256GCM:        "aes-256-gcm",
+	ChaCha20Poly1305: "chacha20-poly1305",
+}
+
+// ParseCipher parses the textual representation of a cipher like "aes-256-gcm" or "chacha20-poly1305".
+func ParseCipher(s string) (Cipher, error) {
+	for c, name := range cipherNames {
+		if name == s {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher %q", s)
+}
+
+// Valid reports whether c is a supported cipher.
+func (c Cipher) Valid() bool {
+	_, ok := cipherNames[c]
+	return ok
+}
+
+// String returns the textual representation of the cipher, e.g. "aes-256-gcm".
+func (c Cipher) String() string {
+	if name, ok := cipherNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+// KDF identifies the function that derives the key of the Cipher from the encryption key.
+type KDF uint8
+
+const (
+	// Argon2id derives the key with Argon2id as defined in RFC 9106 (1 pass, 64 MiB, 4 lanes).
+	Argon2id KDF = iota + 1
+
+	// Scrypt derives the key with scrypt as defined in RFC 7914 (N=32768, r=8, p=1).
+	Scrypt
+
+	// KDFNone uses the encryption key itself as the key of the Cipher. It must be EncryptionKeyLength bytes long.
+	KDFNone
+
+	// DefaultKDF is the key derivation function that is used if none is configured.
+	DefaultKDF = Argon2id
+)
+
+// kdfNames maps every key derivation function to its textual representation.
+var kdfNames = map[KDF]string{
+	Argon2id: "argon2id",
+	Scrypt:   "scrypt",
+	KDFNone:  "none",
+}
+
+// ParseKDF parses the textual representation of a key derivation function like "argon2id", "scrypt" or "none".
+func ParseKDF(s string) (KDF, error) {
+	for k, name := range kdfNames {
+		if name == s {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown key derivation function %q", s)
+}
+
+// Valid reports whether k is a supported key derivation function.
+func (k KDF) Valid() bool {
+	_, ok := kdfNames[k]
+	return ok
+}
+
+// String returns the textual representation of the key derivation function, e.g. "argon2id".
+func (k KDF) String() string {
+	if name, ok := kdfNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(k))
+}
+
+// EncryptionKeyLength is the number of bytes of the key of every Cipher.
+const EncryptionKeyLength = 32
+
+// saltLength is the number of bytes of the random salt of the key derivation
+// that every chunk of an encrypted image carries right after its locator.
+const saltLength = 16
+
+// encryptionBitLength is the number of bits the encryption occupies in every chunk: the salt and the
+// authentication tag. Both supported ciphers produce tags of the same length.
+const encryptionBitLength = (saltLength + chacha20poly1305.Overhead) * chunk.BitsPerByte
+
+// ErrEncryptionKeyRequired is returned if an image with an encrypted payload is decoded without an encryption key.
+var ErrEncryptionKeyRequired = errors.New("image payload is encrypted")
+
+// ErrDecryption is returned if the payload of no chunk of an encrypted image could be authenticated.
+var ErrDecryption = errors.New("payload authentication failed, the encryption key is wrong")
+
+// newSalt returns a new random salt for the key derivation.
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// deriveKey derives the key of the cipher from the given encryption key and salt with the given key derivation function.
+func deriveKey(kdf KDF, encryptionKey []byte, salt []byte) ([]byte, error) {
+	switch kdf {
+	case Argon2id:
+		return argon2.IDKey(encryptionKey, salt, 1, 64*1024, 4, EncryptionKeyLength), nil
+	case Scrypt:
+		return scrypt.Key(encryptionKey, salt, 1<<15, 8, 1, EncryptionKeyLength)
+	case KDFNone:
+		if len(encryptionKey) != EncryptionKeyLength {
+			return nil, fmt.Errorf("encryption key must be %d bytes long without key derivation", EncryptionKeyLength)
+		}
+		return encryptionKey, nil
+	default:
+		return nil, fmt.Errorf("invalid key derivation function %d", kdf)
+	}
+}
+
+// newAEAD derives the key from the given encryption key and salt and returns the given cipher with that key.
+func newAEAD(c Cipher, kdf KDF, encryptionKey []byte, salt []byte) (cipher.AEAD, error) {
+	key, err := deriveKey(kdf, encryptionKey, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c {
+	case AES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case ChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("invalid cipher %d", c)
+	}
+}
+
+// chunkNonce returns the nonce of the chunk at the given index. The key is derived with a random salt for
+// every encoded image, so the position of the chunk in the chunk grid is unique for every key.
+func chunkNonce(index ChunkIndex) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint32(nonce[0:4], uint32(index.X))
+	binary.BigEndian.PutUint32(nonce[4:8], uint32(index.Y))
+	return nonce
+}
+
+// additionalData returns the data that the cipher authenticates without encrypting it: the binary
+// representations of the given header and locator as they are embedded at the beginning of every chunk.
+func additionalData(h header, l locator) ([]byte, error) {
+	hdr, err := h.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	loc, err := l.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(hdr, loc...), nil
+}
+
+// writeSalt writes the given salt to the least significant bits of the given chunk.
+func writeSalt(c *chunk.Chunk, salt []byte) error {
+	_, err := c.Write(salt)
+	return err
+}
+
+// readSalt reads the salt from the least significant bits of the given chunk.
+func readSalt(c *chunk.Chunk) ([]byte, error) {
+	salt := make([]byte, saltLength)
+	if _, err := c.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// salt returns the salt that most of the chunks of an encrypted image carry that lie completely within the
+// given region of the encoded image. It returns nil if the payload of the image isn't encrypted.
+func (g grid) salt(pixels chunk.Pixels, region image.Rectangle) []byte {
+	if !g.header.encrypted() {
+		return nil
+	}
+
+	saltCounts := map[string]int{}
+	for _, boundRow := range g.bounds() {
+		for _, bound := range boundRow {
+			if !bound.In(region) {
+				continue
+			}
+
+			c := &chunk.Chunk{
+				Pixels:   pixels.Crop(bound.Sub(g.offset)),
+				Channels: g.header.channels,
+				Planes:   g.header.planes,
+			}
+
+			skip := chunk.HeaderBitLength + chunk.LocatorBitLength
+			if _, err := c.Read(make([]byte, skip/chunk.BitsPerByte)); err != nil {
+				continue
+			}
+
+			if salt, err := readSalt(c); err == nil {
+				saltCounts[string(salt)]++
+			}
+		}
+	}
+
+	var salt string
+	for s, count := range saltCounts {
+		if count > saltCounts[salt] {
+			salt = s
+		}
+	}
+
+	return []byte(salt)
+}
@@ -0,0 +1,290 @@
+package stego
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"dennis-tra/image-stego/internal/chunk"
+)
+
+// Channels is a bit mask of the color channels of a pixel whose least significant bits carry payload.
+type Channels = chunk.Channels
+
+const (
+	// ChannelR selects the red channel.
+	ChannelR = chunk.ChannelR
+
+	// ChannelG selects the green channel.
+	ChannelG = chunk.ChannelG
+
+	// ChannelB selects the blue channel.
+	ChannelB = chunk.ChannelB
+
+	// ChannelA selects the alpha channel.
+	ChannelA = chunk.ChannelA
+
+	// DefaultChannels are the channels that are used if no channels are configured.
+	DefaultChannels = chunk.DefaultChannels
+)
+
+// MaxPlanes is the maximum number of low bits per channel that can carry the Merkle tree information.
+const MaxPlanes = chunk.MaxPlanes
+
+// MaxRowHashBits is the maximum number of bits every row hash can be truncated to.
+const MaxRowHashBits = chunk.MaxRowHashBits
+
+// HashAlgorithm identifies the hash function of the chunk hashes and Merkle nodes.
+type HashAlgorithm = chunk.HashAlgorithm
+
+const (
+	// SHA256 is SHA-256 as defined in FIPS 180-4.
+	SHA256 = chunk.SHA256
+
+	// SHA512_256 is SHA-512/256 as defined in FIPS 180-4.
+	SHA512_256 = chunk.SHA512_256
+
+	// SHA3_256 is SHA3-256 as defined in FIPS 202.
+	SHA3_256 = chunk.SHA3_256
+
+	// BLAKE2b256 is BLAKE2b with a 256 bit digest as defined in RFC 7693.
+	BLAKE2b256 = chunk.BLAKE2b256
+
+	// BLAKE3 is BLAKE3 with a 256 bit digest.
+	BLAKE3 = chunk.BLAKE3
+
+	// DefaultHashAlgorithm is the hash algorithm that is used if no algorithm is configured.
+	DefaultHashAlgorithm = chunk.DefaultHashAlgorithm
+)
+
+// MinHashBits is the minimum number of bits the chunk hashes and Merkle nodes can be truncated to.
+const MinHashBits = chunk.MinHashBits
+
+// MaxHashBits is the number of bits of untruncated chunk hashes and Merkle nodes.
+const MaxHashBits = chunk.HashBitLength
+
+// ParseHashAlgorithm parses the name of a hash algorithm like "sha256", "sha512/256",
+// "sha3-256", "blake2b-256" or "blake3".
+func ParseHashAlgorithm(s string) (HashAlgorithm, error) {
+	return chunk.ParseHashAlgorithm(s)
+}
+
+// ParseChannels parses a channel selection like "rgb" or "a". Every character
+// denotes a channel and may only occur once.
+func ParseChannels(s string) (Channels, error) {
+	return chunk.ParseChannels(s)
+}
+
+// FormatVersion is the version of the chunk header and payload format produced by this package.
+// Images of other versions are rejected with ErrUnsupportedFormat.
+const FormatVersion = 1
+
+// flagKeyed is set in the header flags if the chunk hashes and Merkle nodes are message
+// authentication codes that can only be calculated with a secret key.
+const flagKeyed uint8 = 1 << 0
+
+// flagSigned is set in the header flags if every chunk carries a signature over the Merkle root
+// right after its Merkle path.
+const flagSigned uint8 = 1 << 1
+
+// flagScattered is set in the header flags if the payload after the locator is spread across every
+// chunk by a pseudo-random permutation of its LSBs that is seeded from the secret key (see scatterSeed).
+const flagScattered uint8 = 1 << 2
+
+// flagEncrypted is set in the header flags if everything after the locator and the salt is encrypted
+// with an authenticated cipher (see Cipher and KDF).
+const flagEncrypted uint8 = 1 << 3
+
+// flagMessage is set in the header flags if a message is hidden in the LSBs that are left over by the
+// Merkle tree information (see EncodeOptions.Message).
+const flagMessage uint8 = 1 << 4
+
+// flagSkipTransparent is set in the header flags if fully transparent pixels after the sequentially
+// filled LSBs carry no payload and are hashed as transparent black (see EncodeOptions.SkipTransparent).
+const flagSkipTransparent uint8 = 1 << 5
+
+// headerMagic is the magic value every chunk header starts with.
+var headerMagic = [2]byte{'S', 'g'}
+
+// header is the self-describing configuration that is embedded at the beginning of every chunk in ModeLSB.
+// It is laid out as follows:
+//
+//	bytes 0-1:   magic value "Sg"
+//	byte  2:     format version
+//	byte  3:     hash algorithm
+//	byte  4:     number of planes minus one (upper four bits) and channel mask (lower four bits)
+//	bytes 5-6:   number of chunks along the width (big endian)
+//	bytes 7-8:   number of chunks along the height (big endian)
+//	byte  9:     flags (see flagKeyed, flagSigned, flagScattered, flagEncrypted, flagMessage and flagSkipTransparent), unknown flags are reserved for future use
+//	byte  10:    number of bits of every row hash, 0 if there are none
+//	byte  11:    number of bytes of every chunk hash and Merkle node
+//	byte  12:    cipher (upper four bits) and key derivation function (lower four bits) of an encrypted
+//	             payload, 0 otherwise
+type header struct {
+	// version is the format version.
+	version uint8
+
+	// hashAlg identifies the hash algorithm of the Merkle tree.
+	hashAlg HashAlgorithm
+
+	// channels are the color channels whose low bits carry the Merkle tree information.
+	channels Channels
+
+	// planes is the number of low bits of each channel that carry the Merkle tree information.
+	planes int
+
+	// cols is the number of chunks along the width of the image.
+	cols int
+
+	// rows is the number of chunks along the height of the image.
+	rows int
+
+	// flags holds the flag bits like flagKeyed, flagSigned, flagScattered, flagEncrypted, flagMessage and flagSkipTransparent. All other bits are reserved for future use and always 0.
+	flags uint8
+
+	// rowHashBits is the number of bits every row hash is truncated to. 0 means there are no row hashes.
+	rowHashBits int
+
+	// hashBits is the number of bits every chunk hash and Merkle node is truncated to.
+	hashBits int
+
+	// cipher is the cipher of an encrypted payload and 0 otherwise.
+	cipher Cipher
+
+	// kdf is the key derivation function of an encrypted payload and 0 otherwise.
+	kdf KDF
+}
+
+// sequentialBits returns the number of LSBs at the beginning of every chunk that are never permuted or
+// encrypted: the header and the locator, which are needed to find the chunk grid, and the salt of an
+// encrypted payload.
+func (h header) sequentialBits() int {
+	if h.encrypted() {
+		return chunk.HeaderBitLength + chunk.LocatorBitLength + saltLength*chunk.BitsPerByte
+	}
+	return chunk.HeaderBitLength + chunk.LocatorBitLength
+}
+
+// keyed reports whether the chunk hashes and Merkle nodes are message authentication codes.
+func (h header) keyed() bool {
+	return h.flags&flagKeyed != 0
+}
+
+// signed reports whether every chunk carries a signature over the Merkle root.
+func (h header) signed() bool {
+	return h.flags&flagSigned != 0
+}
+
+// scattered reports whether the payload after the locator is spread pseudo-randomly across every chunk.
+func (h header) scattered() bool {
+	return h.flags&flagScattered != 0
+}
+
+// encrypted reports whether everything after the locator and the salt is encrypted.
+func (h header) encrypted() bool {
+	return h.flags&flagEncrypted != 0
+}
+
+// hasMessage reports whether a message is hidden in the LSBs that are left over by the Merkle tree information.
+func (h header) hasMessage() bool {
+	return h.flags&flagMessage != 0
+}
+
+// skipsTransparent reports whether fully transparent pixels carry no payload.
+func (h header) skipsTransparent() bool {
+	return h.flags&flagSkipTransparent != 0
+}
+
+// MarshalBinary encodes the header into its binary representation.
+func (h header) MarshalBinary() ([]byte, error) {
+	if h.cols > math.MaxUint16 || h.rows > math.MaxUint16 {
+		return nil, fmt.Errorf("chunk grid %dx%d too large", h.cols, h.rows)
+	}
+
+	buf := make([]byte, chunk.HeaderBitLength/chunk.BitsPerByte)
+	copy(buf[0:2], headerMagic[:])
+	buf[2] = h.version
+	buf[3] = byte(h.hashAlg)
+	buf[4] = byte(h.planes-1)<<4 | byte(h.channels)
+	binary.BigEndian.PutUint16(buf[5:7], uint16(h.cols))
+	binary.BigEndian.PutUint16(buf[7:9], uint16(h.rows))
+	buf[9] = h.flags
+	buf[10] = byte(h.rowHashBits)
+	buf[11] = byte(h.hashBits / chunk.BitsPerByte)
+	buf[12] = byte(h.cipher)<<4 | byte(h.kdf)
+
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the header from its binary representation. It returns ErrNotEncoded if
+// the data doesn't start with the magic value or holds an invalid configuration and
+// ErrUnsupportedFormat if it was written by an incompatible version of this package.
+func (h *header) UnmarshalBinary(data []byte) error {
+	if len(data) != chunk.HeaderBitLength/chunk.BitsPerByte || !bytes.Equal(data[0:2], headerMagic[:]) {
+		return ErrNotEncoded
+	}
+
+	*h = header{
+		version:     data[2],
+		hashAlg:     HashAlgorithm(data[3]),
+		channels:    Channels(data[4] & 0x0F),
+		planes:      int(data[4]>>4) + 1,
+		cols:        int(binary.BigEndian.Uint16(data[5:7])),
+		rows:        int(binary.BigEndian.Uint16(data[7:9])),
+		flags:       data[9],
+		rowHashBits: int(data[10]),
+		hashBits:    int(data[11]) * chunk.BitsPerByte,
+		cipher:      Cipher(data[12] >> 4),
+		kdf:         KDF(data[12] & 0x0F),
+	}
+
+	if h.version != FormatVersion {
+		return fmt.Errorf("%w: version %d", ErrUnsupportedFormat, h.version)
+	}
+
+	if !h.hashAlg.Valid() {
+		return fmt.Errorf("%w: hash algorithm %d", ErrUnsupportedFormat, h.hashAlg)
+	}
+
+	if h.flags&^(flagKeyed|flagSigned|flagScattered|flagEncrypted|flagMessage|flagSkipTransparent) != 0 {
+		return fmt.Errorf("%w: flags %08b", ErrUnsupportedFormat, h.flags)
+	}
+
+	if h.encrypted() != (h.cipher != 0 || h.kdf != 0) || h.encrypted() && (!h.cipher.Valid() || !h.kdf.Valid()) {
+		return fmt.Errorf("%w: cipher %d and key derivation function %d", ErrUnsupportedFormat, h.cipher, h.kdf)
+	}
+
+	if !h.channels.Valid() || h.planes > MaxPlanes || h.cols*h.rows < 2 || h.rowHashBits > MaxRowHashBits ||
+		h.hashBits < MinHashBits || h.hashBits > MaxHashBits {
+		return ErrNotEncoded
+	}
+
+	return nil
+}
+
+// writeHeader writes the given header to the least significant bits of the given chunk.
+func writeHeader(c *chunk.Chunk, h header) error {
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Write(buf)
+	return err
+}
+
+// readHeader reads the chunk header from the least significant bits of the given chunk.
+func readHeader(c *chunk.Chunk) (header, error) {
+	buf := make([]byte, chunk.HeaderBitLength/chunk.BitsPerByte)
+	if _, err := c.Read(buf); err != nil {
+		return header{}, err
+	}
+
+	h := header{}
+	if err := h.UnmarshalBinary(buf); err != nil {
+		return header{}, err
+	}
+
+	return h, nil
+}
@@ -0,0 +1,224 @@
+package stego
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+
+	"dennis-tra/image-stego/internal/chunk"
+	"dennis-tra/image-stego/pkg/bit"
+)
+
+// locator directly follows the header of every chunk in ModeLSB. It records the
+// position of the chunk in the chunk grid and the dimensions of the encoded image, so that the chunk grid
+// can be restored from any chunk of a cropped image. It is laid out as follows:
+//
+//	bytes 0-1: position of the chunk along the width (big endian)
+//	bytes 2-3: position of the chunk along the height (big endian)
+//	bytes 4-5: width of the encoded image (big endian)
+//	bytes 6-7: height of the encoded image (big endian)
+type locator struct {
+	// index is the position of the chunk in the chunk grid.
+	index ChunkIndex
+
+	// width is the width of the encoded image.
+	width int
+
+	// height is the height of the encoded image.
+	height int
+}
+
+// MarshalBinary encodes the locator into its chunk.LocatorBitLength bits long binary representation.
+func (l locator) MarshalBinary() ([]byte, error) {
+	if l.width > math.MaxUint16 || l.height > math.MaxUint16 {
+		return nil, fmt.Errorf("image dimensions %dx%d too large", l.width, l.height)
+	}
+
+	buf := make([]byte, chunk.LocatorBitLength/chunk.BitsPerByte)
+	binary.BigEndian.PutUint16(buf[0:2], uint16(l.index.X))
+	binary.BigEndian.PutUint16(buf[2:4], uint16(l.index.Y))
+	binary.BigEndian.PutUint16(buf[4:6], uint16(l.width))
+	binary.BigEndian.PutUint16(buf[6:8], uint16(l.height))
+
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the locator from its binary representation.
+func (l *locator) UnmarshalBinary(data []byte) error {
+	if len(data) != chunk.LocatorBitLength/chunk.BitsPerByte {
+		return ErrNotEncoded
+	}
+
+	*l = locator{
+		index: ChunkIndex{
+			X: int(binary.BigEndian.Uint16(data[0:2])),
+			Y: int(binary.BigEndian.Uint16(data[2:4])),
+		},
+		width:  int(binary.BigEndian.Uint16(data[4:6])),
+		height: int(binary.BigEndian.Uint16(data[6:8])),
+	}
+
+	return nil
+}
+
+// grid describes the chunk grid of an encoded image and where a decoded image is located within it.
+type grid struct {
+	// header is the header of the chunks.
+	header header
+
+	// original is the bounds of the encoded image.
+	original image.Rectangle
+
+	// offset is the position of the top left pixel of the decoded image within the encoded image.
+	offset image.Point
+}
+
+// bounds returns the chunk bounds of the encoded image, indexed by [x][y].
+func (g grid) bounds() [][]image.Rectangle {
+	return chunk.ChunkBounds(g.original.Dx(), g.original.Dy(), g.header.cols, g.header.rows)
+}
+
+// locateGrid finds the chunk grid of the given image. It first tries the header of the chunk in the top left
+// corner of the image. If that fails (e.g. because the image was cropped) the whole image is searched for
+// chunk headers. As every chunk records its own position, each header votes for the position of the image
+// within the encoded image and the most common one wins.
+func locateGrid(pixels chunk.Pixels) (grid, error) {
+
+	g, err := readGrid(pixels, image.Point{})
+	if err == nil || errors.Is(err, ErrUnsupportedFormat) {
+		return g, err
+	}
+
+	headerPixels := chunk.HeaderPixelCount(pixels.PixelChannels(), chunk.HeaderBitLength)
+
+	candidates := []grid{}
+	votes := map[grid]int{}
+	for y := 0; y < pixels.Bounds().Dy(); y++ {
+		for x := 0; x+headerPixels <= pixels.Bounds().Dx(); x++ {
+
+			if !hasMagic(pixels, x, y) {
+				continue
+			}
+
+			g, err := readGrid(pixels, image.Pt(x, y))
+			if err != nil {
+				continue
+			}
+
+			if votes[g] == 0 {
+				candidates = append(candidates, g)
+			}
+			votes[g]++
+		}
+	}
+
+	if len(candidates) == 0 {
+		return grid{}, ErrNotEncoded
+	}
+
+	best := candidates[0]
+	for _, candidate := range candidates {
+		if votes[candidate] > votes[best] {
+			best = candidate
+		}
+	}
+
+	return best, nil
+}
+
+// readGrid reads the header and locator of a chunk whose top left pixel is located at the given point
+// and derives the chunk grid from it.
+func readGrid(pixels chunk.Pixels, pt image.Point) (grid, error) {
+
+	// The header and locator are always located in the first row of the chunk
+	headerPixels := chunk.HeaderPixelCount(pixels.PixelChannels(), chunk.HeaderBitLength)
+	row := image.Rect(pt.X, pt.Y, pixels.Bounds().Dx(), pt.Y+1)
+	if row.Dx() < headerPixels {
+		return grid{}, ErrNotEncoded
+	}
+
+	h, err := readHeader(&chunk.Chunk{Pixels: pixels.Crop(row)})
+	if err != nil {
+		return grid{}, err
+	}
+
+	// The payload can't lie in channels the image doesn't have, e.g. if a color image was converted to grayscale
+	if h.channels&^pixels.PixelChannels() != 0 {
+		return grid{}, ErrNotEncoded
+	}
+
+	c := &chunk.Chunk{
+		Pixels:   pixels.Crop(row),
+		Channels: h.channels,
+		Planes:   h.planes,
+	}
+
+	if _, err = readHeader(c); err != nil {
+		return grid{}, err
+	}
+
+	l, err := readLocator(c)
+	if err != nil {
+		return grid{}, ErrNotEncoded
+	}
+
+	if l.index.X >= h.cols || l.index.Y >= h.rows || h.cols > l.width/headerPixels || h.rows > l.height {
+		return grid{}, ErrNotEncoded
+	}
+
+	g := grid{
+		header:   h,
+		original: image.Rect(0, 0, l.width, l.height),
+	}
+
+	bound := chunk.ChunkBound(l.width, l.height, h.cols, h.rows, l.index.X, l.index.Y)
+	g.offset = bound.Min.Sub(pt)
+
+	// The image needs to lie within the encoded image
+	if !pixels.Bounds().Add(g.offset).In(g.original) {
+		return grid{}, ErrNotEncoded
+	}
+
+	return g, nil
+}
+
+// hasMagic reports whether the least significant bits of the header channels (see chunk.HeaderChannels)
+// of the pixels starting at the given position hold the magic value of the chunk header.
+func hasMagic(pixels chunk.Pixels, x, y int) bool {
+	channelCount := chunk.HeaderChannels(pixels.PixelChannels()).Count()
+	for i := 0; i < len(headerMagic)*chunk.BitsPerByte; i++ {
+		want := bit.GetBit(headerMagic[i/chunk.BitsPerByte], chunk.BitsPerByte-1-i%chunk.BitsPerByte)
+		if bit.GetLSB(pixels.Pixel(x+i/channelCount, y)[(i%channelCount+1)*pixels.SampleSize()-1]) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// writeLocator writes the given locator to the least significant bits of the given chunk.
+func writeLocator(c *chunk.Chunk, l locator) error {
+	buf, err := l.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Write(buf)
+	return err
+}
+
+// readLocator reads the chunk locator from the least significant bits of the given chunk.
+func readLocator(c *chunk.Chunk) (locator, error) {
+	buf := make([]byte, chunk.LocatorBitLength/chunk.BitsPerByte)
+	if _, err := c.Read(buf); err != nil {
+		return locator{}, err
+	}
+
+	l := locator{}
+	if err := l.UnmarshalBinary(buf); err != nil {
+		return locator{}, err
+	}
+
+	return l, nil
+}
@@ -0,0 +1,96 @@
+package stego
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"dennis-tra/image-stego/internal/chunk"
+)
+
+// messageFrameLength is the number of bytes the framing adds to a hidden message:
+// its length in front of it and its checksum behind it.
+const messageFrameLength = 4 + crc32.Size
+
+// ErrMessageTooLarge is returned if a message doesn't fit into the LSBs that are left over by the Merkle tree information.
+var ErrMessageTooLarge = errors.New("message exceeds the capacity of the image")
+
+// ErrNoMessage is returned if no message was hidden in an image.
+var ErrNoMessage = errors.New("image carries no message")
+
+// ErrMessageCorrupted is returned if the hidden message can't be extracted intact, e.g. because chunks that
+// carry parts of it were tampered with or cut off by cropping.
+var ErrMessageCorrupted = errors.New("message is corrupted")
+
+// frameMessage prepends the length of the given message and appends its CRC-32 checksum.
+func frameMessage(message []byte) []byte {
+	framed := make([]byte, 4, len(message)+messageFrameLength)
+	binary.BigEndian.PutUint32(framed, uint32(len(message)))
+	framed = append(framed, message...)
+
+	checksum := make([]byte, crc32.Size)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(message))
+	return append(framed, checksum...)
+}
+
+// unframeMessage returns the message at the beginning of the given stream of message fragments.
+// It returns ErrMessageCorrupted if the length or the checksum doesn't match.
+func unframeMessage(stream []byte) ([]byte, error) {
+	if len(stream) < messageFrameLength {
+		return nil, ErrMessageCorrupted
+	}
+
+	length := binary.BigEndian.Uint32(stream)
+	if uint64(length) > uint64(len(stream)-messageFrameLength) {
+		return nil, fmt.Errorf("%w: length %d", ErrMessageCorrupted, length)
+	}
+
+	message := stream[4 : 4+length]
+	if binary.BigEndian.Uint32(stream[4+length:]) != crc32.ChecksumIEEE(message) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrMessageCorrupted)
+	}
+
+	return append([]byte{}, message...), nil
+}
+
+// writeMessageFragment writes as much of the given framed message to the least significant bits of the given
+// chunk as fits into the remaining LSBs and returns the part that still needs to be written to other chunks.
+func writeMessageFragment(c *chunk.Chunk, rest []byte) ([]byte, error) {
+	n := c.RemainingPayloadSize()
+	if n > len(rest) {
+		n = len(rest)
+	}
+
+	if _, err := c.Write(rest[:n]); err != nil {
+		return nil, err
+	}
+
+	return rest[n:], nil
+}
+
+// readMessageFragment reads all remaining least significant bits of the given chunk, which carry its fragment
+// of the framed message. The last chunks may carry less of the message or none at all.
+func readMessageFragment(c *chunk.Chunk) []byte {
+	fragment := make([]byte, c.MaxPayloadSize())
+
+	// Reading stops with io.EOF at the end of the LSBs
+	n, _ := c.Read(fragment)
+	return fragment[:n]
+}
+
+// joinMessage concatenates the given message fragments of all chunks of an image that is divided into the given
+// number of chunks, indexed by the chunk index, and returns the message. Fragments of chunks that were cut off by
+// cropping or don't lead to the Merkle root are missing, which only corrupts the message if they carry a part of it.
+func joinMessage(fragments map[int][]byte, chunkCount int) ([]byte, error) {
+	stream := []byte{}
+	for i := 0; i < chunkCount; i++ {
+		fragment, found := fragments[i]
+		if !found {
+			break
+		}
+		stream = append(stream, fragment...)
+	}
+
+	return unframeMessage(stream)
+}
@@ -0,0 +1,252 @@
+package stego
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+
+	"dennis-tra/image-stego/internal/chunk"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// maxMetadataShards is the maximum number of Reed-Solomon shards the metadata is split into.
+const maxMetadataShards = 256
+
+// metadataChecksumLength is the number of bytes of the checksum that follows every metadata shard (see
+// shardChecksum). It reveals manipulated shards, so that they can be treated as erasures.
+const metadataChecksumLength = crc32.Size
+
+// errMetadataLost is returned if too few metadata shards survived to recover the metadata.
+var errMetadataLost = errors.New("too few intact metadata shards")
+
+// errMetadataInconsistent is returned if the intact metadata shards don't belong to the same metadata,
+// e.g. because chunks of another image were spliced in.
+var errMetadataInconsistent = errors.New("inconsistent metadata shards")
+
+// metadata is the image-wide information that is embedded across all chunks. It is
+// split into Reed-Solomon coded shards and every chunk carries one of them right after its Merkle path (or
+// signature), so that it survives the manipulation of a sizeable fraction of the chunks. The shards are
+// assigned to the chunks in the order of their chunk index and repeat if there are more chunks than shards.
+type metadata struct {
+	// version is the format version.
+	version uint8
+
+	// cols is the number of chunks along the width of the image.
+	cols int
+
+	// rows is the number of chunks along the height of the image.
+	rows int
+
+	// width is the width in pixels of the encoded image.
+	width int
+
+	// height is the height in pixels of the encoded image.
+	height int
+
+	// root is the Merkle root of the image.
+	root []byte
+}
+
+// metadataLength returns the number of bytes of the binary representation of the
+// metadata of an image whose hashes are truncated to the given number of bits.
+func metadataLength(hashBits int) int {
+	return 1 + 4*2 + hashBits/chunk.BitsPerByte
+}
+
+// metadataShards returns the number of data and parity shards the metadata of an image that is divided
+// into the given number of chunks is split into. A quarter of the shards carry data, so that the metadata
+// can be recovered as long as a quarter of the shards survive.
+func metadataShards(chunkCount int, hashBits int) (int, int) {
+	total := chunkCount
+	if total > maxMetadataShards {
+		total = maxMetadataShards
+	}
+
+	data := total / 4
+	if data < 1 {
+		data = 1
+	} else if data > metadataLength(hashBits) {
+		data = metadataLength(hashBits)
+	}
+
+	return data, total - data
+}
+
+// metadataShardLength returns the number of bytes every chunk of an image that is divided into the given
+// number of chunks needs to carry its metadata shard including the checksum.
+func metadataShardLength(chunkCount int, hashBits int) int {
+	data, _ := metadataShards(chunkCount, hashBits)
+	return int(math.Ceil(float64(metadataLength(hashBits))/float64(data))) + metadataChecksumLength
+}
+
+// MarshalBinary encodes the metadata into its binary representation.
+func (m metadata) MarshalBinary() ([]byte, error) {
+	if m.cols > math.MaxUint16 || m.rows > math.MaxUint16 || m.width > math.MaxUint16 || m.height > math.MaxUint16 {
+		return nil, fmt.Errorf("image dimensions %dx%d too large", m.width, m.height)
+	}
+
+	buf := make([]byte, 9, 9+len(m.root))
+	buf[0] = m.version
+	binary.BigEndian.PutUint16(buf[1:3], uint16(m.cols))
+	binary.BigEndian.PutUint16(buf[3:5], uint16(m.rows))
+	binary.BigEndian.PutUint16(buf[5:7], uint16(m.width))
+	binary.BigEndian.PutUint16(buf[7:9], uint16(m.height))
+
+	return append(buf, m.root...), nil
+}
+
+// UnmarshalBinary decodes the metadata from its binary representation.
+func (m *metadata) UnmarshalBinary(data []byte) error {
+	if len(data) < 9 {
+		return fmt.Errorf("invalid metadata length %d", len(data))
+	}
+
+	*m = metadata{
+		version: data[0],
+		cols:    int(binary.BigEndian.Uint16(data[1:3])),
+		rows:    int(binary.BigEndian.Uint16(data[3:5])),
+		width:   int(binary.BigEndian.Uint16(data[5:7])),
+		height:  int(binary.BigEndian.Uint16(data[7:9])),
+		root:    append([]byte{}, data[9:]...),
+	}
+
+	return nil
+}
+
+// shardChecksum returns the checksum of the metadata shard with the given index of an image with the given
+// header. Without a key it is the CRC-32 checksum of the shard, which only reveals accidental damage. With a key
+// it is the keyed hash of the index and the shard truncated to metadataChecksumLength bytes, so that shards can't
+// be forged or moved to another index without the key.
+func shardChecksum(h header, key []byte, idx int, shard []byte) []byte {
+	checksum := make([]byte, metadataChecksumLength)
+	if len(key) == 0 {
+		binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(shard))
+		return checksum
+	}
+
+	mac := h.hashAlg.KeyedTruncated(key, metadataChecksumLength*chunk.BitsPerByte)()
+	binary.BigEndian.PutUint16(checksum, uint16(idx))
+	mac.Write(checksum[:2])
+	mac.Write(shard)
+	return mac.Sum(nil)
+}
+
+// shards splits the metadata into the Reed-Solomon coded shards for an image with the given header.
+// Every shard is followed by its checksum under the given key (see shardChecksum).
+func (m metadata) shards(h header, key []byte) ([][]byte, error) {
+	buf, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := reedsolomon.New(metadataShards(m.cols*m.rows, h.hashBits))
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := enc.Split(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = enc.Encode(shards); err != nil {
+		return nil, err
+	}
+
+	for i, shard := range shards {
+		shards[i] = append(append([]byte{}, shard...), shardChecksum(h, key, i, shard)...)
+	}
+
+	return shards, nil
+}
+
+// recoverMetadata reconstructs the metadata of an image with the given header from the given shards that were
+// read from its chunks, indexed by the chunk index. Shards with a wrong checksum under the given key are treated
+// as erasures. If a shard repeats the first intact one in the order of the chunk index is used. The parity of the
+// shards is verified, so that intact shards of other images are detected as long as more shards survived than
+// carry data.
+func recoverMetadata(h header, key []byte, shardsByChunk map[int][]byte) (*metadata, error) {
+
+	chunkCount := h.cols * h.rows
+	dataShards, parityShards := metadataShards(chunkCount, h.hashBits)
+
+	shards := make([][]byte, dataShards+parityShards)
+	for i := 0; i < chunkCount; i++ {
+		shard, ok := shardsByChunk[i]
+		idx := i % len(shards)
+		if !ok || shards[idx] != nil || len(shard) <= metadataChecksumLength {
+			continue
+		}
+
+		data, checksum := shard[:len(shard)-metadataChecksumLength], shard[len(shard)-metadataChecksumLength:]
+		if !hmac.Equal(checksum, shardChecksum(h, key, idx, data)) {
+			continue
+		}
+
+		shards[idx] = data
+	}
+
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	// The missing parity shards are reconstructed as well, so that the parity can be verified
+	if err = enc.Reconstruct(shards); err != nil {
+		return nil, errMetadataLost
+	}
+
+	if ok, err := enc.Verify(shards); err != nil || !ok {
+		return nil, errMetadataInconsistent
+	}
+
+	buf := &bytes.Buffer{}
+	if err = enc.Join(buf, shards, metadataLength(h.hashBits)); err != nil {
+		return nil, err
+	}
+
+	m := &metadata{}
+	if err = m.UnmarshalBinary(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// writeMetadataShard writes the given metadata shard to the least significant bits of the given chunk.
+func writeMetadataShard(c *chunk.Chunk, shard []byte) error {
+	_, err := c.Write(shard)
+	return err
+}
+
+// readMetadataShard reads the metadata shard of an image with the given header from
+// the least significant bits of the given chunk.
+func readMetadataShard(c *chunk.Chunk, h header) ([]byte, error) {
+	shard := make([]byte, metadataShardLength(h.cols*h.rows, h.hashBits))
+	if _, err := c.Read(shard); err != nil {
+		return nil, err
+	}
+	return shard, nil
+}
+
+// recoverMetadata reconstructs the metadata of the image from the given shards that were read from its chunks,
+// indexed by the chunk index, with the given key. It returns nil if too few shards survived, they are inconsistent
+// or the metadata doesn't describe the chunk grid.
+func (g grid) recoverMetadata(key []byte, shardsByChunk map[int][]byte) *metadata {
+	m, err := recoverMetadata(g.header, key, shardsByChunk)
+	if err != nil {
+		return nil
+	}
+
+	if m.version != g.header.version || m.cols != g.header.cols || m.rows != g.header.rows ||
+		m.width != g.original.Dx() || m.height != g.original.Dy() || len(m.root) != g.header.hashBits/chunk.BitsPerByte {
+		return nil
+	}
+
+	return m
+}
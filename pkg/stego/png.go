@@ -0,0 +1,56 @@
+package stego
+
+import (
+	"errors"
+	"image"
+	"io"
+
+	"dennis-tra/image-stego/internal/chunk"
+)
+
+// PNGChunkType is the type of the private ancillary PNG chunk that holds the proof
+// of an image encoded in ModePNGChunk. The lowercase first letter marks it as ancillary,
+// the lowercase second letter as private and the lowercase last letter as safe to copy.
+const PNGChunkType = "stEg"
+
+// MaxPNGProofLength is the maximum number of bytes of a proof that is embedded into a PNGChunkType chunk.
+// It is far larger than the compressed proofs of common image sizes and protects against crafted chunk lengths.
+const MaxPNGProofLength = 256 << 20
+
+// ErrNoProof is returned if a PNG stream does not contain an embedded proof.
+var ErrNoProof = errors.New("no proof embedded in png")
+
+// WritePNG writes the given image as PNG to w. If proof is not nil it is embedded
+// into a PNGChunkType chunk so that the image file is self-contained while
+// all pixels keep their original values.
+func WritePNG(w io.Writer, img image.Image, proof *Proof) error {
+
+	if proof == nil {
+		return chunk.EncodePNG(w, img)
+	}
+
+	data, err := proof.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return chunk.EncodePNG(w, img, chunk.PNGChunk{Type: PNGChunkType, Data: data})
+}
+
+// ReadPNGProof reads the proof that is embedded into the PNGChunkType chunk of the PNG stream r.
+func ReadPNGProof(r io.Reader) (*Proof, error) {
+
+	data, err := chunk.ReadPNGChunk(r, PNGChunkType, MaxPNGProofLength)
+	if err == chunk.ErrPNGChunkNotFound {
+		return nil, ErrNoProof
+	} else if err != nil {
+		return nil, err
+	}
+
+	proof := &Proof{}
+	if err = proof.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return proof, nil
+}
@@ -0,0 +1,252 @@
+package stego
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"image"
+
+	"dennis-tra/image-stego/internal/chunk"
+)
+
+// ProofVersion is the version of the proof format produced by this package. Proofs of other versions are rejected.
+const ProofVersion = 1
+
+// Mode determines where the Merkle tree information of an encoded image is stored.
+type Mode int
+
+const (
+	// ModeLSB embeds the Merkle tree information into the least significant bits of each chunk.
+	ModeLSB Mode = iota
+
+	// ModeSidecar leaves the image pixels untouched. The Merkle tree information
+	// is only available through the Proof of the encoded image which needs
+	// to be stored separately (e.g. in a sidecar file).
+	ModeSidecar
+
+	// ModePNGChunk leaves the image pixels untouched. The Proof of the encoded image
+	// is meant to be embedded into a private ancillary chunk of a PNG file (see WritePNG).
+	ModePNGChunk
+)
+
+// String returns a human readable representation of the mode.
+func (m Mode) String() string {
+	switch m {
+	case ModeLSB:
+		return "lsb"
+	case ModeSidecar:
+		return "sidecar"
+	case ModePNGChunk:
+		return "png"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText encodes the mode as its string representation.
+func (m Mode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText decodes the mode from its string representation.
+func (m *Mode) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "lsb":
+		*m = ModeLSB
+	case "sidecar":
+		*m = ModeSidecar
+	case "png":
+		*m = ModePNGChunk
+	default:
+		return fmt.Errorf("unknown mode %q", text)
+	}
+	return nil
+}
+
+// hashLSB reports whether the least significant bits are considered in the chunk hashes.
+// This is only the case if they don't carry the Merkle tree information.
+func (m Mode) hashLSB() bool {
+	return m != ModeLSB
+}
+
+// HexBytes is a byte slice that is hex encoded in its text representation.
+type HexBytes []byte
+
+// MarshalText encodes the bytes as a hex string.
+func (h HexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+// UnmarshalText decodes the bytes from a hex string.
+func (h *HexBytes) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*h = b
+	return nil
+}
+
+// Proof holds the chunk grid, the chunk hashes, the Merkle paths and the Merkle root of
+// an encoded image. Together with the image it is all that's needed to verify it.
+type Proof struct {
+	// Version is the version of the proof format.
+	Version int `json:"version"`
+
+	// Mode is the mode the image was encoded with.
+	Mode Mode `json:"mode"`
+
+	// Width is the width in pixels of the encoded image.
+	Width int `json:"width"`
+
+	// Height is the height in pixels of the encoded image.
+	Height int `json:"height"`
+
+	// HashAlgorithm is the hash function of the chunk hashes and Merkle nodes.
+	HashAlgorithm HashAlgorithm `json:"hash_algorithm,omitempty"`
+
+	// HashBits is the number of bits the chunk hashes and Merkle nodes are truncated to.
+	HashBits int `json:"hash_bits,omitempty"`
+
+	// Keyed reports whether the chunk hashes and Merkle nodes are message authentication
+	// codes that can only be calculated with the secret key the image was encoded with.
+	Keyed bool `json:"keyed,omitempty"`
+
+	// Channels are the color channels whose low bits carry the Merkle tree information in ModeLSB and
+	// are therefore left out of the chunk hashes. It is 0 in other modes, which hash all bits.
+	Channels Channels `json:"channels,omitempty"`
+
+	// Planes is the number of low bits of each of the Channels that are left out of the chunk hashes in ModeLSB.
+	Planes int `json:"planes,omitempty"`
+
+	// SkipTransparent reports whether fully transparent pixels are hashed as transparent black in ModeLSB.
+	SkipTransparent bool `json:"skip_transparent,omitempty"`
+
+	// SequentialBits is the number of LSBs at the beginning of every chunk that are filled sequentially in ModeLSB.
+	SequentialBits int `json:"sequential_bits,omitempty"`
+
+	// Signature is the signature over MerkleRoot. It is nil if the image wasn't signed.
+	Signature *Signature `json:"signature,omitempty"`
+
+	// MerkleRoot is the root hash of the Merkle tree built from all chunks.
+	MerkleRoot HexBytes `json:"merkle_root"`
+
+	// Chunks holds the proof of every chunk of the image.
+	Chunks []ProofChunk `json:"chunks"`
+}
+
+// ProofChunk holds the proof of a single chunk.
+type ProofChunk struct {
+	// Index is the position of the chunk in the chunk grid.
+	Index ChunkIndex `json:"index"`
+
+	// Bounds is the region of the image that is covered by the chunk.
+	Bounds image.Rectangle `json:"bounds"`
+
+	// Hash is the Merkle leaf hash of the chunk.
+	Hash HexBytes `json:"hash"`
+
+	// Path holds the Merkle nodes that are necessary to rebuild the Merkle root from Hash.
+	Path []ProofNode `json:"path"`
+}
+
+// ProofNode is a Merkle node on the path from a chunk's hash to the Merkle root.
+type ProofNode struct {
+	// Side is 0 if Hash needs to be prepended and 1 if it needs to
+	// be appended to the current hash to calculate the composite hash.
+	Side uint8 `json:"side"`
+
+	// Hash is the hash of the Merkle node.
+	Hash HexBytes `json:"hash"`
+}
+
+// MarshalBinary encodes the proof as zlib compressed JSON.
+func (p *Proof) MarshalBinary() ([]byte, error) {
+
+	buf := &bytes.Buffer{}
+	w := zlib.NewWriter(buf)
+
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes the proof from zlib compressed JSON.
+func (p *Proof) UnmarshalBinary(data []byte) error {
+
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return json.NewDecoder(r).Decode(p)
+}
+
+// checkGrid returns ErrProofMismatch unless the chunks of the proof exactly tile the chunk grid of an image
+// with the dimensions of the proof: every chunk of the grid occurs exactly once with its bounds and a Merkle
+// path as long as the Merkle tree is deep. Otherwise the chunks that a proof leaves out would never be verified.
+func (p *Proof) checkGrid() error {
+	cols, rows := 0, 0
+	for _, c := range p.Chunks {
+		if c.Index.X >= cols {
+			cols = c.Index.X + 1
+		}
+		if c.Index.Y >= rows {
+			rows = c.Index.Y + 1
+		}
+	}
+
+	if cols > len(p.Chunks) || rows > len(p.Chunks) || cols*rows != len(p.Chunks) || cols*rows < 2 {
+		return fmt.Errorf("%w: %d chunks don't form a %dx%d chunk grid", ErrProofMismatch, len(p.Chunks), cols, rows)
+	}
+
+	bounds := chunk.ChunkBounds(p.Width, p.Height, cols, rows)
+	depth := chunk.TreeDepth(cols * rows)
+	seen := map[ChunkIndex]bool{}
+	for _, c := range p.Chunks {
+		if c.Index.X < 0 || c.Index.Y < 0 || seen[c.Index] {
+			return fmt.Errorf("%w: chunk %d,%d is missing or duplicated", ErrProofMismatch, c.Index.X, c.Index.Y)
+		}
+		seen[c.Index] = true
+
+		if c.Bounds != bounds[c.Index.X][c.Index.Y] || len(c.Path) != depth {
+			return fmt.Errorf("%w: chunk %d,%d doesn't belong to the chunk grid", ErrProofMismatch, c.Index.X, c.Index.Y)
+		}
+	}
+
+	return nil
+}
+
+// foldPath rebuilds the Merkle root from the given leaf hash and Merkle path with hashes created by newHash.
+// Folding stops early at a node with an invalid side.
+func foldPath(leaf []byte, path []ProofNode, newHash func() hash.Hash) []byte {
+
+	prevHash := leaf
+	for _, node := range path {
+
+		var data []byte
+		if node.Side == 0 {
+			data = append(append([]byte{}, node.Hash...), prevHash...)
+		} else if node.Side == 1 {
+			data = append(append([]byte{}, prevHash...), node.Hash...)
+		} else {
+			break
+		}
+
+		h := newHash()
+		h.Write(data)
+		prevHash = h.Sum(nil)
+	}
+
+	return prevHash
+}
@@ -0,0 +1,275 @@
+package stego
+
+import (
+	"bytes"
+	"encoding/hex"
+	"image"
+)
+
+// Verdict is the final outcome of verifying an image.
+type Verdict int
+
+const (
+	// Intact means all chunks lead to the Merkle root.
+	Intact Verdict = iota
+
+	// Tampered means at least one chunk does not lead to the Merkle root.
+	Tampered
+
+	// Unverifiable means no two chunks lead to the same root hash and none leads to
+	// the expected Merkle root. This is the case if the image was not encoded at all.
+	Unverifiable
+)
+
+// String returns a human readable representation of the verdict.
+func (v Verdict) String() string {
+	switch v {
+	case Intact:
+		return "intact"
+	case Tampered:
+		return "tampered"
+	case Unverifiable:
+		return "unverifiable"
+	default:
+		return "unknown"
+	}
+}
+
+// ChunkIndex holds the index of a chunk in the bounds matrix.
+type ChunkIndex struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// ChunkReport holds the verification result of a single chunk.
+type ChunkReport struct {
+	// Index is the position of the chunk in the chunk grid.
+	Index ChunkIndex
+
+	// Bounds is the region of the image that is covered by the chunk.
+	Bounds image.Rectangle
+
+	// Root is the Merkle root that was rebuilt from the chunk's hash
+	// and the Merkle path embedded in its least significant bits. It is
+	// nil if the encrypted payload of the chunk couldn't be authenticated.
+	Root []byte
+
+	// Match reports whether Root equals the Merkle root of the report.
+	Match bool
+
+	// TamperedRows holds the indexes of the pixel rows of a tampered chunk whose row hash
+	// doesn't match, starting at 0 for the top row of the chunk. It is only set if the image
+	// was encoded with row hashes (see EncodeOptions.RowHashBits).
+	TamperedRows []int
+}
+
+// VerificationReport is the result of verifying an image.
+type VerificationReport struct {
+	// MerkleRoot is the root hash the chunks were judged against.
+	MerkleRoot []byte
+
+	// Expected reports whether MerkleRoot was supplied by the caller
+	// instead of being determined by a majority vote over all chunks.
+	Expected bool
+
+	// Recovered reports whether MerkleRoot was recovered from the metadata that is
+	// distributed across all chunks instead of being determined by a majority vote.
+	// This is possible even if most of the chunks were manipulated.
+	Recovered bool
+
+	// Chunks holds the verification result of every chunk of the image.
+	Chunks []ChunkReport
+
+	// Verdict is the final outcome of the verification.
+	Verdict Verdict
+
+	// Original is the bounds of the encoded image.
+	Original image.Rectangle
+
+	// Region is the region of the encoded image that the verified image covers,
+	// in the coordinates of the encoded image. It differs from Original if the
+	// verified image was cropped. The Bounds of the chunk reports are relative
+	// to the verified image, i.e. to Region.Min.
+	Region image.Rectangle
+
+	// Signature holds the result of verifying the signature over MerkleRoot. It is nil if the image wasn't signed.
+	Signature *SignatureReport
+
+	// message is the message that was hidden in the image (see Message).
+	message []byte
+
+	// messageErr is the reason why no message could be extracted (see Message).
+	messageErr error
+}
+
+// Message returns the message that was hidden in the image (see EncodeOptions.Message). It returns ErrNoMessage
+// if no message was hidden and ErrMessageCorrupted if it can't be extracted intact, e.g. because chunks that carry
+// parts of it don't lead to the Merkle root or were cut off by cropping. Unless the payload was encrypted, the
+// message is unauthenticated: it may have been replaced even if the image is intact.
+func (r *VerificationReport) Message() ([]byte, error) {
+	if r.messageErr != nil {
+		return nil, r.messageErr
+	} else if r.message == nil {
+		return nil, ErrNoMessage
+	}
+	return r.message, nil
+}
+
+// SignatureReport holds the result of verifying the signature over the Merkle root of an image.
+type SignatureReport struct {
+	// Algorithm is the algorithm of the signature. It is 0 if none of the chunks
+	// that lead to the Merkle root carries a readable signature.
+	Algorithm SignatureAlgorithm
+
+	// KeyID identifies the public key the image was signed with (see KeyID).
+	KeyID []byte
+
+	// Signer is the Name of the trusted key that verified the signature. It is empty if Verified is false.
+	Signer string
+
+	// Verified reports whether the signature over the Merkle root was verified with one of the trusted
+	// keys. Only signatures of chunks that lead to the Merkle root are considered.
+	Verified bool
+}
+
+// rootSource denotes where the Merkle root that the chunks of a report are judged against comes from.
+type rootSource int
+
+const (
+	// rootMajority is the root hash that most chunks agree on (or the root hash of a proof).
+	rootMajority rootSource = iota
+
+	// rootExpected is the root hash supplied by the caller (see DecodeOptions.ExpectedRoot).
+	rootExpected
+
+	// rootRecovered is the root hash recovered from the metadata that is distributed across all chunks.
+	rootRecovered
+)
+
+// newVerificationReport judges the given chunks against the given Merkle root
+// and derives the final verdict. Unless the Merkle root was determined by a
+// majority vote, it is trusted even if only a single chunk leads to it.
+func newVerificationReport(merkleRoot []byte, source rootSource, chunks []ChunkReport) *VerificationReport {
+
+	report := &VerificationReport{
+		MerkleRoot: merkleRoot,
+		Expected:   source == rootExpected,
+		Recovered:  source == rootRecovered,
+		Chunks:     chunks,
+		Verdict:    Intact,
+	}
+	trusted := source != rootMajority
+
+	matches := 0
+	for i := range chunks {
+		chunks[i].Match = bytes.Equal(chunks[i].Root, merkleRoot)
+		if chunks[i].Match {
+			matches++
+		} else {
+			report.Verdict = Tampered
+		}
+	}
+
+	// Without at least two chunks agreeing on a root hash there is no
+	// evidence that the image carries any Merkle information at all.
+	if !trusted || matches == 0 {
+		maxCount := 0
+		for _, count := range report.RootCounts() {
+			if count > maxCount {
+				maxCount = count
+			}
+		}
+		if maxCount < 2 {
+			report.Verdict = Unverifiable
+		}
+	}
+
+	return report
+}
+
+// reject judges all chunks as tampered. This is the case if none of the rebuilt root hashes can be trusted.
+// Unless the report is judged against an expected root, the Merkle root of the report is cleared.
+func (r *VerificationReport) reject() {
+	r.Verdict = Tampered
+	if !r.Expected {
+		r.MerkleRoot = nil
+		r.Recovered = false
+	}
+	for i := range r.Chunks {
+		r.Chunks[i].Match = false
+	}
+}
+
+// setTamperedRows sets the tampered rows of every chunk that doesn't lead to the Merkle root. The
+// given slice holds the rows whose row hash doesn't match for every chunk in the order of r.Chunks.
+func (r *VerificationReport) setTamperedRows(rowsByChunk [][]int) {
+	for i := range r.Chunks {
+		if !r.Chunks[i].Match {
+			r.Chunks[i].TamperedRows = rowsByChunk[i]
+		}
+	}
+}
+
+// setSignature verifies the signatures of all chunks that lead to the Merkle root against the given trusted
+// keys and sets the result. The given slice holds the signature of every chunk in the order of r.Chunks.
+func (r *VerificationReport) setSignature(signatures []*Signature, keys []TrustedKey) {
+	matching := []*Signature{}
+	for i := range r.Chunks {
+		if r.Chunks[i].Match {
+			matching = append(matching, signatures[i])
+		}
+	}
+
+	r.Signature = verifySignature(r.MerkleRoot, matching, keys)
+	if r.Signature == nil {
+		r.Signature = &SignatureReport{}
+	}
+}
+
+// Cropped reports whether the verified image covers only a part of the encoded image.
+func (r *VerificationReport) Cropped() bool {
+	return r.Region != r.Original
+}
+
+// Tampered reports whether at least one chunk does not lead to the Merkle root.
+func (r *VerificationReport) Tampered() bool {
+	return r.Verdict == Tampered
+}
+
+// TamperedChunks returns the reports of all chunks that do not lead to the Merkle root.
+func (r *VerificationReport) TamperedChunks() []ChunkReport {
+	chunks := []ChunkReport{}
+	for _, c := range r.Chunks {
+		if !c.Match {
+			chunks = append(chunks, c)
+		}
+	}
+	return chunks
+}
+
+// Grid returns the number of chunks along the width and height of the image.
+func (r *VerificationReport) Grid() (int, int) {
+	cols, rows := 0, 0
+	for _, c := range r.Chunks {
+		if c.Index.X >= cols {
+			cols = c.Index.X + 1
+		}
+		if c.Index.Y >= rows {
+			rows = c.Index.Y + 1
+		}
+	}
+	return cols, rows
+}
+
+// RootCounts maps every hex encoded root hash that was rebuilt from
+// the chunks to the number of chunks that led to it. Chunks without
+// a root hash are left out, so that they never agree on a root.
+func (r *VerificationReport) RootCounts() map[string]int {
+	counts := map[string]int{}
+	for _, c := range r.Chunks {
+		if c.Root != nil {
+			counts[hex.EncodeToString(c.Root)]++
+		}
+	}
+	return counts
+}
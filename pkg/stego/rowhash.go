@@ -0,0 +1,62 @@
+package stego
+
+import (
+	"encoding/binary"
+
+	"dennis-tra/image-stego/internal/chunk"
+)
+
+// rowHashes returns the hashes of all pixel rows of the given chunk truncated to the given number of bits.
+// They are embedded after the Merkle path of every chunk if enabled. As they are not part of the Merkle tree
+// they don't prove anything. They only help to localise modifications within a chunk that is tampered.
+func rowHashes(c *chunk.Chunk, bits int) ([]uint64, error) {
+	hashes := make([]uint64, c.Height())
+	for y := range hashes {
+		hash, err := c.CalculateRowHash(y)
+		if err != nil {
+			return nil, err
+		}
+		hashes[y] = binary.BigEndian.Uint64(hash[:8]) >> uint(64-bits)
+	}
+	return hashes, nil
+}
+
+// writeRowHashes writes the hashes of all pixel rows of the given chunk truncated to the given number
+// of bits to the least significant bits of the chunk.
+func writeRowHashes(c *chunk.Chunk, bits int) error {
+	hashes, err := rowHashes(c, bits)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		if err = c.WriteBits(hash, uint8(bits)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tamperedRows reads the row hashes of the given chunk truncated to the given number of bits from
+// its least significant bits and returns the indexes of the rows whose hash doesn't match anymore.
+func tamperedRows(c *chunk.Chunk, bits int) ([]int, error) {
+	hashes, err := rowHashes(c, bits)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []int{}
+	for y, hash := range hashes {
+		embedded, err := c.ReadBits(uint8(bits))
+		if err != nil {
+			return nil, err
+		}
+
+		if embedded != hash {
+			rows = append(rows, y)
+		}
+	}
+
+	return rows, nil
+}
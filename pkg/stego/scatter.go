@@ -0,0 +1,24 @@
+package stego
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// scatterContext separates the seeds of the LSB permutation from other uses of the secret key.
+const scatterContext = "image-stego scatter"
+
+// scatterSeed derives the seed of the pseudo-random permutation of the LSBs of the chunk at the given
+// index from the given secret key (see chunk.Chunk.Seed). Every chunk is permuted differently, so that
+// the payload positions of one chunk don't reveal those of another.
+func scatterSeed(key []byte, index ChunkIndex) []byte {
+	buf := make([]byte, len(scatterContext)+8)
+	copy(buf, scatterContext)
+	binary.BigEndian.PutUint32(buf[len(scatterContext):], uint32(index.X))
+	binary.BigEndian.PutUint32(buf[len(scatterContext)+4:], uint32(index.Y))
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,52 @@
+package stego
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// ErrSelfCheckFailed is returned by SelfCheck if an encoded image doesn't verify.
+var ErrSelfCheckFailed = errors.New("encoded image failed the self-check")
+
+// SelfCheck decodes the given image, usually the encoded image after it was saved and read again, with the keys
+// of the given options and returns ErrSelfCheckFailed unless it is intact, leads to the Merkle root of encoded
+// and carries the signature and the message of the options. In ModeSidecar and ModePNGChunk the image is
+// verified against the proof of encoded, which should be read back from where it was saved as well.
+// Lossy compression or color conversions that destroy the Merkle tree information fail the self-check.
+func SelfCheck(img image.Image, encoded *Encoded, opts EncodeOptions) error {
+	decodeOpts := DecodeOptions{ExpectedRoot: encoded.MerkleRoot, Key: opts.Key, EncryptionKey: opts.EncryptionKey}
+	if opts.Mode != ModeLSB {
+		decodeOpts.Proof = encoded.Proof
+	}
+	if opts.Signer != nil {
+		decodeOpts.TrustedKeys = []TrustedKey{{Name: "signer", PublicKey: opts.Signer.Public()}}
+	}
+
+	report, err := Decode(img, decodeOpts)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSelfCheckFailed, err)
+	}
+
+	if report.Verdict != Intact || !bytes.Equal(report.MerkleRoot, encoded.MerkleRoot) {
+		return fmt.Errorf("%w: the image is %s with %d of %d chunks not leading to the Merkle root",
+			ErrSelfCheckFailed, report.Verdict, len(report.TamperedChunks()), len(report.Chunks))
+	}
+
+	if opts.Signer != nil && (report.Signature == nil || !report.Signature.Verified) {
+		return fmt.Errorf("%w: the signature of the Merkle root doesn't verify", ErrSelfCheckFailed)
+	}
+
+	if opts.Message != nil {
+		message, err := report.Message()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrSelfCheckFailed, err)
+		}
+		if !bytes.Equal(message, opts.Message) {
+			return fmt.Errorf("%w: the hidden message differs", ErrSelfCheckFailed)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package stego
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"dennis-tra/image-stego/internal/chunk"
+)
+
+// SignatureAlgorithm identifies the algorithm of the signature over the Merkle root.
+type SignatureAlgorithm uint8
+
+const (
+	// Ed25519 signs the Merkle root with Ed25519 as defined in RFC 8032.
+	Ed25519 SignatureAlgorithm = iota + 1
+
+	// ECDSAP256 signs the SHA-256 hash of the Merkle root with ECDSA on the NIST P-256 curve.
+	ECDSAP256
+)
+
+// String returns a human readable representation of the signature algorithm.
+func (a SignatureAlgorithm) String() string {
+	switch a {
+	case Ed25519:
+		return "ed25519"
+	case ECDSAP256:
+		return "ecdsa-p256"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText encodes the signature algorithm as its string representation.
+func (a SignatureAlgorithm) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText decodes the signature algorithm from its string representation.
+func (a *SignatureAlgorithm) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "ed25519":
+		*a = Ed25519
+	case "ecdsa-p256":
+		*a = ECDSAP256
+	default:
+		return fmt.Errorf("unknown signature algorithm %q", text)
+	}
+	return nil
+}
+
+// KeyIDLength is the number of bytes of a key identifier (see KeyID).
+const KeyIDLength = 8
+
+// signatureLength is the number of bytes of an Ed25519 signature and of an ECDSA P-256
+// signature whose r and s values are each padded to 32 bytes.
+const signatureLength = 64
+
+// signatureBitLength is the number of bits occupied by a Signature in the least significant bits of a chunk.
+const signatureBitLength = (1 + KeyIDLength + signatureLength) * chunk.BitsPerByte
+
+// ErrUnsupportedSigner is returned if an image should be signed with a key other than Ed25519 or ECDSA P-256.
+var ErrUnsupportedSigner = errors.New("unsupported signer")
+
+// KeyID returns the identifier of the given public key that is embedded alongside every signature. It consists
+// of the first KeyIDLength bytes of the SHA-256 hash of the PKIX, ASN.1 DER form of the public key.
+func KeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(der)
+	return sum[:KeyIDLength], nil
+}
+
+// TrustedKey is a public key whose signatures Decode trusts.
+type TrustedKey struct {
+	// Name identifies the owner of the key in the SignatureReport, e.g. the file name of the key.
+	Name string
+
+	// PublicKey is an ed25519.PublicKey or an *ecdsa.PublicKey on the P-256 curve.
+	PublicKey crypto.PublicKey
+}
+
+// Signature is a signature over the Merkle root of an image. In ModeLSB it is embedded
+// into every chunk right after the Merkle path, otherwise it is part of the Proof.
+type Signature struct {
+	// Algorithm is the algorithm of the signature.
+	Algorithm SignatureAlgorithm `json:"algorithm"`
+
+	// KeyID identifies the public key that verifies the signature (see KeyID).
+	KeyID HexBytes `json:"key_id"`
+
+	// Value is the signature itself. ECDSA signatures consist of the r and s values, each padded to 32 bytes.
+	Value HexBytes `json:"value"`
+}
+
+// sign signs the given Merkle root with the given signer, which must hold an Ed25519 or ECDSA P-256 private key.
+func sign(signer crypto.Signer, root []byte) (*Signature, error) {
+
+	keyID, err := KeyID(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	switch pub := signer.Public().(type) {
+	case ed25519.PublicKey:
+		value, err := signer.Sign(rand.Reader, root, crypto.Hash(0))
+		if err != nil {
+			return nil, err
+		}
+		return &Signature{Algorithm: Ed25519, KeyID: keyID, Value: value}, nil
+
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%w: ECDSA curve %s", ErrUnsupportedSigner, pub.Curve.Params().Name)
+		}
+
+		digest := sha256.Sum256(root)
+		der, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+
+		var rs struct{ R, S *big.Int }
+		if _, err = asn1.Unmarshal(der, &rs); err != nil {
+			return nil, err
+		}
+
+		// r and s are right-aligned in their halves of the signature value
+		value := make([]byte, signatureLength)
+		r, sVal := rs.R.Bytes(), rs.S.Bytes()
+		copy(value[signatureLength/2-len(r):signatureLength/2], r)
+		copy(value[signatureLength-len(sVal):], sVal)
+		return &Signature{Algorithm: ECDSAP256, KeyID: keyID, Value: value}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: key type %T", ErrUnsupportedSigner, pub)
+	}
+}
+
+// Verify reports whether the signature over the given Merkle root was created by the private key of the given
+// public key. The key identifier of the signature isn't considered.
+func (s *Signature) Verify(pub crypto.PublicKey, root []byte) bool {
+	if len(s.Value) != signatureLength {
+		return false
+	}
+
+	switch s.Algorithm {
+	case Ed25519:
+		edPub, ok := pub.(ed25519.PublicKey)
+		return ok && ed25519.Verify(edPub, root, s.Value)
+
+	case ECDSAP256:
+		ecPub, ok := pub.(*ecdsa.PublicKey)
+		if !ok || ecPub.Curve != elliptic.P256() {
+			return false
+		}
+
+		digest := sha256.Sum256(root)
+		r := new(big.Int).SetBytes(s.Value[:signatureLength/2])
+		sVal := new(big.Int).SetBytes(s.Value[signatureLength/2:])
+		return ecdsa.Verify(ecPub, digest[:], r, sVal)
+
+	default:
+		return false
+	}
+}
+
+// MarshalBinary encodes the signature into its binary representation: the algorithm (1 byte),
+// the key identifier (KeyIDLength bytes) and the signature value (64 bytes).
+func (s *Signature) MarshalBinary() ([]byte, error) {
+	if len(s.KeyID) != KeyIDLength || len(s.Value) != signatureLength {
+		return nil, fmt.Errorf("invalid signature length")
+	}
+
+	buf := []byte{byte(s.Algorithm)}
+	buf = append(buf, s.KeyID...)
+	return append(buf, s.Value...), nil
+}
+
+// UnmarshalBinary decodes the signature from its binary representation.
+func (s *Signature) UnmarshalBinary(data []byte) error {
+	if len(data) != signatureBitLength/chunk.BitsPerByte {
+		return fmt.Errorf("invalid signature length %d", len(data))
+	}
+
+	*s = Signature{
+		Algorithm: SignatureAlgorithm(data[0]),
+		KeyID:     append(HexBytes{}, data[1:1+KeyIDLength]...),
+		Value:     append(HexBytes{}, data[1+KeyIDLength:]...),
+	}
+
+	return nil
+}
+
+// verifySignature checks the given signatures over the given Merkle root against the given trusted keys
+// and returns the result for the first signature that is verified. If none is verified the result for the
+// first signature is returned. It returns nil if there are no signatures.
+func verifySignature(root []byte, signatures []*Signature, keys []TrustedKey) *SignatureReport {
+
+	var report *SignatureReport
+	tried := map[string]bool{}
+	for _, s := range signatures {
+		// Usually all chunks carry the same signature, so every distinct one is only checked once
+		if s == nil || tried[string(s.KeyID)+string(s.Value)] {
+			continue
+		}
+		tried[string(s.KeyID)+string(s.Value)] = true
+
+		if report == nil {
+			report = &SignatureReport{Algorithm: s.Algorithm, KeyID: s.KeyID}
+		}
+
+		for _, key := range keys {
+			keyID, err := KeyID(key.PublicKey)
+			if err != nil || !bytes.Equal(keyID, s.KeyID) || !s.Verify(key.PublicKey, root) {
+				continue
+			}
+
+			return &SignatureReport{Algorithm: s.Algorithm, KeyID: s.KeyID, Signer: key.Name, Verified: true}
+		}
+	}
+
+	return report
+}
+
+// writeSignature writes the given signature to the least significant bits of the given chunk.
+func writeSignature(c *chunk.Chunk, s *Signature) error {
+	buf, err := s.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Write(buf)
+	return err
+}
+
+// readSignature reads a signature from the least significant bits of the given chunk.
+func readSignature(c *chunk.Chunk) (*Signature, error) {
+	buf := make([]byte, signatureBitLength/chunk.BitsPerByte)
+	if _, err := c.Read(buf); err != nil {
+		return nil, err
+	}
+
+	s := &Signature{}
+	if err := s.UnmarshalBinary(buf); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
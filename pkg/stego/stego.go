@@ -0,0 +1,6 @@
+// Package stego embeds Merkle tree nodes into the least significant bits of image
+// chunks so that each chunk's integrity can be verified on its own.
+//
+// All functions operate on image.Image values only. They neither write files
+// nor log, which makes the package suitable to be embedded into other services.
+package stego
@@ -0,0 +1,1602 @@
+package stego
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"dennis-tra/image-stego/internal/chunk"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// noiseImage creates an opaque NRGBA image with the given width and height
+// where all pixels have random colors.
+func noiseImage(w, h int) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(int64(w * h)))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		if (i+1)%4 == 0 {
+			img.Pix[i] = 255
+		} else {
+			img.Pix[i] = uint8(rnd.Intn(256))
+		}
+	}
+	return img
+}
+
+// tamper paints the given region of img black.
+func tamper(img draw.Image, r image.Rectangle) {
+	for x := r.Min.X; x < r.Max.X; x++ {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			img.Set(x, y, color.NRGBA{A: 255})
+		}
+	}
+}
+
+func TestEncode_DoesNotAlterInput(t *testing.T) {
+	img := noiseImage(200, 150)
+	orig := append([]byte{}, img.Pix...)
+
+	_, err := Encode(img, EncodeOptions{})
+	require.NoError(t, err)
+
+	assert.True(t, bytes.Equal(orig, img.Pix))
+}
+
+func TestEncodeDecode_Intact(t *testing.T) {
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{})
+	require.NoError(t, err)
+
+	report, err := Decode(encoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, Intact, report.Verdict)
+	assert.Empty(t, report.TamperedChunks())
+	assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+
+	i := 0
+	for x, boundsRow := range encoded.Bounds {
+		for y, bound := range boundsRow {
+			c := report.Chunks[i]
+			assert.Equal(t, ChunkIndex{x, y}, c.Index)
+			assert.Equal(t, bound, c.Bounds)
+			assert.Equal(t, encoded.MerkleRoot, c.Root)
+			assert.True(t, c.Match)
+			i++
+		}
+	}
+	assert.Len(t, report.Chunks, i)
+}
+
+func TestEncodeDecode_Tampered(t *testing.T) {
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{})
+	require.NoError(t, err)
+
+	tampered := encoded.Bounds[1][2]
+	tamper(encoded.Image, image.Rect(0, 0, 2, 2).Add(tampered.Min))
+
+	report, err := Decode(encoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, Tampered, report.Verdict)
+	assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+
+	tamperedChunks := report.TamperedChunks()
+	require.Len(t, tamperedChunks, 1)
+	assert.Equal(t, ChunkIndex{1, 2}, tamperedChunks[0].Index)
+	assert.Equal(t, tampered, tamperedChunks[0].Bounds)
+	assert.False(t, tamperedChunks[0].Match)
+	assert.NotEqual(t, encoded.MerkleRoot, tamperedChunks[0].Root)
+}
+
+func TestDecode_ExpectedRoot(t *testing.T) {
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{})
+	require.NoError(t, err)
+
+	report, err := Decode(encoded.Image, DecodeOptions{ExpectedRoot: encoded.MerkleRoot})
+	require.NoError(t, err)
+
+	assert.Equal(t, Intact, report.Verdict)
+	assert.True(t, report.Expected)
+	assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+}
+
+func TestDecode_ExpectedRootReencoded(t *testing.T) {
+	img := noiseImage(200, 150)
+
+	encoded, err := Encode(img, EncodeOptions{})
+	require.NoError(t, err)
+
+	// An adversary manipulates the image and encodes it again
+	tamper(img, image.Rect(0, 0, 2, 2))
+	reencoded, err := Encode(img, EncodeOptions{})
+	require.NoError(t, err)
+
+	report, err := Decode(reencoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+
+	report, err = Decode(reencoded.Image, DecodeOptions{ExpectedRoot: encoded.MerkleRoot})
+	require.NoError(t, err)
+	assert.Equal(t, Tampered, report.Verdict)
+	assert.Len(t, report.TamperedChunks(), len(report.Chunks))
+}
+
+func TestDecode_NotEncoded(t *testing.T) {
+	_, err := Decode(image.NewNRGBA(image.Rect(0, 0, 200, 150)), DecodeOptions{})
+	assert.Equal(t, ErrNotEncoded, err)
+}
+
+func TestDecode_Unverifiable(t *testing.T) {
+	img := noiseImage(200, 150)
+
+	encoded, err := Encode(img, EncodeOptions{})
+	require.NoError(t, err)
+
+	// Give the image a valid chunk header and locator without any Merkle tree information
+	copy(img.Pix[:4*chunk.MinChunkWidth(chunk.AllChannels, DefaultChannels, 1)], encoded.Image.(*image.NRGBA).Pix)
+
+	report, err := Decode(img, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, Unverifiable, report.Verdict)
+
+	report, err = Decode(img, DecodeOptions{ExpectedRoot: encoded.MerkleRoot})
+	require.NoError(t, err)
+	assert.Equal(t, Unverifiable, report.Verdict)
+}
+
+func TestEncodeDecode_Sidecar(t *testing.T) {
+	img := noiseImage(200, 150)
+
+	encoded, err := Encode(img, EncodeOptions{Mode: ModeSidecar})
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(img.Pix, encoded.Image.(*image.NRGBA).Pix))
+
+	report, err := Decode(img, DecodeOptions{Proof: encoded.Proof})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+	assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+
+	// Flipping a single least significant bit is detected as all bits are considered
+	tampered := encoded.Proof.Chunks[3].Bounds
+	img.Pix[img.PixOffset(tampered.Min.X, tampered.Min.Y)] ^= 1
+
+	report, err = Decode(img, DecodeOptions{Proof: encoded.Proof})
+	require.NoError(t, err)
+	assert.Equal(t, Tampered, report.Verdict)
+
+	tamperedChunks := report.TamperedChunks()
+	require.Len(t, tamperedChunks, 1)
+	assert.Equal(t, encoded.Proof.Chunks[3].Index, tamperedChunks[0].Index)
+}
+
+func TestDecode_ProofMismatch(t *testing.T) {
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{Mode: ModeSidecar})
+	require.NoError(t, err)
+
+	_, err = Decode(noiseImage(150, 200), DecodeOptions{Proof: encoded.Proof})
+	assert.Equal(t, ErrProofMismatch, err)
+}
+
+func TestDecode_ProofIncomplete(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(chunks []ProofChunk) []ProofChunk
+	}{
+		{"dropped", func(chunks []ProofChunk) []ProofChunk { return append(chunks[:3], chunks[4:]...) }},
+		{"duplicated", func(chunks []ProofChunk) []ProofChunk { chunks[3] = chunks[4]; return chunks }},
+		{"appended", func(chunks []ProofChunk) []ProofChunk { return append(chunks, chunks[0]) }},
+		{"short path", func(chunks []ProofChunk) []ProofChunk { chunks[3].Path = chunks[3].Path[1:]; return chunks }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := noiseImage(200, 150)
+			encoded, err := Encode(img, EncodeOptions{Mode: ModeSidecar})
+			require.NoError(t, err)
+			require.Greater(t, len(encoded.Proof.Chunks), 4)
+
+			// The chunk that is left out of the proof is tampered with
+			tamper(img, encoded.Proof.Chunks[3].Bounds)
+			encoded.Proof.Chunks = tt.modify(encoded.Proof.Chunks)
+
+			_, err = Decode(img, DecodeOptions{Proof: encoded.Proof, ExpectedRoot: encoded.MerkleRoot})
+			assert.True(t, errors.Is(err, ErrProofMismatch))
+		})
+	}
+}
+
+func TestProof_JSON(t *testing.T) {
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{Mode: ModeSidecar})
+	require.NoError(t, err)
+
+	data, err := json.Marshal(encoded.Proof)
+	require.NoError(t, err)
+
+	proof := &Proof{}
+	require.NoError(t, json.Unmarshal(data, proof))
+	assert.Equal(t, encoded.Proof, proof)
+}
+
+func TestWriteReadPNGProof(t *testing.T) {
+	img := noiseImage(200, 150)
+
+	encoded, err := Encode(img, EncodeOptions{Mode: ModePNGChunk})
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WritePNG(buf, encoded.Image, encoded.Proof))
+
+	decoded, err := png.Decode(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	proof, err := ReadPNGProof(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, encoded.Proof, proof)
+
+	report, err := Decode(decoded, DecodeOptions{Proof: proof})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+}
+
+func TestReadPNGProof_NoProof(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, WritePNG(buf, noiseImage(20, 20), nil))
+
+	_, err := ReadPNGProof(buf)
+	assert.Equal(t, ErrNoProof, err)
+}
+
+func TestEncodeDecode_Channels(t *testing.T) {
+	for _, channels := range []Channels{ChannelR, ChannelA, ChannelG | ChannelB | ChannelA} {
+		t.Run(channels.String(), func(t *testing.T) {
+			encoded, err := Encode(noiseImage(200, 150), EncodeOptions{Channels: channels})
+			require.NoError(t, err)
+
+			// The encoded image survives a round trip through a PNG file
+			buf := &bytes.Buffer{}
+			require.NoError(t, png.Encode(buf, encoded.Image))
+			decoded, err := png.Decode(buf)
+			require.NoError(t, err)
+
+			report, err := Decode(decoded, DecodeOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, Intact, report.Verdict)
+			assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+			assert.Len(t, report.Chunks, len(encoded.Bounds)*len(encoded.Bounds[0]))
+		})
+	}
+}
+
+func TestEncode_InvalidChannels(t *testing.T) {
+	_, err := Encode(noiseImage(200, 150), EncodeOptions{Channels: 1 << 5})
+	assert.Error(t, err)
+}
+
+func TestEncodeDecode_Planes(t *testing.T) {
+	chunkCount := 0
+	for planes := 1; planes <= MaxPlanes; planes++ {
+		t.Run(fmt.Sprintf("%d planes", planes), func(t *testing.T) {
+			img := noiseImage(200, 150)
+			encoded, err := Encode(img, EncodeOptions{Channels: ChannelR | ChannelA, Planes: planes})
+			require.NoError(t, err)
+
+			// More planes yield a finer chunk grid
+			count := len(encoded.Bounds) * len(encoded.Bounds[0])
+			assert.GreaterOrEqual(t, count, chunkCount)
+			chunkCount = count
+
+			report, err := Decode(encoded.Image, DecodeOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, Intact, report.Verdict)
+			assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+
+			// Changes to the bits above the payload planes are detected
+			encoded.Image.(*image.NRGBA).Pix[len(encoded.Image.(*image.NRGBA).Pix)-4] ^= 1 << uint(planes)
+			report, err = Decode(encoded.Image, DecodeOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, Tampered, report.Verdict)
+			assert.Len(t, report.TamperedChunks(), 1)
+		})
+	}
+}
+
+func TestDecode_ProofEmbeddingConfig(t *testing.T) {
+	// A transparent border whose color is discarded by premultiplying alpha
+	transparentImg := noiseImage(300, 200)
+	for y := 0; y < transparentImg.Bounds().Dy(); y++ {
+		for x := 0; x < 20; x++ {
+			transparentImg.Pix[transparentImg.PixOffset(x, y)+3] = 0
+		}
+	}
+
+	tests := map[string]struct {
+		img  *image.NRGBA
+		opts EncodeOptions
+	}{
+		"channels":    {img: noiseImage(200, 150), opts: EncodeOptions{Channels: ChannelR | ChannelA, Planes: 2}},
+		"scattered":   {img: noiseImage(200, 150), opts: EncodeOptions{Planes: 3, Key: []byte("key"), Scatter: true}},
+		"encrypted":   {img: noiseImage(200, 150), opts: EncodeOptions{Channels: ChannelG, EncryptionKey: []byte("secret")}},
+		"transparent": {img: transparentImg, opts: EncodeOptions{SkipTransparent: true}},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := Encode(tt.img, tt.opts)
+			require.NoError(t, err)
+
+			data, err := encoded.Proof.MarshalBinary()
+			require.NoError(t, err)
+			proof := &Proof{}
+			require.NoError(t, proof.UnmarshalBinary(data))
+
+			report, err := Decode(encoded.Image, DecodeOptions{Proof: proof, Key: tt.opts.Key})
+			require.NoError(t, err)
+			assert.Equal(t, Intact, report.Verdict)
+			assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+
+			// Changes to the bits above the payload planes are detected
+			img := chunk.ImageToNRGBA(encoded.Image)
+			img.Pix[img.PixOffset(img.Bounds().Dx()-1, img.Bounds().Dy()-1)] ^= 1 << 3
+			report, err = Decode(img, DecodeOptions{Proof: proof, Key: tt.opts.Key})
+			require.NoError(t, err)
+			assert.Equal(t, Tampered, report.Verdict)
+			assert.Len(t, report.TamperedChunks(), 1)
+		})
+	}
+
+	// The embedding configuration of ModeLSB is rejected in other modes
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{Mode: ModeSidecar})
+	require.NoError(t, err)
+	encoded.Proof.Planes = 2
+	_, err = Decode(encoded.Image, DecodeOptions{Proof: encoded.Proof})
+	assert.Error(t, err)
+}
+
+func TestEncode_InvalidPlanes(t *testing.T) {
+	for _, planes := range []int{-1, MaxPlanes + 1} {
+		_, err := Encode(noiseImage(200, 150), EncodeOptions{Planes: planes})
+		assert.Error(t, err)
+	}
+}
+
+func TestHeader_MarshalBinary(t *testing.T) {
+	h := header{
+		version:     FormatVersion,
+		hashAlg:     BLAKE3,
+		channels:    ChannelG | ChannelA,
+		planes:      3,
+		cols:        300,
+		rows:        2,
+		flags:       flagKeyed | flagSigned | flagScattered | flagEncrypted | flagMessage,
+		rowHashBits: 12,
+		hashBits:    96,
+		cipher:      ChaCha20Poly1305,
+		kdf:         Scrypt,
+	}
+
+	data, err := h.MarshalBinary()
+	require.NoError(t, err)
+	assert.Len(t, data, chunk.HeaderBitLength/chunk.BitsPerByte)
+
+	parsed := header{}
+	require.NoError(t, parsed.UnmarshalBinary(data))
+	assert.Equal(t, h, parsed)
+
+	data[0] ^= 1
+	assert.Equal(t, ErrNotEncoded, parsed.UnmarshalBinary(data))
+}
+
+func TestDecode_UnsupportedFormat(t *testing.T) {
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{})
+	require.NoError(t, err)
+
+	// Overwrite the header of the top left chunk with a header of a future version
+	h := header{
+		version:  FormatVersion + 1,
+		hashAlg:  SHA256,
+		channels: DefaultChannels,
+		planes:   1,
+		cols:     len(encoded.Bounds),
+		rows:     len(encoded.Bounds[0]),
+	}
+	c := &chunk.Chunk{Pixels: chunk.NRGBA{NRGBA: encoded.Image.(*image.NRGBA).SubImage(encoded.Bounds[0][0]).(*image.NRGBA)}}
+	require.NoError(t, writeHeader(c, h))
+
+	_, err = Decode(encoded.Image, DecodeOptions{})
+	assert.True(t, errors.Is(err, ErrUnsupportedFormat))
+}
+
+func TestEncode_ImageTooSmall(t *testing.T) {
+	_, err := Encode(noiseImage(10, 10), EncodeOptions{})
+	assert.Equal(t, ErrImageTooSmall, err)
+}
+
+func TestDecode_Cropped(t *testing.T) {
+	encoded, err := Encode(noiseImage(400, 300), EncodeOptions{})
+	require.NoError(t, err)
+
+	for _, crop := range []image.Rectangle{
+		image.Rect(0, 0, 310, 220),
+		image.Rect(37, 23, 301, 250),
+		image.Rect(120, 80, 400, 300),
+	} {
+		t.Run(crop.String(), func(t *testing.T) {
+			cropped := chunk.ImageToNRGBA(encoded.Image.(*image.NRGBA).SubImage(crop))
+
+			report, err := Decode(cropped, DecodeOptions{ExpectedRoot: encoded.MerkleRoot})
+			require.NoError(t, err)
+			assert.Equal(t, Intact, report.Verdict)
+			assert.True(t, report.Cropped())
+			assert.Equal(t, encoded.Image.Bounds(), report.Original)
+			assert.Equal(t, crop, report.Region)
+
+			// Exactly the chunks that lie completely within the crop are verified
+			want := 0
+			for _, boundRow := range encoded.Bounds {
+				for _, bound := range boundRow {
+					if bound.In(crop) {
+						want++
+					}
+				}
+			}
+			assert.Len(t, report.Chunks, want)
+			for _, c := range report.Chunks {
+				assert.Equal(t, encoded.Bounds[c.Index.X][c.Index.Y], c.Bounds.Add(crop.Min))
+			}
+
+			// Tampering is still localised
+			target := report.Chunks[len(report.Chunks)-1]
+			tamper(cropped, target.Bounds.Inset(2))
+
+			report, err = Decode(cropped, DecodeOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, Tampered, report.Verdict)
+			require.Len(t, report.TamperedChunks(), 1)
+			assert.Equal(t, target.Index, report.TamperedChunks()[0].Index)
+		})
+	}
+}
+
+func TestDecode_TopLeftHeaderTampered(t *testing.T) {
+	encoded, err := Encode(noiseImage(400, 300), EncodeOptions{})
+	require.NoError(t, err)
+
+	// Destroy the header of the top left chunk. The chunk grid is restored from the other chunks.
+	tamper(encoded.Image, image.Rect(0, 0, chunk.HeaderPixels, 1))
+
+	report, err := Decode(encoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, Tampered, report.Verdict)
+	assert.False(t, report.Cropped())
+	require.Len(t, report.TamperedChunks(), 1)
+	assert.Equal(t, ChunkIndex{0, 0}, report.TamperedChunks()[0].Index)
+}
+
+func TestDecode_TamperedRows(t *testing.T) {
+	encoded, err := Encode(noiseImage(400, 300), EncodeOptions{RowHashBits: 16})
+	require.NoError(t, err)
+
+	report, err := Decode(encoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+
+	bound := encoded.Bounds[1][1]
+	tamper(encoded.Image, image.Rect(bound.Min.X+10, bound.Min.Y+5, bound.Min.X+20, bound.Min.Y+8))
+
+	report, err = Decode(encoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, Tampered, report.Verdict)
+	require.Len(t, report.TamperedChunks(), 1)
+	assert.Equal(t, []int{5, 6, 7}, report.TamperedChunks()[0].TamperedRows)
+
+	// Intact chunks don't report any rows
+	for _, c := range report.Chunks {
+		if c.Match {
+			assert.Nil(t, c.TamperedRows)
+		}
+	}
+}
+
+func TestEncode_InvalidRowHashBits(t *testing.T) {
+	for _, bits := range []int{-1, MaxRowHashBits + 1} {
+		_, err := Encode(noiseImage(200, 150), EncodeOptions{RowHashBits: bits})
+		assert.Error(t, err)
+	}
+
+	for _, mode := range []Mode{ModeSidecar, ModePNGChunk} {
+		_, err := Encode(noiseImage(200, 150), EncodeOptions{Mode: mode, RowHashBits: 8})
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+	}
+}
+
+func TestEncodeDecode_HashAlgorithms(t *testing.T) {
+	for _, hashAlg := range []HashAlgorithm{SHA256, SHA512_256, SHA3_256, BLAKE2b256, BLAKE3} {
+		t.Run(hashAlg.String(), func(t *testing.T) {
+			encoded, err := Encode(noiseImage(200, 150), EncodeOptions{HashAlgorithm: hashAlg, HashBits: 128})
+			require.NoError(t, err)
+			assert.Len(t, encoded.MerkleRoot, 16)
+
+			report, err := Decode(encoded.Image, DecodeOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, Intact, report.Verdict)
+			assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+
+			tamper(encoded.Image, encoded.Bounds[1][0].Inset(2))
+			report, err = Decode(encoded.Image, DecodeOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, Tampered, report.Verdict)
+			require.Len(t, report.TamperedChunks(), 1)
+			assert.Equal(t, ChunkIndex{1, 0}, report.TamperedChunks()[0].Index)
+		})
+	}
+}
+
+func TestEncode_HashAlgorithmsDiffer(t *testing.T) {
+	img := noiseImage(200, 150)
+
+	roots := map[string]bool{}
+	for _, hashAlg := range []HashAlgorithm{SHA256, SHA512_256, SHA3_256, BLAKE2b256, BLAKE3} {
+		encoded, err := Encode(img, EncodeOptions{HashAlgorithm: hashAlg})
+		require.NoError(t, err)
+		roots[string(encoded.MerkleRoot)] = true
+	}
+	assert.Len(t, roots, 5)
+}
+
+func TestEncode_TruncatedHashFinerGrid(t *testing.T) {
+	// The chunks of wide and flat images are limited by their capacity rather than their minimum width
+	img := noiseImage(600, 60)
+
+	full, err := Encode(img, EncodeOptions{})
+	require.NoError(t, err)
+
+	truncated, err := Encode(img, EncodeOptions{HashBits: MinHashBits})
+	require.NoError(t, err)
+
+	assert.Greater(t, len(truncated.Bounds)*len(truncated.Bounds[0]), len(full.Bounds)*len(full.Bounds[0]))
+}
+
+func TestEncodeDecode_SidecarHashAlgorithm(t *testing.T) {
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{Mode: ModeSidecar, HashAlgorithm: SHA3_256, HashBits: 64})
+	require.NoError(t, err)
+
+	data, err := encoded.Proof.MarshalBinary()
+	require.NoError(t, err)
+
+	proof := &Proof{}
+	require.NoError(t, proof.UnmarshalBinary(data))
+	assert.Equal(t, SHA3_256, proof.HashAlgorithm)
+	assert.Equal(t, 64, proof.HashBits)
+
+	report, err := Decode(encoded.Image, DecodeOptions{Proof: proof})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+	assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+}
+
+func TestDecode_UnsupportedProofVersion(t *testing.T) {
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{Mode: ModeSidecar})
+	require.NoError(t, err)
+
+	encoded.Proof.Version = ProofVersion + 1
+	_, err = Decode(encoded.Image, DecodeOptions{Proof: encoded.Proof})
+	assert.Error(t, err)
+}
+
+func TestEncode_InvalidHash(t *testing.T) {
+	for _, opts := range []EncodeOptions{
+		{HashAlgorithm: 42},
+		{HashBits: MinHashBits - 8},
+		{HashBits: MaxHashBits + 8},
+		{HashBits: 100},
+	} {
+		_, err := Encode(noiseImage(200, 150), opts)
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+	}
+}
+
+func TestEncodeDecode_Keyed(t *testing.T) {
+	for _, hashAlg := range []HashAlgorithm{SHA256, BLAKE2b256, BLAKE3} {
+		t.Run(hashAlg.String(), func(t *testing.T) {
+			key := []byte("secret")
+			encoded, err := Encode(noiseImage(200, 150), EncodeOptions{HashAlgorithm: hashAlg, Key: key})
+			require.NoError(t, err)
+
+			_, err = Decode(encoded.Image, DecodeOptions{})
+			assert.Equal(t, ErrKeyRequired, err)
+
+			report, err := Decode(encoded.Image, DecodeOptions{Key: key})
+			require.NoError(t, err)
+			assert.Equal(t, Intact, report.Verdict)
+			assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+
+			report, err = Decode(encoded.Image, DecodeOptions{Key: []byte("wrong")})
+			require.NoError(t, err)
+			assert.Equal(t, Tampered, report.Verdict)
+		})
+	}
+}
+
+func TestDecode_KeyedReencoded(t *testing.T) {
+	key := []byte("secret")
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{Key: key})
+	require.NoError(t, err)
+
+	// An attacker tampers with the image and encodes it again without knowing the key
+	tamper(encoded.Image, encoded.Bounds[0][0].Inset(2))
+	for _, attackerKey := range [][]byte{nil, []byte("guess")} {
+		reencoded, err := Encode(encoded.Image, EncodeOptions{Key: attackerKey})
+		require.NoError(t, err)
+
+		report, err := Decode(reencoded.Image, DecodeOptions{Key: key})
+		require.NoError(t, err)
+		assert.Equal(t, Tampered, report.Verdict)
+		assert.Len(t, report.TamperedChunks(), len(report.Chunks))
+	}
+}
+
+func TestEncodeDecode_SidecarKeyed(t *testing.T) {
+	key := []byte("secret")
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{Mode: ModeSidecar, Key: key})
+	require.NoError(t, err)
+	assert.True(t, encoded.Proof.Keyed)
+
+	_, err = Decode(encoded.Image, DecodeOptions{Proof: encoded.Proof})
+	assert.Equal(t, ErrKeyRequired, err)
+
+	report, err := Decode(encoded.Image, DecodeOptions{Proof: encoded.Proof, Key: key})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+
+	// The proof of an image that was encoded again without the key doesn't hold up
+	reencoded, err := Encode(encoded.Image, EncodeOptions{Mode: ModeSidecar})
+	require.NoError(t, err)
+
+	report, err = Decode(reencoded.Image, DecodeOptions{Proof: reencoded.Proof, Key: key})
+	require.NoError(t, err)
+	assert.Equal(t, Tampered, report.Verdict)
+}
+
+func TestEncodeDecode_Signed(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(crand.Reader)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	require.NoError(t, err)
+
+	other, _, err := ed25519.GenerateKey(crand.Reader)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		signer crypto.Signer
+		alg    SignatureAlgorithm
+	}{
+		{edKey, Ed25519},
+		{ecKey, ECDSAP256},
+	} {
+		t.Run(tt.alg.String(), func(t *testing.T) {
+			encoded, err := Encode(noiseImage(300, 200), EncodeOptions{Signer: tt.signer})
+			require.NoError(t, err)
+			require.NotNil(t, encoded.Proof.Signature)
+			assert.True(t, encoded.Proof.Signature.Verify(tt.signer.Public(), encoded.MerkleRoot))
+
+			keyID, err := KeyID(tt.signer.Public())
+			require.NoError(t, err)
+
+			trusted := []TrustedKey{{Name: "other", PublicKey: other}, {Name: "signer", PublicKey: tt.signer.Public()}}
+
+			// A tampered chunk doesn't prevent the verification of the signature
+			tamper(encoded.Image, encoded.Bounds[0][0].Inset(2))
+
+			report, err := Decode(encoded.Image, DecodeOptions{TrustedKeys: trusted})
+			require.NoError(t, err)
+			assert.Equal(t, Tampered, report.Verdict)
+			require.NotNil(t, report.Signature)
+			assert.True(t, report.Signature.Verified)
+			assert.Equal(t, "signer", report.Signature.Signer)
+			assert.Equal(t, tt.alg, report.Signature.Algorithm)
+			assert.Equal(t, keyID, report.Signature.KeyID)
+
+			// Without the public key of the signer the signature can't be verified
+			report, err = Decode(encoded.Image, DecodeOptions{TrustedKeys: trusted[:1]})
+			require.NoError(t, err)
+			require.NotNil(t, report.Signature)
+			assert.False(t, report.Signature.Verified)
+			assert.Empty(t, report.Signature.Signer)
+			assert.Equal(t, keyID, report.Signature.KeyID)
+		})
+	}
+}
+
+func TestDecode_NotSigned(t *testing.T) {
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{})
+	require.NoError(t, err)
+
+	report, err := Decode(encoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, report.Signature)
+}
+
+func TestDecode_SignedReencoded(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(crand.Reader)
+	require.NoError(t, err)
+
+	_, attackerKey, err := ed25519.GenerateKey(crand.Reader)
+	require.NoError(t, err)
+
+	encoded, err := Encode(noiseImage(300, 200), EncodeOptions{Signer: key})
+	require.NoError(t, err)
+
+	// An attacker tampers with the image and signs it again with their own key
+	tamper(encoded.Image, encoded.Bounds[0][0].Inset(2))
+	reencoded, err := Encode(encoded.Image, EncodeOptions{Signer: attackerKey})
+	require.NoError(t, err)
+
+	report, err := Decode(reencoded.Image, DecodeOptions{TrustedKeys: []TrustedKey{{Name: "owner", PublicKey: key.Public()}}})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+	require.NotNil(t, report.Signature)
+	assert.False(t, report.Signature.Verified)
+}
+
+func TestEncodeDecode_SidecarSigned(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(crand.Reader)
+	require.NoError(t, err)
+
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{Mode: ModeSidecar, Signer: key})
+	require.NoError(t, err)
+
+	data, err := json.Marshal(encoded.Proof)
+	require.NoError(t, err)
+
+	proof := &Proof{}
+	require.NoError(t, json.Unmarshal(data, proof))
+	assert.Equal(t, encoded.Proof.Signature, proof.Signature)
+
+	report, err := Decode(encoded.Image, DecodeOptions{Proof: proof, TrustedKeys: []TrustedKey{{Name: "owner", PublicKey: pub}}})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+	require.NotNil(t, report.Signature)
+	assert.True(t, report.Signature.Verified)
+	assert.Equal(t, "owner", report.Signature.Signer)
+}
+
+func TestEncode_UnsupportedSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), crand.Reader)
+	require.NoError(t, err)
+
+	_, err = Encode(noiseImage(200, 150), EncodeOptions{Signer: key})
+	assert.True(t, errors.Is(err, ErrUnsupportedSigner))
+}
+
+func TestDecode_MetadataRecovered(t *testing.T) {
+	encoded, err := Encode(noiseImage(400, 300), EncodeOptions{})
+	require.NoError(t, err)
+
+	report, err := Decode(encoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+	assert.True(t, report.Recovered)
+	assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+
+	// Paint two thirds of the chunks black. They all lead to the same wrong root, which
+	// outnumbers the intact chunks, but the metadata survives in the remaining third.
+	tampered := map[ChunkIndex]bool{}
+	i := 0
+	for x, boundsRow := range encoded.Bounds {
+		for y, bound := range boundsRow {
+			if i%3 != 0 {
+				tamper(encoded.Image, bound)
+				tampered[ChunkIndex{x, y}] = true
+			}
+			i++
+		}
+	}
+
+	report, err = Decode(encoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, Tampered, report.Verdict)
+	assert.True(t, report.Recovered)
+	assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+	for _, c := range report.Chunks {
+		assert.Equal(t, !tampered[c.Index], c.Match, c.Index)
+	}
+}
+
+func TestDecode_MetadataSpliced(t *testing.T) {
+	for name, key := range map[string][]byte{"plain": nil, "keyed": []byte("key")} {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := Encode(noiseImage(400, 300), EncodeOptions{Key: key})
+			require.NoError(t, err)
+
+			// Another image with the same chunk grid
+			other := noiseImage(400, 300)
+			tamper(other, image.Rect(0, 0, 400, 300))
+			otherEncoded, err := Encode(other, EncodeOptions{Key: key})
+			require.NoError(t, err)
+			require.Equal(t, encoded.Bounds, otherEncoded.Bounds)
+
+			// Splice the first quarter of the chunks, which carry the data shards of
+			// the metadata, from the other image into the encoded image
+			cols, rows := len(encoded.Bounds), len(encoded.Bounds[0])
+			spliced := map[ChunkIndex]bool{}
+			for x, boundsRow := range encoded.Bounds {
+				for y, bound := range boundsRow {
+					if x*rows+y < cols*rows/4 {
+						draw.Draw(encoded.Image.(draw.Image), bound, otherEncoded.Image, bound.Min, draw.Src)
+						spliced[ChunkIndex{x, y}] = true
+					}
+				}
+			}
+
+			report, err := Decode(encoded.Image, DecodeOptions{Key: key})
+			require.NoError(t, err)
+			assert.Equal(t, Tampered, report.Verdict)
+			assert.False(t, report.Recovered)
+			assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+			for _, c := range report.Chunks {
+				assert.Equal(t, !spliced[c.Index], c.Match, c.Index)
+			}
+		})
+	}
+}
+
+func TestOutvoted(t *testing.T) {
+	root, other := []byte{0xAB}, []byte{0xCD}
+	counts := map[string]int{hex.EncodeToString(root): 2, hex.EncodeToString(other): 2}
+	assert.False(t, outvoted(root, counts))
+
+	counts[hex.EncodeToString(other)]++
+	assert.True(t, outvoted(root, counts))
+	assert.False(t, outvoted(other, counts))
+
+	// A recovered root that no chunk leads to is outvoted by any other root
+	assert.True(t, outvoted([]byte{0xEF}, counts))
+	assert.False(t, outvoted(root, map[string]int{}))
+}
+
+func TestRecoverMetadata(t *testing.T) {
+	h := header{version: FormatVersion, cols: 8, rows: 6, hashBits: 96}
+	m := metadata{version: FormatVersion, cols: 8, rows: 6, width: 400, height: 300, root: bytes.Repeat([]byte{0xAB}, 12)}
+
+	shards, err := m.shards(h, nil)
+	require.NoError(t, err)
+	require.Len(t, shards, h.cols*h.rows)
+
+	shardsByChunk := map[int][]byte{}
+	for i, shard := range shards {
+		shardsByChunk[i] = shard
+	}
+
+	recovered, err := recoverMetadata(h, nil, shardsByChunk)
+	require.NoError(t, err)
+	assert.Equal(t, m, *recovered)
+
+	// Manipulated and missing shards are erasures. Three quarters of them can be lost.
+	data, _ := metadataShards(h.cols*h.rows, h.hashBits)
+	for i := 0; i < len(shards)-data; i++ {
+		if i%2 == 0 {
+			shardsByChunk[i][0] ^= 1
+		} else {
+			delete(shardsByChunk, i)
+		}
+	}
+
+	recovered, err = recoverMetadata(h, nil, shardsByChunk)
+	require.NoError(t, err)
+	assert.Equal(t, m, *recovered)
+
+	shardsByChunk[len(shards)-1][0] ^= 1
+	_, err = recoverMetadata(h, nil, shardsByChunk)
+	assert.Equal(t, errMetadataLost, err)
+}
+
+func TestRecoverMetadata_Inconsistent(t *testing.T) {
+	h := header{version: FormatVersion, cols: 8, rows: 6, hashBits: 96}
+	m := metadata{version: FormatVersion, cols: 8, rows: 6, width: 400, height: 300, root: bytes.Repeat([]byte{0xAB}, 12)}
+	other := m
+	other.root = bytes.Repeat([]byte{0xCD}, 12)
+
+	shards, err := m.shards(h, nil)
+	require.NoError(t, err)
+	otherShards, err := other.shards(h, nil)
+	require.NoError(t, err)
+
+	// The data shards of another image don't fit the parity shards
+	data, _ := metadataShards(h.cols*h.rows, h.hashBits)
+	shardsByChunk := map[int][]byte{}
+	for i := range shards {
+		shardsByChunk[i] = shards[i]
+		if i < data {
+			shardsByChunk[i] = otherShards[i]
+		}
+	}
+
+	_, err = recoverMetadata(h, nil, shardsByChunk)
+	assert.Equal(t, errMetadataInconsistent, err)
+}
+
+func TestRecoverMetadata_Keyed(t *testing.T) {
+	h := header{version: FormatVersion, hashAlg: DefaultHashAlgorithm, cols: 8, rows: 6, hashBits: 96}
+	m := metadata{version: FormatVersion, cols: 8, rows: 6, width: 400, height: 300, root: bytes.Repeat([]byte{0xAB}, 12)}
+	key := []byte("key")
+
+	shards, err := m.shards(h, key)
+	require.NoError(t, err)
+
+	shardsByChunk := map[int][]byte{}
+	for i, shard := range shards {
+		shardsByChunk[i] = shard
+	}
+
+	recovered, err := recoverMetadata(h, key, shardsByChunk)
+	require.NoError(t, err)
+	assert.Equal(t, m, *recovered)
+
+	// Without the key the checksums don't match
+	_, err = recoverMetadata(h, nil, shardsByChunk)
+	assert.Equal(t, errMetadataLost, err)
+	_, err = recoverMetadata(h, []byte("other"), shardsByChunk)
+	assert.Equal(t, errMetadataLost, err)
+
+	// Shards with a fixed up CRC-32 checksum or moved to another index are erasures
+	unkeyed, err := m.shards(h, nil)
+	require.NoError(t, err)
+	data, _ := metadataShards(h.cols*h.rows, h.hashBits)
+	for i := 0; i < len(shards)-data+1; i++ {
+		if i%2 == 0 {
+			shardsByChunk[i] = unkeyed[i]
+		} else {
+			shardsByChunk[i] = shards[i-1]
+		}
+	}
+	_, err = recoverMetadata(h, key, shardsByChunk)
+	assert.Equal(t, errMetadataLost, err)
+}
+
+func TestEncodeDecode_Scattered(t *testing.T) {
+	key := []byte("secret")
+	img := noiseImage(400, 300)
+
+	plain, err := Encode(img, EncodeOptions{Key: key})
+	require.NoError(t, err)
+
+	encoded, err := Encode(img, EncodeOptions{Key: key, Scatter: true, RowHashBits: 8})
+	require.NoError(t, err)
+
+	_, err = Decode(encoded.Image, DecodeOptions{})
+	assert.Equal(t, ErrKeyRequired, err)
+
+	report, err := Decode(encoded.Image, DecodeOptions{Key: key})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+	assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+
+	// The payload isn't crammed into the top rows of the chunk anymore
+	bound := encoded.Bounds[1][1]
+	changed := func(e *Encoded) int {
+		count := 0
+		for x := bound.Min.X; x < bound.Max.X; x++ {
+			for y := bound.Min.Y + bound.Dy()/2; y < bound.Max.Y; y++ {
+				if e.Image.(*image.NRGBA).NRGBAAt(x, y) != img.NRGBAAt(x, y) {
+					count++
+				}
+			}
+		}
+		return count
+	}
+	assert.Greater(t, changed(encoded), 10*changed(plain))
+
+	tamper(encoded.Image, image.Rect(bound.Max.X-12, bound.Max.Y-3, bound.Max.X-2, bound.Max.Y-1))
+	report, err = Decode(encoded.Image, DecodeOptions{Key: key})
+	require.NoError(t, err)
+	assert.Equal(t, Tampered, report.Verdict)
+	require.Len(t, report.TamperedChunks(), 1)
+	assert.Equal(t, ChunkIndex{1, 1}, report.TamperedChunks()[0].Index)
+	assert.Equal(t, []int{bound.Dy() - 3, bound.Dy() - 2}, report.TamperedChunks()[0].TamperedRows)
+
+	report, err = Decode(encoded.Image, DecodeOptions{Key: []byte("wrong")})
+	require.NoError(t, err)
+	assert.Equal(t, Tampered, report.Verdict)
+	assert.Len(t, report.TamperedChunks(), len(report.Chunks))
+}
+
+func TestEncode_ScatterWithoutKey(t *testing.T) {
+	_, err := Encode(noiseImage(200, 150), EncodeOptions{Scatter: true})
+	assert.Equal(t, ErrScatterWithoutKey, err)
+
+	for _, mode := range []Mode{ModeSidecar, ModePNGChunk} {
+		_, err = Encode(noiseImage(200, 150), EncodeOptions{Mode: mode, Scatter: true, Key: []byte("secret")})
+		assert.Error(t, err)
+	}
+}
+
+func TestEncodeDecode_Encrypted(t *testing.T) {
+	rawKey := bytes.Repeat([]byte{0x42}, EncryptionKeyLength)
+	for _, cipherID := range []Cipher{AES256GCM, ChaCha20Poly1305} {
+		for _, kdf := range []KDF{Argon2id, Scrypt, KDFNone} {
+			t.Run(cipherID.String()+"/"+kdf.String(), func(t *testing.T) {
+				key := []byte("passphrase")
+				if kdf == KDFNone {
+					key = rawKey
+				}
+
+				encoded, err := Encode(noiseImage(200, 150), EncodeOptions{EncryptionKey: key, Cipher: cipherID, KDF: kdf})
+				require.NoError(t, err)
+
+				_, err = Decode(encoded.Image, DecodeOptions{})
+				assert.Equal(t, ErrEncryptionKeyRequired, err)
+
+				report, err := Decode(encoded.Image, DecodeOptions{EncryptionKey: key})
+				require.NoError(t, err)
+				assert.Equal(t, Intact, report.Verdict)
+				assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+
+				wrong := append([]byte{}, key...)
+				wrong[0] ^= 1
+				_, err = Decode(encoded.Image, DecodeOptions{EncryptionKey: wrong})
+				assert.Equal(t, ErrDecryption, err)
+			})
+		}
+	}
+}
+
+func TestEncode_EncryptedNoise(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, EncryptionKeyLength)
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 150))
+	tamper(img, img.Bounds())
+
+	// onesRatio returns the share of one bits in the LSBs of the top left chunk after the salt
+	onesRatio := func(opts EncodeOptions) float64 {
+		encoded, err := Encode(img, opts)
+		require.NoError(t, err)
+
+		c := &chunk.Chunk{Pixels: chunk.NewPixels(encoded.Image.(*image.NRGBA).SubImage(encoded.Bounds[0][0]))}
+		_, err = c.Read(make([]byte, (chunk.HeaderBitLength+chunk.LocatorBitLength)/chunk.BitsPerByte+saltLength))
+		require.NoError(t, err)
+
+		buf := make([]byte, c.MaxPayloadSize()-(chunk.HeaderBitLength+chunk.LocatorBitLength)/chunk.BitsPerByte-saltLength)
+		_, err = c.Read(buf)
+		require.NoError(t, err)
+
+		ones := 0
+		for _, b := range buf {
+			for ; b > 0; b &= b - 1 {
+				ones++
+			}
+		}
+		return float64(ones) / float64(len(buf)*chunk.BitsPerByte)
+	}
+
+	assert.Less(t, onesRatio(EncodeOptions{}), 0.3)
+	assert.InDelta(t, 0.5, onesRatio(EncodeOptions{EncryptionKey: key, KDF: KDFNone}), 0.05)
+}
+
+func TestDecode_EncryptedTampered(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, EncryptionKeyLength)
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{EncryptionKey: key, KDF: KDFNone, Cipher: ChaCha20Poly1305})
+	require.NoError(t, err)
+
+	// Flipping a single LSB of the payload is detected even though the chunk hash doesn't change
+	bound := encoded.Bounds[1][2]
+	encoded.Image.(*image.NRGBA).Pix[encoded.Image.(*image.NRGBA).PixOffset(bound.Min.X+bound.Dx()/2, bound.Min.Y+bound.Dy()/2)] ^= 1
+
+	report, err := Decode(encoded.Image, DecodeOptions{EncryptionKey: key})
+	require.NoError(t, err)
+	assert.Equal(t, Tampered, report.Verdict)
+	assert.Equal(t, encoded.MerkleRoot, report.MerkleRoot)
+	require.Len(t, report.TamperedChunks(), 1)
+	assert.Equal(t, ChunkIndex{1, 2}, report.TamperedChunks()[0].Index)
+}
+
+func TestDecode_EncryptedUnauthenticated(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, EncryptionKeyLength)
+	encoded, err := Encode(noiseImage(200, 150), EncodeOptions{EncryptionKey: key, KDF: KDFNone})
+	require.NoError(t, err)
+
+	// Chunks whose payload can't be authenticated don't agree on a root with each other
+	img := encoded.Image.(*image.NRGBA)
+	for x, boundsRow := range encoded.Bounds {
+		for y, bound := range boundsRow {
+			if x != 0 || y != 0 {
+				img.Pix[img.PixOffset(bound.Min.X+bound.Dx()/2, bound.Min.Y+bound.Dy()/2)] ^= 1
+			}
+		}
+	}
+
+	report, err := Decode(img, DecodeOptions{EncryptionKey: key})
+	require.NoError(t, err)
+	assert.Equal(t, Unverifiable, report.Verdict)
+	assert.Len(t, report.RootCounts(), 1)
+}
+
+func TestEncode_InvalidEncryption(t *testing.T) {
+	for _, opts := range []EncodeOptions{
+		{EncryptionKey: []byte("short"), KDF: KDFNone},
+		{EncryptionKey: []byte("passphrase"), Cipher: 9},
+		{EncryptionKey: []byte("passphrase"), KDF: 9},
+		{EncryptionKey: []byte("passphrase"), Mode: ModeSidecar},
+		{EncryptionKey: []byte("passphrase"), Mode: ModePNGChunk},
+	} {
+		_, err := Encode(noiseImage(200, 150), opts)
+		assert.Error(t, err)
+	}
+}
+
+func TestEncodeDecode_Message(t *testing.T) {
+	img := noiseImage(200, 150)
+	key := bytes.Repeat([]byte{0x42}, EncryptionKeyLength)
+
+	for name, opts := range map[string]EncodeOptions{
+		"plain":     {},
+		"rows":      {RowHashBits: 8, Planes: 2},
+		"encrypted": {EncryptionKey: key, KDF: KDFNone, Key: key, Scatter: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			capacity, err := Capacity(img, opts)
+			require.NoError(t, err)
+			assert.Greater(t, capacity, 1000)
+
+			plain, err := Encode(img, opts)
+			require.NoError(t, err)
+			assert.Equal(t, capacity, plain.MessageCapacity)
+
+			report, err := Decode(plain.Image, DecodeOptions{Key: opts.Key, EncryptionKey: opts.EncryptionKey})
+			require.NoError(t, err)
+			_, err = report.Message()
+			assert.Equal(t, ErrNoMessage, err)
+
+			opts.Message = make([]byte, capacity+1)
+			rand.New(rand.NewSource(1)).Read(opts.Message)
+			_, err = Encode(img, opts)
+			assert.True(t, errors.Is(err, ErrMessageTooLarge))
+
+			// The message doesn't affect the chunk grid and can fill the capacity completely
+			for _, length := range []int{0, 17, capacity} {
+				opts.Message = opts.Message[:length]
+				encoded, err := Encode(img, opts)
+				require.NoError(t, err)
+				assert.Equal(t, plain.Bounds, encoded.Bounds)
+
+				report, err := Decode(encoded.Image, DecodeOptions{Key: opts.Key, EncryptionKey: opts.EncryptionKey})
+				require.NoError(t, err)
+				assert.Equal(t, Intact, report.Verdict)
+
+				message, err := report.Message()
+				require.NoError(t, err)
+				assert.Equal(t, opts.Message, message)
+			}
+		})
+	}
+}
+
+func TestDecode_MessageCorrupted(t *testing.T) {
+	img := noiseImage(200, 150)
+
+	capacity, err := Capacity(img, EncodeOptions{})
+	require.NoError(t, err)
+
+	encoded, err := Encode(img, EncodeOptions{Message: bytes.Repeat([]byte("secret"), capacity/6)})
+	require.NoError(t, err)
+
+	// The LSBs that carry the message aren't part of the chunk hash
+	bound := encoded.Bounds[0][0]
+	encoded.Image.(*image.NRGBA).Pix[encoded.Image.(*image.NRGBA).PixOffset(bound.Min.X+bound.Dx()/2, bound.Max.Y-2)] ^= 1
+
+	report, err := Decode(encoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+
+	_, err = report.Message()
+	assert.True(t, errors.Is(err, ErrMessageCorrupted))
+}
+
+func TestDecode_MessageTamperedChunk(t *testing.T) {
+	img := noiseImage(200, 150)
+	encoded, err := Encode(img, EncodeOptions{Message: []byte("secret")})
+	require.NoError(t, err)
+
+	// The message lies in the first chunk, whose LSBs stay untouched while the chunk hash changes
+	bound := encoded.Bounds[0][0]
+	encoded.Image.(*image.NRGBA).Pix[encoded.Image.(*image.NRGBA).PixOffset(bound.Min.X+bound.Dx()/2, bound.Max.Y-2)] ^= 2
+
+	report, err := Decode(encoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, Tampered, report.Verdict)
+
+	_, err = report.Message()
+	assert.True(t, errors.Is(err, ErrMessageCorrupted))
+}
+
+func TestEncode_MessageSidecar(t *testing.T) {
+	_, err := Encode(noiseImage(200, 150), EncodeOptions{Mode: ModeSidecar, Message: []byte("secret")})
+	assert.Error(t, err)
+}
+
+func TestInspect(t *testing.T) {
+	img := noiseImage(200, 150)
+	_, priv, err := ed25519.GenerateKey(crand.Reader)
+	require.NoError(t, err)
+	key := bytes.Repeat([]byte{0x42}, EncryptionKeyLength)
+
+	for name, opts := range map[string]EncodeOptions{
+		"plain":     {},
+		"signed":    {Signer: priv, HashBits: 128},
+		"rows":      {RowHashBits: 8, Planes: 2},
+		"encrypted": {EncryptionKey: key, Cipher: ChaCha20Poly1305, KDF: KDFNone, RowHashBits: 4},
+	} {
+		t.Run(name, func(t *testing.T) {
+			report, err := Inspect(img, opts)
+			require.NoError(t, err)
+
+			encoded, err := Encode(img, opts)
+			require.NoError(t, err)
+
+			assert.Equal(t, 200, report.Width)
+			assert.Equal(t, 150, report.Height)
+			assert.Equal(t, len(encoded.Bounds), report.Cols)
+			assert.Equal(t, len(encoded.Bounds[0]), report.Rows)
+			assert.Equal(t, encoded.MessageCapacity, report.MessageCapacity)
+			require.Len(t, report.Chunks, report.Cols*report.Rows)
+
+			freeBytes := 0
+			for _, c := range report.Chunks {
+				assert.Equal(t, encoded.Bounds[c.Index.X][c.Index.Y], c.Bounds)
+				assert.LessOrEqual(t, c.RequiredBits, c.AvailableBits)
+				assert.LessOrEqual(t, c.SpareBytes*8, c.AvailableBits-c.RequiredBits)
+				assert.True(t, c.Bounds.Dx() >= report.MinChunkSize.X && c.Bounds.Dx() <= report.MaxChunkSize.X)
+				assert.True(t, c.Bounds.Dy() >= report.MinChunkSize.Y && c.Bounds.Dy() <= report.MaxChunkSize.Y)
+				freeBytes += c.SpareBytes
+			}
+			assert.Equal(t, freeBytes, report.FreeBytes)
+
+			if opts.RowHashBits > 0 {
+				assert.Equal(t, image.Pt(report.MinChunkSize.X, 1), report.MinRegionSize)
+			} else {
+				assert.Equal(t, report.MinChunkSize, report.MinRegionSize)
+			}
+		})
+	}
+}
+
+func TestInspect_Sidecar(t *testing.T) {
+	report, err := Inspect(noiseImage(200, 150), EncodeOptions{Mode: ModeSidecar})
+	require.NoError(t, err)
+	assert.Zero(t, report.FreeBytes)
+	assert.Zero(t, report.MessageCapacity)
+	for _, c := range report.Chunks {
+		assert.Zero(t, c.RequiredBits)
+		assert.Greater(t, c.AvailableBits, 0)
+	}
+
+	_, err = Inspect(noiseImage(10, 10), EncodeOptions{})
+	assert.Equal(t, ErrImageTooSmall, err)
+}
+
+func TestEncodeDecode_16Bit(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA64(image.Rect(0, 0, 200, 150))
+	for i := range img.Pix {
+		if i%8 >= 6 {
+			img.Pix[i] = 255
+		} else {
+			img.Pix[i] = uint8(rnd.Intn(256))
+		}
+	}
+
+	encoded, err := Encode(img, EncodeOptions{Planes: 2})
+	require.NoError(t, err)
+
+	// Only the low bits of the least significant byte of every sample are altered
+	encodedImg, ok := encoded.Image.(*image.NRGBA64)
+	require.True(t, ok)
+	for i := 0; i < len(img.Pix); i += 2 {
+		require.Equal(t, img.Pix[i], encodedImg.Pix[i])
+		require.Equal(t, img.Pix[i+1]>>2, encodedImg.Pix[i+1]>>2)
+	}
+
+	// The 16-bit PNG decodes as *image.RGBA64 as it is opaque
+	buf := &bytes.Buffer{}
+	require.NoError(t, png.Encode(buf, encoded.Image))
+	decoded, err := png.Decode(buf)
+	require.NoError(t, err)
+	assert.Equal(t, color.RGBA64Model, decoded.ColorModel())
+
+	report, err := Decode(decoded, DecodeOptions{ExpectedRoot: encoded.MerkleRoot})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+
+	// Reducing the bit depth to 8 bits loses the Merkle tree information
+	_, err = Decode(chunk.ImageToNRGBA(decoded), DecodeOptions{})
+	assert.Error(t, err)
+
+	tamper(encoded.Image, encoded.Bounds[1][1].Inset(2))
+	report, err = Decode(encoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, Tampered, report.Verdict)
+	require.Len(t, report.TamperedChunks(), 1)
+	assert.Equal(t, ChunkIndex{1, 1}, report.TamperedChunks()[0].Index)
+}
+
+func TestEncodeDecode_Gray(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	gray := image.NewGray(image.Rect(0, 0, 600, 300))
+	gray16 := image.NewGray16(gray.Bounds())
+	rnd.Read(gray.Pix)
+	rnd.Read(gray16.Pix)
+
+	tests := []struct {
+		name  string
+		img   image.Image
+		model color.Model
+	}{
+		{"8-bit", gray, color.GrayModel},
+		{"16-bit", gray16, color.Gray16Model},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := Encode(tt.img, EncodeOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, tt.model, encoded.Image.ColorModel())
+
+			// The output stays grayscale through a PNG round trip
+			buf := &bytes.Buffer{}
+			require.NoError(t, png.Encode(buf, encoded.Image))
+			decoded, err := png.Decode(buf)
+			require.NoError(t, err)
+			assert.Equal(t, tt.model, decoded.ColorModel())
+
+			report, err := Decode(decoded, DecodeOptions{ExpectedRoot: encoded.MerkleRoot})
+			require.NoError(t, err)
+			assert.Equal(t, Intact, report.Verdict)
+
+			last := ChunkIndex{len(encoded.Bounds) - 1, len(encoded.Bounds[0]) - 1}
+			tamper(encoded.Image, encoded.Bounds[last.X][last.Y].Inset(2))
+			report, err = Decode(encoded.Image, DecodeOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, Tampered, report.Verdict)
+			require.Len(t, report.TamperedChunks(), 1)
+			assert.Equal(t, last, report.TamperedChunks()[0].Index)
+		})
+	}
+
+	// The gray value counts as the red channel
+	_, err := Encode(gray, EncodeOptions{Channels: chunk.ChannelA})
+	assert.Error(t, err)
+
+	// Converting the image to color loses the Merkle tree information
+	encoded, err := Encode(gray, EncodeOptions{})
+	require.NoError(t, err)
+	_, err = Decode(chunk.ImageToNRGBA(encoded.Image), DecodeOptions{})
+	assert.Equal(t, ErrNotEncoded, err)
+}
+
+func TestEncodeDecode_Paletted(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	palette := color.Palette{}
+	for i := 0; i < 16; i++ {
+		palette = append(palette, color.NRGBA{R: uint8(rnd.Intn(256)), G: uint8(rnd.Intn(256)), B: uint8(rnd.Intn(256)), A: 255})
+	}
+	palette[0] = color.NRGBA{A: 255}
+
+	img := image.NewPaletted(image.Rect(0, 0, 600, 300), palette)
+	for i := range img.Pix {
+		img.Pix[i] = uint8(1 + rnd.Intn(len(palette)-1))
+	}
+
+	encoded, err := Encode(img, EncodeOptions{})
+	require.NoError(t, err)
+
+	// The palette indexes carry the payload without changing any color
+	encodedImg, ok := encoded.Image.(*image.Paletted)
+	require.True(t, ok)
+	assert.Len(t, encodedImg.Palette, 2*len(palette))
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			require.Equal(t, img.At(x, y), encodedImg.At(x, y))
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, png.Encode(buf, encoded.Image))
+	decoded, err := png.Decode(buf)
+	require.NoError(t, err)
+	require.IsType(t, &image.Paletted{}, decoded)
+
+	report, err := Decode(decoded, DecodeOptions{ExpectedRoot: encoded.MerkleRoot})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+
+	// Painting pixels or altering the palette is detected
+	tamper(encodedImg, encoded.Bounds[1][0].Inset(2))
+	report, err = Decode(encodedImg, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, Tampered, report.Verdict)
+	require.Len(t, report.TamperedChunks(), 1)
+	assert.Equal(t, ChunkIndex{1, 0}, report.TamperedChunks()[0].Index)
+
+	// A color of the palette occurs in every chunk, so no chunk leads to the root anymore
+	recolored := decoded.(*image.Paletted)
+	recolored.Palette[2] = color.NRGBA{R: 1, A: 255}
+	report, err = Decode(recolored, DecodeOptions{ExpectedRoot: encoded.MerkleRoot})
+	require.NoError(t, err)
+	assert.Equal(t, Unverifiable, report.Verdict)
+	assert.Len(t, report.TamperedChunks(), len(report.Chunks))
+
+	// Palettes that can't be paired are encoded in color
+	large := image.NewPaletted(img.Bounds(), palette)
+	for len(large.Palette) <= 128 {
+		large.Palette = append(large.Palette, color.White)
+	}
+	copy(large.Pix, img.Pix)
+	encoded, err = Encode(large, EncodeOptions{})
+	require.NoError(t, err)
+	assert.IsType(t, &image.NRGBA{}, encoded.Image)
+
+	report, err = Decode(encoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+}
+
+func TestEncodeDecode_Alpha(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 150))
+	img64 := image.NewNRGBA64(img.Bounds())
+	rnd.Read(img.Pix)
+	rnd.Read(img64.Pix)
+
+	// Some pixels are fully transparent
+	for i := 0; i < img.Bounds().Dx()*img.Bounds().Dy(); i += 7 {
+		img.Pix[4*i+3] = 0
+		img64.Pix[8*i+6], img64.Pix[8*i+7] = 0, 0
+	}
+
+	for _, src := range []image.Image{img, img64} {
+		encoded, err := Encode(src, EncodeOptions{Planes: 2})
+		require.NoError(t, err)
+
+		// The PNG round trip keeps every bit of semi-transparent and transparent pixels
+		buf := &bytes.Buffer{}
+		require.NoError(t, png.Encode(buf, encoded.Image))
+		decoded, err := png.Decode(buf)
+		require.NoError(t, err)
+		assert.Equal(t, encoded.Image, decoded)
+
+		report, err := Decode(decoded, DecodeOptions{ExpectedRoot: encoded.MerkleRoot})
+		require.NoError(t, err)
+		assert.Equal(t, Intact, report.Verdict)
+	}
+}
+
+func TestEncodeDecode_SkipTransparent(t *testing.T) {
+	// A transparent border and hole like in a logo
+	img := noiseImage(300, 200)
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			if x < 20 || y >= 170 || (x-150)*(x-150)+(y-80)*(y-80) < 40*40 {
+				img.Pix[img.PixOffset(x, y)+3] = 0
+			}
+		}
+	}
+
+	// Premultiplying alpha discards the color of transparent pixels
+	premultiply := func(img image.Image) image.Image {
+		return chunk.ImageToNRGBA(chunk.ImageToRGBA(img))
+	}
+
+	encoded, err := Encode(img, EncodeOptions{})
+	require.NoError(t, err)
+	report, err := Decode(premultiply(encoded.Image), DecodeOptions{ExpectedRoot: encoded.MerkleRoot})
+	require.NoError(t, err)
+	assert.NotEqual(t, Intact, report.Verdict)
+
+	opts := EncodeOptions{SkipTransparent: true, Message: []byte("message")}
+	encoded, err = Encode(img, opts)
+	require.NoError(t, err)
+
+	report, err = Decode(premultiply(encoded.Image), DecodeOptions{ExpectedRoot: encoded.MerkleRoot})
+	require.NoError(t, err)
+	assert.Equal(t, Intact, report.Verdict)
+	message, err := report.Message()
+	require.NoError(t, err)
+	assert.Equal(t, opts.Message, message)
+
+	// Transparent pixels after the first row of every chunk are left untouched
+	encodedImg := encoded.Image.(*image.NRGBA)
+	for _, boundsRow := range encoded.Bounds {
+		for _, bound := range boundsRow {
+			for y := bound.Min.Y + 1; y < bound.Max.Y; y++ {
+				for x := bound.Min.X; x < bound.Max.X; x++ {
+					if img.NRGBAAt(x, y).A == 0 {
+						require.Equal(t, img.NRGBAAt(x, y), encodedImg.NRGBAAt(x, y))
+					}
+				}
+			}
+		}
+	}
+
+	capacity, err := Capacity(img, opts)
+	require.NoError(t, err)
+	assert.Equal(t, encoded.MessageCapacity, capacity)
+
+	// Painting a transparent region is still detected
+	tamper(encoded.Image, image.Rect(0, 175, 300, 200))
+	report, err = Decode(encoded.Image, DecodeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, Tampered, report.Verdict)
+
+	_, err = Encode(img, EncodeOptions{SkipTransparent: true, Channels: ChannelR | ChannelA})
+	assert.True(t, errors.Is(err, ErrInvalidOptions))
+
+	// Transparent pixels only carry payload in ModeLSB
+	for _, mode := range []Mode{ModeSidecar, ModePNGChunk} {
+		_, err = Encode(img, EncodeOptions{Mode: mode, SkipTransparent: true})
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	img := noiseImage(600, 300)
+	_, signer, err := ed25519.GenerateKey(crand.Reader)
+	require.NoError(t, err)
+	opts := EncodeOptions{Key: []byte("key"), Signer: signer, Message: []byte("hello")}
+
+	encoded, err := Encode(img, opts)
+	require.NoError(t, err)
+
+	// A PNG round trip keeps every bit
+	buf := &bytes.Buffer{}
+	require.NoError(t, png.Encode(buf, encoded.Image))
+	decoded, err := png.Decode(buf)
+	require.NoError(t, err)
+	assert.NoError(t, SelfCheck(decoded, encoded, opts))
+
+	// Even the highest JPEG quality destroys the Merkle tree information
+	buf.Reset()
+	require.NoError(t, jpeg.Encode(buf, encoded.Image, &jpeg.Options{Quality: 100}))
+	decoded, err = jpeg.Decode(buf)
+	require.NoError(t, err)
+	err = SelfCheck(decoded, encoded, opts)
+	assert.True(t, errors.Is(err, ErrSelfCheckFailed), err)
+
+	// The keys, the signer and the message of the options need to match
+	other := opts
+	other.Key = []byte("other")
+	assert.True(t, errors.Is(SelfCheck(encoded.Image, encoded, other), ErrSelfCheckFailed))
+
+	_, other.Signer, err = ed25519.GenerateKey(crand.Reader)
+	require.NoError(t, err)
+	other.Key = opts.Key
+	assert.True(t, errors.Is(SelfCheck(encoded.Image, encoded, other), ErrSelfCheckFailed))
+
+	other = opts
+	other.Message = []byte("world")
+	assert.True(t, errors.Is(SelfCheck(encoded.Image, encoded, other), ErrSelfCheckFailed))
+
+	// Without embedded information the image is checked against the proof
+	opts = EncodeOptions{Mode: ModeSidecar}
+	encoded, err = Encode(img, opts)
+	require.NoError(t, err)
+	assert.NoError(t, SelfCheck(img, encoded, opts))
+
+	tamper(encoded.Image, encoded.Bounds[0][0])
+	assert.True(t, errors.Is(SelfCheck(encoded.Image, encoded, opts), ErrSelfCheckFailed))
+}